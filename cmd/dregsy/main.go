@@ -24,6 +24,9 @@ import (
 
 	log "github.com/sirupsen/logrus"
 
+	"github.com/xelalexv/dregsy/internal/pkg/metrics"
+	"github.com/xelalexv/dregsy/internal/pkg/redact"
+	"github.com/xelalexv/dregsy/internal/pkg/relays/native"
 	"github.com/xelalexv/dregsy/internal/pkg/sync"
 )
 
@@ -31,6 +34,7 @@ import (
 func init() {
 
 	log.SetOutput(os.Stdout)
+	log.AddHook(&redact.Hook{})
 
 	format := strings.ToLower(os.Getenv("LOG_FORMAT"))
 	switch format {
@@ -69,6 +73,21 @@ var testArgs []string
 var testSync chan *sync.Sync
 var dregsyExitCode int
 
+//
+const synopsis = `synopsis: dregsy [command] [options]
+
+commands:
+  run        sync according to config, keep running if there are periodic
+             tasks; this is the default when no command is given
+  once       run each task exactly once, regardless of interval or schedule
+  validate   only validate config
+  list-tags  list tags of an image, using the credentials and TLS settings
+             configured for its registry, if any
+  version    show version
+
+Use 'dregsy {command} -h' to see the options of a command.
+`
+
 //
 func version() {
 	log.Infof("dregsy %s", DregsyVersion)
@@ -79,43 +98,219 @@ func main() {
 
 	dregsyExitCode = 0
 
-	fs := flag.NewFlagSet("dregsy", flag.ContinueOnError)
-	configFile := fs.String("config", "", "path to config file")
-
+	var args []string
 	if testRound {
 		if len(testArgs) > 0 {
-			failOnError(fs.Parse(testArgs))
+			args = testArgs
 		} else {
 			panic("no test arguments")
 		}
 	} else {
-		failOnError(fs.Parse(os.Args[1:]))
+		args = os.Args[1:]
+	}
+
+	cmd := "run"
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		cmd = args[0]
+		args = args[1:]
+	}
+
+	var err error
+
+	switch cmd {
+	case "run":
+		err = run(args, false)
+	case "once":
+		err = run(args, true)
+	case "validate":
+		err = validate(args)
+	case "list-tags":
+		err = listTags(args)
+	case "version":
+		fmt.Printf("dregsy %s\n", DregsyVersion)
+	case "help":
+		fmt.Print(synopsis)
+	default:
+		fmt.Printf("unknown command '%s'\n\n", cmd)
+		fmt.Print(synopsis)
+		exit(1)
+		return
+	}
+
+	if err == flag.ErrHelp {
+		exit(0)
+		return
+	}
+
+	log.Debug("exit main")
+	failOnError(err)
+	exit(0)
+}
+
+// run syncs according to the config; with once, each task is run exactly once
+func run(args []string, once bool) error {
+
+	name := "run"
+	if once {
+		name = "once"
+	}
+
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	configFile := fs.String("config", "", "path to config file")
+	metricsAddr := fs.String("metrics-addr", "",
+		"address on which to serve metrics, e.g. ':9090'; overrides config")
+	dryRun := fs.Bool("dry-run", false,
+		"print a plan of what would be synced, without syncing anything")
+	fs.Usage = func() {
+		fmt.Fprint(fs.Output(), synopsis)
+		fmt.Fprintf(fs.Output(), "\noptions for '%s':\n", name)
+		fs.PrintDefaults()
+	}
+	var tasks taskNames
+	if once {
+		fs.Var(&tasks, "task",
+			"name of task to run; can be repeated, all tasks if omitted")
+	}
+
+	if err := fs.Parse(args); err != nil {
+		return err
 	}
 
 	if len(*configFile) == 0 {
 		version()
-		fmt.Println("synopsis: dregsy -config={config file}")
-		exit(1)
+		fmt.Print(synopsis)
+		return fmt.Errorf("no config file given")
 	}
 
 	version()
 
 	conf, err := sync.LoadConfig(*configFile)
-	failOnError(err)
+	if err != nil {
+		return err
+	}
+
+	if once {
+		if err := conf.OneOff(tasks); err != nil {
+			return err
+		}
+	}
+
+	if *dryRun {
+		// keep the plan on stdout clean, and don't serve metrics for a run
+		// that doesn't sync anything
+		log.SetOutput(os.Stderr)
+		conf.Metrics = nil
+
+	} else if *metricsAddr != "" {
+		if conf.Metrics == nil {
+			conf.Metrics = &metrics.Config{}
+		}
+		conf.Metrics.Listen = *metricsAddr
+		if err := conf.Metrics.Validate(); err != nil {
+			return err
+		}
+	}
 
 	s, err := sync.New(conf)
-	failOnError(err)
+	if err != nil {
+		return err
+	}
+	defer s.Dispose()
+
+	if *dryRun {
+		return s.Plan(conf, os.Stdout)
+	}
 
 	if testRound {
 		testSync <- s
 	}
 
-	err = s.SyncFromConfig(conf)
-	s.Dispose()
+	return s.SyncFromConfig(conf)
+}
 
-	log.Debug("exit main")
-	failOnError(err)
-	exit(0)
+// validate only loads and validates the config
+func validate(args []string) error {
+
+	fs := flag.NewFlagSet("validate", flag.ContinueOnError)
+	configFile := fs.String("config", "", "path to config file")
+
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if len(*configFile) == 0 {
+		return fmt.Errorf("no config file given")
+	}
+
+	if _, err := sync.LoadConfig(*configFile); err != nil {
+		return err
+	}
+
+	fmt.Printf("config '%s' is valid\n", *configFile)
+	return nil
+}
+
+// listTags lists the tags of an image
+func listTags(args []string) error {
+
+	fs := flag.NewFlagSet("list-tags", flag.ContinueOnError)
+	configFile := fs.String("config", "",
+		"path to config file, for using the relay, credentials, and TLS "+
+			"settings configured for the image's registry")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(),
+			"synopsis: dregsy list-tags [-config={config file}] {image ref}")
+		fs.PrintDefaults()
+	}
+
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return fmt.Errorf("expecting exactly one image ref")
+	}
+
+	conf := &sync.SyncConfig{Relay: native.RelayID}
+	if len(*configFile) > 0 {
+		c, err := sync.LoadConfig(*configFile)
+		if err != nil {
+			return err
+		}
+		conf = c
+	}
+	conf.Metrics = nil
+
+	s, err := sync.New(conf)
+	if err != nil {
+		return err
+	}
+	defer s.Dispose()
+
+	tags, err := s.ListTags(conf, fs.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	for _, t := range tags {
+		fmt.Println(t)
+	}
+	return nil
+}
+
+// taskNames collects the values of a repeated -task option
+type taskNames []string
+
+//
+func (n *taskNames) String() string {
+	return strings.Join(*n, ",")
+}
+
+//
+func (n *taskNames) Set(val string) error {
+	*n = append(*n, val)
+	return nil
 }
 
 //
@@ -17,6 +17,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"testing"
@@ -25,6 +26,7 @@ import (
 
 	log "github.com/sirupsen/logrus"
 
+	"github.com/xelalexv/dregsy/internal/pkg/auth"
 	"github.com/xelalexv/dregsy/internal/pkg/relays/skopeo"
 	"github.com/xelalexv/dregsy/internal/pkg/sync"
 	"github.com/xelalexv/dregsy/internal/pkg/test"
@@ -127,8 +129,10 @@ func tryConfig(th *test.TestHelper, file string, ticks int, wait time.Duration,
 		for _, m := range t.Mappings {
 			ref := fmt.Sprintf("%s%s", t.Target.Registry, m.To)
 			th.AssertNoError(t.Target.RefreshAuth())
-			tags, err := skopeo.ListAllTags(ref,
-				skopeo.DecodeJSONAuth(t.Target.Auth), "", t.Target.SkipTLSVerify)
+			creds, err := auth.Decode(t.Target.Auth)
+			th.AssertNoError(err)
+			tags, err := skopeo.ListAllTags(context.Background(),
+				ref, creds, "", t.Target.SkipTLSVerify)
 			th.AssertNoError(err)
 			th.AssertEquivalentSlices(m.Tags, tags)
 		}
@@ -0,0 +1,78 @@
+/*
+	Copyright 2020 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package auth
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// Credentials for a registry, either username & password, or a bearer token.
+// Relays receive them encoded as base64 JSON, which is also the form in which
+// they can be given in the config, and which the Docker engine API expects.
+type Credentials struct {
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+	Token    string `json:"registrytoken,omitempty"`
+}
+
+// Decode decodes base64 JSON credentials. An empty string yields nil, i.e. no
+// credentials.
+func Decode(authBase64 string) (*Credentials, error) {
+
+	if authBase64 == "" {
+		return nil, nil
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(authBase64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid auth, not base64 encoded: %v", err)
+	}
+
+	var ret Credentials
+	if err := json.Unmarshal(decoded, &ret); err != nil {
+		return nil, fmt.Errorf("invalid auth, not JSON: %v", err)
+	}
+
+	if err := ret.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid auth, %v", err)
+	}
+
+	return &ret, nil
+}
+
+// Validate checks that either username, or token are set, but not both
+func (c *Credentials) Validate() error {
+	if c.Token != "" {
+		if c.Username != "" || c.Password != "" {
+			return errors.New("token cannot be combined with username & password")
+		}
+		return nil
+	}
+	if c.Username == "" {
+		return errors.New("neither username nor token set")
+	}
+	return nil
+}
+
+// Encode encodes the credentials as base64 JSON
+func (c *Credentials) Encode() string {
+	data, _ := json.Marshal(c)
+	return base64.StdEncoding.EncodeToString(data)
+}
@@ -0,0 +1,63 @@
+/*
+	Copyright 2020 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package auth
+
+import (
+	"testing"
+
+	"github.com/xelalexv/dregsy/internal/pkg/test"
+)
+
+//
+func TestDecode(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	// {"username": "anonymous", "password": "anonymous"}
+	c, err := Decode(
+		"eyJ1c2VybmFtZSI6ICJhbm9ueW1vdXMiLCAicGFzc3dvcmQiOiAiYW5vbnltb3VzIn0K")
+	th.AssertNoError(err)
+	th.AssertEqual("anonymous", c.Username)
+	th.AssertEqual("anonymous", c.Password)
+
+	c, err = Decode("")
+	th.AssertNoError(err)
+	th.AssertNil(c)
+
+	c, err = Decode((&Credentials{Token: "s3cr3t"}).Encode())
+	th.AssertNoError(err)
+	th.AssertEqual("s3cr3t", c.Token)
+
+	c = &Credentials{Username: "alex", Password: `"quoted"`}
+	d, err := Decode(c.Encode())
+	th.AssertNoError(err)
+	th.AssertEqual(*c, *d)
+
+	_, err = Decode("not base64")
+	th.AssertError(err, "invalid auth, not base64 encoded")
+
+	// alex:secret
+	_, err = Decode("YWxleDpzZWNyZXQ=")
+	th.AssertError(err, "invalid auth, not JSON")
+
+	_, err = Decode((&Credentials{Password: "secret"}).Encode())
+	th.AssertError(err, "invalid auth, neither username nor token set")
+
+	_, err = Decode((&Credentials{Username: "alex", Token: "t"}).Encode())
+	th.AssertError(err,
+		"invalid auth, token cannot be combined with username & password")
+}
@@ -0,0 +1,222 @@
+/*
+	Copyright 2020 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package auth
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+//
+const dockerHubServer = "https://index.docker.io/v1/"
+
+// HelperPrefix is the prefix of the executables of Docker credential helpers;
+// the helper configured as 'pass' e.g. is run as 'docker-credential-pass'
+var HelperPrefix = "docker-credential-"
+
+// HelperTimeout is how long a credential helper may take to respond
+var HelperTimeout = 30 * time.Second
+
+// errNotFound is returned by credential helpers that have no credentials for a
+// server
+var errNotFound = errors.New("credentials not found")
+
+// dockerConfig is the part of a Docker config.json dealing with credentials
+type dockerConfig struct {
+	Auths       map[string]*dockerAuth `json:"auths"`
+	CredsStore  string                 `json:"credsStore"`
+	CredHelpers map[string]string      `json:"credHelpers"`
+}
+
+//
+type dockerAuth struct {
+	Auth          string `json:"auth"`
+	Username      string `json:"username"`
+	Password      string `json:"password"`
+	IdentityToken string `json:"identitytoken"`
+	RegistryToken string `json:"registrytoken"`
+}
+
+// FromDockerConfig looks up the credentials for registry in Docker config file
+// file, the same way the Docker CLI does: a credential helper configured for
+// the registry in credHelpers takes precedence, followed by the credsStore,
+// and finally the credentials stored in auths. Credential helpers are run via
+// their stdin/stdout protocol. Returns nil if there are no credentials for the
+// registry.
+func FromDockerConfig(file, registry string) (*Credentials, error) {
+
+	path, err := ExpandHome(file)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read Docker config: %v", err)
+	}
+
+	var conf dockerConfig
+	if err := json.Unmarshal(data, &conf); err != nil {
+		return nil, fmt.Errorf("cannot parse Docker config '%s': %v", file, err)
+	}
+
+	host := normalizeServer(registry)
+
+	for server, helper := range conf.CredHelpers {
+		if normalizeServer(server) == host {
+			creds, err := fromHelper(helper, server)
+			if err == errNotFound {
+				return nil, nil
+			}
+			return creds, err
+		}
+	}
+
+	server := registry
+	if host == normalizeServer(dockerHubServer) {
+		server = dockerHubServer
+	}
+
+	if conf.CredsStore != "" {
+		creds, err := fromHelper(conf.CredsStore, server)
+		if err != errNotFound {
+			return creds, err
+		}
+	}
+
+	for server, a := range conf.Auths {
+		if a != nil && normalizeServer(server) == host {
+			return a.credentials(server)
+		}
+	}
+
+	return nil, nil
+}
+
+//
+func (a *dockerAuth) credentials(server string) (*Credentials, error) {
+
+	switch {
+
+	case a.RegistryToken != "":
+		return &Credentials{Token: a.RegistryToken}, nil
+
+	case a.IdentityToken != "":
+		return nil, fmt.Errorf(
+			"identity token for '%s' in Docker config not supported", server)
+
+	case a.Auth != "":
+		decoded, err := base64.StdEncoding.DecodeString(a.Auth)
+		if err != nil {
+			return nil, fmt.Errorf(
+				"invalid auth for '%s' in Docker config: %v", server, err)
+		}
+		parts := strings.SplitN(string(decoded), ":", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf(
+				"invalid auth for '%s' in Docker config", server)
+		}
+		return &Credentials{Username: parts[0], Password: parts[1]}, nil
+
+	case a.Username != "":
+		return &Credentials{Username: a.Username, Password: a.Password}, nil
+	}
+
+	return nil, nil
+}
+
+// helperResponse is the output of a credential helper's get command
+type helperResponse struct {
+	ServerURL string `json:"ServerURL"`
+	Username  string `json:"Username"`
+	Secret    string `json:"Secret"`
+}
+
+// fromHelper runs credential helper 'get' for server
+func fromHelper(helper, server string) (*Credentials, error) {
+
+	ctx, cancel := context.WithTimeout(context.Background(), HelperTimeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, HelperPrefix+helper, "get")
+	cmd.Stdin = strings.NewReader(server)
+	bufOut := new(bytes.Buffer)
+	bufErr := new(bytes.Buffer)
+	cmd.Stdout = bufOut
+	cmd.Stderr = bufErr
+
+	if err := cmd.Run(); err != nil {
+		msg := strings.TrimSpace(bufOut.String() + " " + bufErr.String())
+		// helpers report missing credentials on stdout
+		if strings.Contains(msg, "credentials not found") {
+			return nil, errNotFound
+		}
+		return nil, fmt.Errorf("credential helper '%s' failed for '%s': %v, %s",
+			helper, server, err, msg)
+	}
+
+	var resp helperResponse
+	if err := json.Unmarshal(bufOut.Bytes(), &resp); err != nil {
+		return nil, fmt.Errorf(
+			"cannot parse response of credential helper '%s': %v", helper, err)
+	}
+
+	if resp.Username == "<token>" {
+		return nil, fmt.Errorf(
+			"identity token from credential helper '%s' not supported", helper)
+	}
+
+	return &Credentials{Username: resp.Username, Password: resp.Secret}, nil
+}
+
+// normalizeServer reduces a server address as found in a Docker config to its
+// host name, mapping all aliases of Docker Hub to the same name
+func normalizeServer(server string) string {
+	s := strings.ToLower(server)
+	s = strings.TrimPrefix(strings.TrimPrefix(s, "https://"), "http://")
+	if ix := strings.Index(s, "/"); ix != -1 {
+		s = s[:ix]
+	}
+	switch s {
+	case "docker.io", "registry-1.docker.io", "registry.hub.docker.com":
+		return "index.docker.io"
+	}
+	return s
+}
+
+// ExpandHome replaces a leading ~ in path with the home directory of the
+// current user
+func ExpandHome(path string) (string, error) {
+	if path != "~" && !strings.HasPrefix(path, "~/") {
+		return path, nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, path[1:]), nil
+}
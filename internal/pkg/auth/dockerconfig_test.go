@@ -0,0 +1,112 @@
+/*
+	Copyright 2020 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package auth
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/xelalexv/dregsy/internal/pkg/test"
+)
+
+// fakeHelper is a credential helper that knows credentials for
+// registry.acme.com only
+const fakeHelper = `#!/bin/sh
+[ "$1" = "get" ] || exit 2
+read server
+case "${server}" in
+  registry.acme.com)
+    echo '{"ServerURL": "registry.acme.com", "Username": "alex", "Secret": "s3cr3t"}' ;;
+  https://index.docker.io/v1/)
+    echo '{"ServerURL": "https://index.docker.io/v1/", "Username": "hub", "Secret": "hub-s3cr3t"}' ;;
+  broken.acme.com)
+    echo "something went wrong" >&2
+    exit 1 ;;
+  *)
+    echo "credentials not found in native keychain"
+    exit 1 ;;
+esac
+`
+
+//
+func TestFromDockerConfig(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	dir, err := ioutil.TempDir("", "dregsy-docker-config-")
+	th.AssertNoError(err)
+	defer os.RemoveAll(dir)
+
+	th.AssertNoError(ioutil.WriteFile(
+		filepath.Join(dir, "docker-credential-fake"), []byte(fakeHelper), 0700))
+	defer func(prefix string) { HelperPrefix = prefix }(HelperPrefix)
+	HelperPrefix = filepath.Join(dir, "docker-credential-")
+
+	// alex:secret
+	file := filepath.Join(dir, "config.json")
+	th.AssertNoError(ioutil.WriteFile(file, []byte(`{
+		"auths": {
+			"https://static.acme.com/v2/": {"auth": "YWxleDpzZWNyZXQ="},
+			"token.acme.com": {"registrytoken": "t0ken"},
+			"registry.acme.com": {}
+		},
+		"credHelpers": {
+			"helper.acme.com": "fake",
+			"broken.acme.com": "fake"
+		}
+	}`), 0600))
+
+	creds, err := FromDockerConfig(file, "static.acme.com")
+	th.AssertNoError(err)
+	th.AssertEqual(Credentials{Username: "alex", Password: "secret"}, *creds)
+
+	creds, err = FromDockerConfig(file, "token.acme.com")
+	th.AssertNoError(err)
+	th.AssertEqual(Credentials{Token: "t0ken"}, *creds)
+
+	// helper doesn't know helper.acme.com
+	creds, err = FromDockerConfig(file, "helper.acme.com")
+	th.AssertNoError(err)
+	th.AssertNil(creds)
+
+	_, err = FromDockerConfig(file, "broken.acme.com")
+	th.AssertError(err, "credential helper 'fake' failed for 'broken.acme.com'")
+
+	creds, err = FromDockerConfig(file, "unknown.acme.com")
+	th.AssertNoError(err)
+	th.AssertNil(creds)
+
+	// with a credentials store, registry.acme.com is looked up there, and
+	// Docker Hub under its canonical server address
+	th.AssertNoError(ioutil.WriteFile(file, []byte(`{
+		"auths": {"registry.acme.com": {}, "https://index.docker.io/v1/": {}},
+		"credsStore": "fake"
+	}`), 0600))
+
+	creds, err = FromDockerConfig(file, "registry.acme.com")
+	th.AssertNoError(err)
+	th.AssertEqual(Credentials{Username: "alex", Password: "s3cr3t"}, *creds)
+
+	creds, err = FromDockerConfig(file, "registry.hub.docker.com")
+	th.AssertNoError(err)
+	th.AssertEqual(Credentials{Username: "hub", Password: "hub-s3cr3t"}, *creds)
+
+	_, err = FromDockerConfig(filepath.Join(dir, "missing.json"), "acme.com")
+	th.AssertError(err, "cannot read Docker config")
+}
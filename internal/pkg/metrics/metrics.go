@@ -0,0 +1,163 @@
+/*
+	Copyright 2020 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package metrics
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "dregsy"
+
+//
+var registry = prometheus.NewRegistry()
+
+//
+var (
+	taskRuns = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "task_runs_total",
+			Help:      "Number of sync task runs.",
+		}, []string{"task"})
+
+	taskFailures = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "task_failures_total",
+			Help:      "Number of sync task runs that had errors.",
+		}, []string{"task"})
+
+	taskDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "task_duration_seconds",
+			Help:      "Duration of sync task runs.",
+			Buckets:   []float64{1, 5, 15, 30, 60, 120, 300, 600, 1800, 3600},
+		}, []string{"task"})
+
+	taskLastSuccess = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "task_last_success_timestamp_seconds",
+			Help:      "Time of the last sync task run without errors.",
+		}, []string{"task"})
+
+	tags = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "tags_total",
+			Help: "Number of processed tags by outcome, i.e. synced, " +
+				"up-to-date (skipped), failed, or pruned.",
+		}, []string{"task", "outcome"})
+
+	tagDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "tag_sync_duration_seconds",
+			Help:      "Time the relay took for syncing a single tag.",
+			Buckets:   []float64{0.5, 1, 5, 15, 30, 60, 120, 300, 600},
+		}, []string{"task"})
+
+	authRefreshFailures = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "auth_refresh_failures_total",
+			Help:      "Number of failed authentication refreshes.",
+		}, []string{"registry"})
+
+	rateLimitLimit = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "rate_limit_limit",
+			Help:      "Pull quota per window last reported by a registry.",
+		}, []string{"registry"})
+
+	rateLimitRemaining = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "rate_limit_remaining",
+			Help:      "Remaining pull quota last reported by a registry.",
+		}, []string{"registry"})
+
+	rateLimitExceeded = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "rate_limit_exceeded_total",
+			Help: "Number of times a registry was paused because its " +
+				"rate limit was exceeded.",
+		}, []string{"registry"})
+)
+
+//
+func init() {
+	registry.MustRegister(
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+		taskRuns, taskFailures, taskDuration, taskLastSuccess,
+		tags, tagDuration, authRefreshFailures,
+		rateLimitLimit, rateLimitRemaining, rateLimitExceeded)
+}
+
+// Handler returns the HTTP handler for exposing metrics to Prometheus
+func Handler() http.Handler {
+	return promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+}
+
+// TaskRun records a run of task which took duration, and either failed or not
+func TaskRun(task string, duration time.Duration, failed bool) {
+	taskRuns.WithLabelValues(task).Inc()
+	taskDuration.WithLabelValues(task).Observe(duration.Seconds())
+	if failed {
+		taskFailures.WithLabelValues(task).Inc()
+	} else {
+		taskLastSuccess.WithLabelValues(task).SetToCurrentTime()
+	}
+}
+
+// TagOutcome records the outcome of processing a single tag in task
+func TagOutcome(task, outcome string) {
+	tags.WithLabelValues(task, outcome).Inc()
+}
+
+// TagSynced records the time the relay took for syncing a single tag in task
+func TagSynced(task string, duration time.Duration) {
+	tagDuration.WithLabelValues(task).Observe(duration.Seconds())
+}
+
+// AuthRefreshFailed records a failed authentication refresh for registry
+func AuthRefreshFailed(registry string) {
+	authRefreshFailures.WithLabelValues(registry).Inc()
+}
+
+// RateLimitQuota records the pull quota last reported by registry; a negative
+// limit means the registry did not report it
+func RateLimitQuota(registry string, limit, remaining int) {
+	if limit >= 0 {
+		rateLimitLimit.WithLabelValues(registry).Set(float64(limit))
+	}
+	rateLimitRemaining.WithLabelValues(registry).Set(float64(remaining))
+}
+
+// RateLimitExceeded records that registry was paused because its rate limit
+// was exceeded
+func RateLimitExceeded(registry string) {
+	rateLimitExceeded.WithLabelValues(registry).Inc()
+}
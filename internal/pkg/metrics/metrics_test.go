@@ -0,0 +1,77 @@
+/*
+	Copyright 2020 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package metrics
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/xelalexv/dregsy/internal/pkg/test"
+)
+
+//
+func TestMetricsServer(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	s, err := NewServer(&Config{Listen: "127.0.0.1:0"})
+	th.AssertNoError(err)
+	s.Start()
+	defer s.Close()
+
+	TaskRun("task-ok", 2*time.Second, false)
+	TaskRun("task-bad", time.Second, true)
+	TagOutcome("task-ok", "synced")
+	TagOutcome("task-ok", "synced")
+	TagOutcome("task-ok", "up-to-date")
+	TagSynced("task-ok", time.Second)
+	AuthRefreshFailed("123456789012.dkr.ecr.eu-central-1.amazonaws.com")
+
+	resp, err := http.Get(fmt.Sprintf("http://%s/metrics", s.Addr()))
+	th.AssertNoError(err)
+	defer resp.Body.Close()
+	th.AssertEqual(http.StatusOK, resp.StatusCode)
+
+	data, err := ioutil.ReadAll(resp.Body)
+	th.AssertNoError(err)
+	body := string(data)
+
+	for _, m := range []string{
+		`dregsy_task_runs_total{task="task-ok"} 1`,
+		`dregsy_task_runs_total{task="task-bad"} 1`,
+		`dregsy_task_failures_total{task="task-bad"} 1`,
+		`dregsy_task_duration_seconds_count{task="task-ok"} 1`,
+		`dregsy_task_last_success_timestamp_seconds{task="task-ok"}`,
+		`dregsy_tags_total{outcome="synced",task="task-ok"} 2`,
+		`dregsy_tags_total{outcome="up-to-date",task="task-ok"} 1`,
+		`dregsy_tag_sync_duration_seconds_count{task="task-ok"} 1`,
+		`dregsy_auth_refresh_failures_total{registry="123456789012.dkr.ecr.eu-central-1.amazonaws.com"} 1`,
+	} {
+		if !strings.Contains(body, m) {
+			t.Errorf("metric missing: %s", m)
+		}
+	}
+
+	th.AssertFalse(strings.Contains(body,
+		`dregsy_task_failures_total{task="task-ok"}`))
+	th.AssertFalse(strings.Contains(body,
+		`dregsy_task_last_success_timestamp_seconds{task="task-bad"}`))
+}
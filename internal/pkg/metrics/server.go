@@ -0,0 +1,108 @@
+/*
+	Copyright 2020 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package metrics
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const defaultPath = "/metrics"
+
+//
+type Config struct {
+	Listen string `yaml:"listen"`
+	Path   string `yaml:"path"`
+}
+
+//
+func (c *Config) Validate() error {
+	if c.Listen == "" {
+		return errors.New("metrics listen address not set")
+	}
+	if c.Path == "" {
+		c.Path = defaultPath
+	}
+	return nil
+}
+
+// Server is the HTTP listener exposing the metrics endpoint, and any additional
+// endpoints registered via Handle
+type Server struct {
+	server   *http.Server
+	mux      *http.ServeMux
+	listener net.Listener
+}
+
+// NewServer creates a server as configured by conf, and starts listening. The
+// server does not serve any requests until Start is called.
+func NewServer(conf *Config) (*Server, error) {
+
+	if err := conf.Validate(); err != nil {
+		return nil, err
+	}
+
+	l, err := net.Listen("tcp", conf.Listen)
+	if err != nil {
+		return nil, fmt.Errorf("cannot listen on '%s': %v", conf.Listen, err)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle(conf.Path, Handler())
+
+	return &Server{
+		server:   &http.Server{Handler: mux},
+		mux:      mux,
+		listener: l,
+	}, nil
+}
+
+// Handle registers handler for path; needs to be called before Start
+func (s *Server) Handle(path string, handler http.Handler) {
+	s.mux.Handle(path, handler)
+}
+
+// Addr returns the address the server is listening on
+func (s *Server) Addr() string {
+	return s.listener.Addr().String()
+}
+
+// Start serves requests in the background
+func (s *Server) Start() {
+	log.WithField("address", s.Addr()).Info("serving metrics")
+	go func() {
+		if err := s.server.Serve(s.listener); err != nil &&
+			err != http.ErrServerClosed {
+			log.Errorf("metrics server stopped: %v", err)
+		}
+	}()
+}
+
+// Close stops the server, waiting a few seconds for active requests to finish
+func (s *Server) Close() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err := s.server.Shutdown(ctx)
+	s.listener.Close() // in case server was never started
+	return err
+}
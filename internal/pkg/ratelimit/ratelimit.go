@@ -0,0 +1,265 @@
+/*
+	Copyright 2020 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package ratelimit
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/xelalexv/dregsy/internal/pkg/metrics"
+	"github.com/xelalexv/dregsy/internal/pkg/retry"
+)
+
+// DefaultPause is how long a registry is paused after it reported that its rate
+// limit was exceeded, when it neither tells when to come back, nor reported the
+// window of its quota before
+const DefaultPause = 10 * time.Minute
+
+// Quota is the pull quota a registry last reported via its RateLimit-Limit and
+// RateLimit-Remaining response headers
+type Quota struct {
+	Limit     int
+	Remaining int
+	Window    time.Duration
+	Time      time.Time
+}
+
+//
+type registryState struct {
+	quota       *Quota
+	pausedUntil time.Time
+}
+
+//
+var (
+	mutex      sync.Mutex
+	registries = map[string]*registryState{}
+)
+
+// Observe inspects response resp received from registry, records the quota
+// reported in its headers, if any, and pauses the registry if the response
+// says that the rate limit was exceeded
+func Observe(registry string, resp *http.Response) {
+
+	if q := parseQuota(resp.Header); q != nil {
+		mutex.Lock()
+		state(registry).quota = q
+		mutex.Unlock()
+		metrics.RateLimitQuota(Key(registry), q.Limit, q.Remaining)
+		log.WithFields(log.Fields{
+			"registry":  registry,
+			"limit":     q.Limit,
+			"remaining": q.Remaining}).Debug("rate limit quota")
+	}
+
+	if resp.StatusCode == http.StatusTooManyRequests {
+		Exceeded(registry, parseRetryAfter(resp.Header.Get("Retry-After")))
+	}
+}
+
+// Exceeded pauses registry for duration d because its rate limit was exceeded.
+// If d is 0, the registry is paused for the window of the quota it last
+// reported, i.e. until the window resets, or for DefaultPause if no window is
+// known. If the registry is already paused, nothing changes. Returned is the
+// time until which the registry is paused.
+func Exceeded(registry string, d time.Duration) time.Time {
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	s := state(registry)
+	now := time.Now()
+	if s.pausedUntil.After(now) {
+		return s.pausedUntil
+	}
+
+	if d <= 0 {
+		d = DefaultPause
+		if s.quota != nil && s.quota.Window > 0 {
+			d = s.quota.Window
+		}
+	}
+	s.pausedUntil = now.Add(d)
+	metrics.RateLimitExceeded(Key(registry))
+	log.WithField("registry", registry).Warnf(
+		"rate limit exceeded, pausing registry until %s",
+		s.pausedUntil.Format(time.RFC3339))
+
+	return s.pausedUntil
+}
+
+// Error is an error saying that the rate limit was exceeded, along with the
+// registry that reported it. Relays syncing images talk to source and target
+// registry, so they use this to tell which of the two it was.
+type Error struct {
+	Registry string
+	Err      error
+}
+
+//
+func (e *Error) Error() string {
+	return e.Err.Error()
+}
+
+//
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Attribute wraps err into an Error for registry, if it says that the rate
+// limit was exceeded; any other error is returned as is
+func Attribute(registry string, err error) error {
+	if !retry.IsRateLimited(err) {
+		return err
+	}
+	return &Error{Registry: registry, Err: err}
+}
+
+// RegistryOf returns the registry that err was attributed to, or an empty
+// string if it wasn't
+func RegistryOf(err error) string {
+	var rerr *Error
+	if errors.As(err, &rerr) {
+		return rerr.Registry
+	}
+	return ""
+}
+
+// PausedUntil returns the time until which registry is paused, and whether it
+// is currently paused at all
+func PausedUntil(registry string) (time.Time, bool) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	if s, ok := registries[Key(registry)]; ok &&
+		s.pausedUntil.After(time.Now()) {
+		return s.pausedUntil, true
+	}
+	return time.Time{}, false
+}
+
+// QuotaOf returns the quota last reported by registry, or nil if it never
+// reported one
+func QuotaOf(registry string) *Quota {
+	mutex.Lock()
+	defer mutex.Unlock()
+	if s, ok := registries[Key(registry)]; ok && s.quota != nil {
+		q := *s.quota
+		return &q
+	}
+	return nil
+}
+
+// Key normalizes registry, so that the different host names under which
+// Docker Hub is reachable all refer to the same rate limit
+func Key(registry string) string {
+	key := strings.ToLower(registry)
+	key = strings.TrimPrefix(key, "https://")
+	key = strings.TrimPrefix(key, "http://")
+	key = strings.TrimSuffix(key, "/")
+	switch key {
+	case "docker.io", "index.docker.io", "registry-1.docker.io",
+		"registry.hub.docker.com":
+		return "docker.io"
+	}
+	return key
+}
+
+// state returns the state for registry, creating it if necessary; the mutex
+// needs to be held
+func state(registry string) *registryState {
+	key := Key(registry)
+	s, ok := registries[key]
+	if !ok {
+		s = &registryState{}
+		registries[key] = s
+	}
+	return s
+}
+
+// parseQuota parses the rate limit headers sent by Docker Hub, which look like
+// 'RateLimit-Limit: 100;w=21600' and 'RateLimit-Remaining: 76;w=21600', where w
+// is the window in seconds
+func parseQuota(h http.Header) *Quota {
+
+	remaining, window, ok := parseLimitHeader(h.Get("RateLimit-Remaining"))
+	if !ok {
+		return nil
+	}
+
+	limit, w, ok := parseLimitHeader(h.Get("RateLimit-Limit"))
+	if !ok {
+		limit = -1
+	} else if window == 0 {
+		window = w
+	}
+
+	return &Quota{
+		Limit:     limit,
+		Remaining: remaining,
+		Window:    window,
+		Time:      time.Now(),
+	}
+}
+
+//
+func parseLimitHeader(val string) (int, time.Duration, bool) {
+
+	if val == "" {
+		return 0, 0, false
+	}
+
+	parts := strings.Split(val, ";")
+	n, err := strconv.Atoi(strings.TrimSpace(parts[0]))
+	if err != nil || n < 0 {
+		return 0, 0, false
+	}
+
+	var window time.Duration
+	for _, p := range parts[1:] {
+		p = strings.TrimSpace(p)
+		if strings.HasPrefix(p, "w=") {
+			if s, err := strconv.Atoi(p[2:]); err == nil && s > 0 {
+				window = time.Duration(s) * time.Second
+			}
+		}
+	}
+
+	return n, window, true
+}
+
+// parseRetryAfter parses a Retry-After header, which is either a number of
+// seconds or an HTTP date; 0 is returned if it is missing or malformed
+func parseRetryAfter(val string) time.Duration {
+	if val == "" {
+		return 0
+	}
+	if s, err := strconv.Atoi(val); err == nil && s > 0 {
+		return time.Duration(s) * time.Second
+	}
+	if t, err := http.ParseTime(val); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d
+		}
+	}
+	return 0
+}
@@ -0,0 +1,152 @@
+/*
+	Copyright 2020 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package ratelimit
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/xelalexv/dregsy/internal/pkg/test"
+)
+
+//
+func TestObserve(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	resp := &http.Response{StatusCode: http.StatusOK, Header: http.Header{}}
+	resp.Header.Set("RateLimit-Limit", "100;w=21600")
+	resp.Header.Set("RateLimit-Remaining", "76;w=21600")
+	Observe("registry-1.docker.io", resp)
+
+	q := QuotaOf("registry.hub.docker.com")
+	th.AssertNotNil(q)
+	th.AssertEqual(100, q.Limit)
+	th.AssertEqual(76, q.Remaining)
+	th.AssertEqual(6*time.Hour, q.Window)
+
+	_, paused := PausedUntil("docker.io")
+	th.AssertFalse(paused)
+
+	resp = &http.Response{
+		StatusCode: http.StatusTooManyRequests, Header: http.Header{}}
+	resp.Header.Set("Retry-After", "120")
+	Observe("observe.example.com", resp)
+
+	th.AssertNil(QuotaOf("observe.example.com"))
+	until, paused := PausedUntil("observe.example.com")
+	th.AssertTrue(paused)
+	th.AssertTrue(until.After(time.Now().Add(110 * time.Second)))
+	th.AssertTrue(until.Before(time.Now().Add(130 * time.Second)))
+}
+
+//
+func TestExceeded(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	_, paused := PausedUntil("exceeded.example.com")
+	th.AssertFalse(paused)
+
+	until := Exceeded("exceeded.example.com", 0)
+	th.AssertTrue(until.After(time.Now().Add(DefaultPause - time.Minute)))
+
+	// an active pause is neither shortened nor extended
+	th.AssertEqual(until, Exceeded("exceeded.example.com", time.Second))
+	th.AssertEqual(until, Exceeded("EXCEEDED.example.com", time.Hour))
+
+	got, paused := PausedUntil("exceeded.example.com")
+	th.AssertTrue(paused)
+	th.AssertEqual(until, got)
+
+	// after the pause ended, a new one starts
+	mutex.Lock()
+	registries[Key("exceeded.example.com")].pausedUntil = time.Now()
+	mutex.Unlock()
+	_, paused = PausedUntil("exceeded.example.com")
+	th.AssertFalse(paused)
+	th.AssertTrue(Exceeded("exceeded.example.com", time.Hour).After(until))
+}
+
+//
+func TestExceededWindow(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	// without Retry-After, the pause lasts until the quota window resets
+	resp := &http.Response{
+		StatusCode: http.StatusTooManyRequests, Header: http.Header{}}
+	resp.Header.Set("RateLimit-Limit", "100;w=21600")
+	resp.Header.Set("RateLimit-Remaining", "0;w=21600")
+	Observe("window.example.com", resp)
+
+	until, paused := PausedUntil("window.example.com")
+	th.AssertTrue(paused)
+	th.AssertTrue(until.After(time.Now().Add(6*time.Hour - time.Minute)))
+	th.AssertTrue(until.Before(time.Now().Add(6*time.Hour + time.Minute)))
+}
+
+//
+func TestAttribute(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	th.AssertNil(Attribute("attribute.example.com", nil))
+
+	err := errors.New("manifest unknown")
+	th.AssertEqual(err, Attribute("attribute.example.com", err))
+	th.AssertEqual("", RegistryOf(err))
+
+	err = Attribute("attribute.example.com",
+		errors.New("toomanyrequests: rate limit exceeded"))
+	th.AssertEqual("toomanyrequests: rate limit exceeded", err.Error())
+	th.AssertEqual("attribute.example.com", RegistryOf(err))
+	th.AssertEqual("attribute.example.com",
+		RegistryOf(fmt.Errorf("sync failed: %w", err)))
+}
+
+//
+func TestParseHeaders(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	h := http.Header{}
+	th.AssertNil(parseQuota(h))
+
+	h.Set("RateLimit-Remaining", "5")
+	q := parseQuota(h)
+	th.AssertNotNil(q)
+	th.AssertEqual(-1, q.Limit)
+	th.AssertEqual(5, q.Remaining)
+	th.AssertEqual(time.Duration(0), q.Window)
+
+	h.Set("RateLimit-Remaining", "garbage;w=60")
+	th.AssertNil(parseQuota(h))
+
+	th.AssertEqual(time.Duration(0), parseRetryAfter(""))
+	th.AssertEqual(time.Duration(0), parseRetryAfter("soon"))
+	th.AssertEqual(30*time.Second, parseRetryAfter("30"))
+	d := parseRetryAfter(
+		time.Now().Add(time.Hour).UTC().Format(http.TimeFormat))
+	th.AssertTrue(d > 59*time.Minute && d <= time.Hour)
+
+	th.AssertEqual("docker.io", Key("https://Index.Docker.io/"))
+	th.AssertEqual("localhost:5000", Key("localhost:5000"))
+}
@@ -0,0 +1,141 @@
+/*
+	Copyright 2020 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package redact
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	gosync "sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Mask is what secrets get replaced with
+const Mask = "***"
+
+// secrets shorter than this are not redacted, since this would garble the log
+// beyond recognition
+const minSecretLength = 4
+
+//
+var secrets = map[string]bool{}
+var replacer *strings.Replacer
+var mutex gosync.RWMutex
+
+// Register adds secrets to the set of values that get redacted. Secrets are
+// kept for the lifetime of the process, so that a rotated credential also does
+// not leak after it was replaced.
+func Register(values ...string) {
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	changed := false
+	for _, v := range values {
+		if len(v) >= minSecretLength && !secrets[v] {
+			secrets[v] = true
+			changed = true
+		}
+	}
+
+	if !changed {
+		return
+	}
+
+	// longest first, so that a secret contained in another one doesn't leave
+	// a part of that other one uncovered
+	var all []string
+	for s := range secrets {
+		all = append(all, s)
+	}
+	sort.Slice(all, func(i, j int) bool {
+		if len(all[i]) != len(all[j]) {
+			return len(all[i]) > len(all[j])
+		}
+		return all[i] < all[j]
+	})
+
+	var pairs []string
+	for _, s := range all {
+		pairs = append(pairs, s, Mask)
+	}
+	replacer = strings.NewReplacer(pairs...)
+}
+
+// String returns s with all registered secrets replaced by Mask
+func String(s string) string {
+	mutex.RLock()
+	r := replacer
+	mutex.RUnlock()
+	if r == nil {
+		return s
+	}
+	return r.Replace(s)
+}
+
+// reset forgets all registered secrets
+func reset() {
+	mutex.Lock()
+	defer mutex.Unlock()
+	secrets = map[string]bool{}
+	replacer = nil
+}
+
+// Hook is a logrus hook that redacts all registered secrets from the message
+// and fields of log entries
+type Hook struct{}
+
+//
+func (h *Hook) Levels() []log.Level {
+	return log.AllLevels
+}
+
+//
+func (h *Hook) Fire(entry *log.Entry) error {
+
+	entry.Message = String(entry.Message)
+
+	// The field map is shared with the entry the log call was made on, so
+	// it must not be modified. We rather replace it, if needed.
+	var data log.Fields
+	for k, v := range entry.Data {
+		var s string
+		switch val := v.(type) {
+		case string:
+			s = val
+		case error:
+			s = val.Error()
+		default:
+			s = fmt.Sprint(v)
+		}
+		if r := String(s); r != s {
+			if data == nil {
+				data = make(log.Fields, len(entry.Data))
+				for dk, dv := range entry.Data {
+					data[dk] = dv
+				}
+			}
+			data[k] = r
+		}
+	}
+	if data != nil {
+		entry.Data = data
+	}
+
+	return nil
+}
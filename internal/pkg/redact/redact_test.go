@@ -0,0 +1,79 @@
+/*
+	Copyright 2020 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package redact
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/xelalexv/dregsy/internal/pkg/test"
+)
+
+//
+func TestString(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+	defer reset()
+
+	th.AssertEqual("no secrets yet", String("no secrets yet"))
+
+	Register("", "abc", "s3cret", "s3cret-and-more")
+	th.AssertEqual("abc is too short, but *** is not",
+		String("abc is too short, but s3cret is not"))
+	th.AssertEqual("***, ***", String("s3cret-and-more, s3cret"))
+
+	reset()
+	th.AssertEqual("s3cret", String("s3cret"))
+}
+
+//
+func TestHook(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+	defer reset()
+
+	Register("t0psecret")
+
+	buf := new(bytes.Buffer)
+	logger := log.New()
+	logger.SetOutput(buf)
+	logger.SetFormatter(&log.JSONFormatter{})
+	logger.AddHook(&Hook{})
+
+	entry := logger.WithFields(log.Fields{
+		"auth":  "t0psecret",
+		"other": "harmless",
+		"count": 42,
+	})
+	entry.WithError(errors.New("login with t0psecret failed")).Error(
+		"copy failed: --creds=alex:t0psecret")
+
+	out := buf.String()
+	th.AssertFalse(strings.Contains(out, "t0psecret"))
+	th.AssertTrue(strings.Contains(out, `"auth":"***"`))
+	th.AssertTrue(strings.Contains(out, `"error":"login with *** failed"`))
+	th.AssertTrue(strings.Contains(out, `"msg":"copy failed: --creds=alex:***"`))
+	th.AssertTrue(strings.Contains(out, `"other":"harmless"`))
+	th.AssertTrue(strings.Contains(out, `"count":42`))
+
+	// fields of the original entry are left alone
+	th.AssertEqual("t0psecret", entry.Data["auth"])
+}
@@ -120,17 +120,23 @@ func (dc *dockerClient) open() error {
 }
 
 //
-func (dc *dockerClient) ping(attempts int, sleep time.Duration) (
-	types.Ping, error) {
+func (dc *dockerClient) ping(ctx context.Context, attempts int,
+	sleep time.Duration) (types.Ping, error) {
 	var err error
 	for i := 1; ; i++ {
-		if res, err := dc.client.Ping(context.Background()); err == nil {
+		var res types.Ping
+		if res, err = dc.client.Ping(ctx); err == nil {
 			return res, err
 		}
 		if i >= attempts {
 			break
 		}
-		time.Sleep(sleep)
+		select {
+		case <-time.After(sleep):
+		case <-ctx.Done():
+			return types.Ping{}, fmt.Errorf(
+				"pinging Docker server aborted: %v", ctx.Err())
+		}
 	}
 	return types.Ping{},
 		fmt.Errorf(
@@ -206,25 +212,25 @@ func match(filterRepo, filterPath, filterTag, ref string) (bool, error) {
 }
 
 //
-func (dc *dockerClient) pullImage(ref string, allTags bool, auth string,
-	verbose bool) error {
+func (dc *dockerClient) pullImage(ctx context.Context, ref string,
+	allTags bool, auth string, verbose bool) error {
 	opts := &types.ImagePullOptions{
 		All:          allTags,
 		RegistryAuth: auth,
 	}
-	rc, err := dc.client.ImagePull(context.Background(), ref, *opts)
+	rc, err := dc.client.ImagePull(ctx, ref, *opts)
 	return dc.handleLog(rc, err, verbose)
 }
 
 //
-func (dc *dockerClient) pushImage(image string, allTags bool, auth string,
-	verbose bool) error {
+func (dc *dockerClient) pushImage(ctx context.Context, image string,
+	allTags bool, auth string, verbose bool) error {
 
 	opts := &types.ImagePushOptions{
 		All:          allTags,
 		RegistryAuth: auth,
 	}
-	rc, err := dc.client.ImagePush(context.Background(), image, *opts)
+	rc, err := dc.client.ImagePush(ctx, image, *opts)
 	return dc.handleLog(rc, err, verbose)
 }
 
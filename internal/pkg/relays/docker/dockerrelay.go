@@ -17,25 +17,41 @@
 package docker
 
 import (
+	"context"
 	"fmt"
 	"io"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/docker/docker/client"
 	log "github.com/sirupsen/logrus"
+
+	"github.com/xelalexv/dregsy/internal/pkg/ratelimit"
+	"github.com/xelalexv/dregsy/internal/pkg/relays/native"
 )
 
 const RelayID = "docker"
 
+// DefaultCertsDir is where the Docker daemon looks for registry certs
+const DefaultCertsDir = "/etc/docker/certs.d"
+
 //
 type RelayConfig struct {
 	DockerHost string `yaml:"dockerhost"`
 	APIVersion string `yaml:"api-version"`
+	CertsDir   string `yaml:"certs-dir"`
 }
 
 //
 type DockerRelay struct {
 	client *dockerClient
+	// for talking to registries directly, where the daemon can't help
+	registry *native.Client
+	// syncs are serialized, since they pull, tag & push via the shared local
+	// image store of the daemon, so concurrent syncs of overlapping refs could
+	// interfere
+	mutex sync.Mutex
 }
 
 //
@@ -45,6 +61,7 @@ func NewDockerRelay(conf *RelayConfig, out io.Writer) (*DockerRelay, error) {
 
 	dockerHost := client.DefaultDockerHost
 	apiVersion := "1.24"
+	certsDir := DefaultCertsDir
 
 	if conf != nil {
 		if conf.DockerHost != "" {
@@ -53,6 +70,9 @@ func NewDockerRelay(conf *RelayConfig, out io.Writer) (*DockerRelay, error) {
 		if conf.APIVersion != "" {
 			apiVersion = conf.APIVersion
 		}
+		if conf.CertsDir != "" {
+			certsDir = conf.CertsDir
+		}
 	}
 
 	cli, err := newClient(dockerHost, apiVersion, out)
@@ -61,17 +81,18 @@ func NewDockerRelay(conf *RelayConfig, out io.Writer) (*DockerRelay, error) {
 	}
 
 	relay.client = cli
+	relay.registry = native.NewClient(certsDir)
 	return relay, nil
 }
 
 //
-func (r *DockerRelay) Prepare() error {
+func (r *DockerRelay) Prepare(ctx context.Context) error {
 
 	// when we begin, Docker daemon may not be ready yet, e.g. when dregsy runs
 	// side by side with a Docker-in-Docker container inside a pod on k8s
 	log.Info("pinging Docker daemon...")
 
-	if _, err := r.client.ping(30, 10*time.Second); err != nil {
+	if _, err := r.client.ping(ctx, 30, 10*time.Second); err != nil {
 		return err
 	}
 
@@ -85,26 +106,84 @@ func (r *DockerRelay) Dispose() error {
 	return r.client.close()
 }
 
+// ListTags lists the tags of image ref in its registry. Since the Docker
+// daemon has no means for this, we talk to the registry directly, using the
+// certs in the relay's certs dir.
+func (r *DockerRelay) ListTags(ctx context.Context, ref, auth string,
+	skipTLSVerify bool) ([]string, error) {
+	return r.registry.ListAllTags(ctx, ref, auth, skipTLSVerify)
+}
+
+//
+func (r *DockerRelay) ImageCreated(ctx context.Context, ref, auth string,
+	skipTLSVerify bool) (time.Time, error) {
+	return r.registry.ImageCreated(ctx, ref, auth, skipTLSVerify)
+}
+
 //
-func (r *DockerRelay) Sync(srcRef, srcAuth string, srcSkipTLSVerify bool,
+func (r *DockerRelay) ManifestDigest(ctx context.Context, ref, auth string,
+	skipTLSVerify bool) (string, error) {
+	return r.registry.ManifestDigest(ctx, ref, auth, skipTLSVerify)
+}
+
+// DeleteTag deletes image ref from its registry. As with listing tags, this is
+// done by talking to the registry directly.
+func (r *DockerRelay) DeleteTag(ctx context.Context, ref, auth string,
+	skipTLSVerify bool) error {
+	return r.registry.DeleteTag(ctx, ref, auth, skipTLSVerify)
+}
+
+// Sync pulls the source image for the given tags, or all tags if none are
+// given, re-tags, and pushes to the target. When ctx gets cancelled, any pull
+// or push in progress is aborted, and the tags not pushed yet are reported.
+func (r *DockerRelay) Sync(ctx context.Context,
+	srcRef, srcAuth string, srcSkipTLSVerify bool,
 	trgtRef, trgtAuth string, trgtSkipTLSVerify bool,
-	tags []string, verbose bool) error {
+	tags []string, policy string, verbose bool) error {
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	pushed, err := r.sync(
+		ctx, srcRef, srcAuth, trgtRef, trgtAuth, tags, verbose)
+
+	if err != nil && ctx.Err() != nil {
+		incomplete := "all"
+		if len(tags) > 0 {
+			incomplete = strings.Join(tags[pushed:], ", ")
+		}
+		return fmt.Errorf("sync aborted (%v), tags left incomplete: %s",
+			ctx.Err(), incomplete)
+	}
+	return err
+}
+
+// sync does the actual work for Sync, and returns the number of tags pushed.
+// Errors saying that a rate limit was exceeded are attributed to the source
+// registry when pulling, and to the target registry when pushing.
+func (r *DockerRelay) sync(ctx context.Context, srcRef, srcAuth string,
+	trgtRef, trgtAuth string, tags []string, verbose bool) (int, error) {
+
+	pushed := 0
+	srcRegistry := registryOf(srcRef)
+	trgtRegistry := registryOf(trgtRef)
 
 	log.WithField("ref", srcRef).Info("pulling source image")
 	var err error
 
 	if len(tags) == 0 {
-		if err = r.pull(srcRef, srcAuth, true, verbose); err != nil {
-			return fmt.Errorf(
-				"error pulling source image '%s': %v", srcRef, err)
+		if err = r.pull(ctx, srcRef, srcAuth, true, verbose); err != nil {
+			return pushed, ratelimit.Attribute(srcRegistry, fmt.Errorf(
+				"error pulling source image '%s': %v", srcRef, err))
 		}
 
 	} else {
 		for _, tag := range tags {
 			srcRefTagged := fmt.Sprintf("%s:%s", srcRef, tag)
-			if err = r.pull(srcRefTagged, srcAuth, false, verbose); err != nil {
-				return fmt.Errorf(
-					"error pulling source image '%s': %v", srcRefTagged, err)
+			if err = r.pull(
+				ctx, srcRefTagged, srcAuth, false, verbose); err != nil {
+				return pushed, ratelimit.Attribute(srcRegistry, fmt.Errorf(
+					"error pulling source image '%s': %v", srcRefTagged, err))
 			}
 		}
 	}
@@ -141,21 +220,92 @@ func (r *DockerRelay) Sync(srcRef, srcAuth string, srcSkipTLSVerify bool,
 
 	_, err = r.tag(srcImages, trgtRef)
 	if err != nil {
-		return fmt.Errorf("error setting tags: %v", err)
+		return pushed, fmt.Errorf("error setting tags: %v", err)
 	}
 
 	log.WithField("ref", trgtRef).Info("pushing target image")
 
-	if err := r.push(trgtRef, trgtAuth, verbose); err != nil {
-		return fmt.Errorf("error pushing target image: %v", err)
+	if len(tags) == 0 {
+		if err := r.push(ctx, trgtRef, trgtAuth, true, verbose); err != nil {
+			return pushed, ratelimit.Attribute(trgtRegistry,
+				fmt.Errorf("error pushing target image: %v", err))
+		}
+
+	} else {
+		for _, tag := range tags {
+			trgtRefTagged := fmt.Sprintf("%s:%s", trgtRef, tag)
+			if err := r.push(
+				ctx, trgtRefTagged, trgtAuth, false, verbose); err != nil {
+				return pushed, ratelimit.Attribute(trgtRegistry, fmt.Errorf(
+					"error pushing target image '%s': %v", trgtRefTagged, err))
+			}
+			pushed++
+		}
+	}
+
+	return pushed, nil
+}
+
+// SyncDigest pulls the source image with the given digest, tags it with tag,
+// and pushes it to the target, regardless of what tag points to in the source
+// by now. Otherwise, this works the same as Sync.
+func (r *DockerRelay) SyncDigest(ctx context.Context,
+	srcRef, srcAuth string, srcSkipTLSVerify bool,
+	trgtRef, trgtAuth string, trgtSkipTLSVerify bool,
+	tag, digest, policy string, verbose bool) error {
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	err := r.syncDigest(ctx, srcRef, srcAuth, trgtRef, trgtAuth, tag, digest,
+		verbose)
+
+	if err != nil && ctx.Err() != nil {
+		return fmt.Errorf("sync aborted (%v), tags left incomplete: %s",
+			ctx.Err(), tag)
+	}
+	return err
+}
+
+// syncDigest does the actual work for SyncDigest
+func (r *DockerRelay) syncDigest(ctx context.Context, srcRef, srcAuth string,
+	trgtRef, trgtAuth, tag, digest string, verbose bool) error {
+
+	srcRefPinned := fmt.Sprintf("%s@%s", srcRef, digest)
+	log.WithField("ref", srcRefPinned).Info("pulling source image")
+	if err := r.pull(ctx, srcRefPinned, srcAuth, false, verbose); err != nil {
+		return ratelimit.Attribute(registryOf(srcRef), fmt.Errorf(
+			"error pulling source image '%s': %v", srcRefPinned, err))
+	}
+
+	trgtRefTagged := fmt.Sprintf("%s:%s", trgtRef, tag)
+	log.WithField("ref", trgtRefTagged).Info("setting tag for target image")
+	if err := r.client.tagImage(srcRefPinned, trgtRefTagged); err != nil {
+		return fmt.Errorf("error setting tag: %v", err)
+	}
+
+	log.WithField("ref", trgtRefTagged).Info("pushing target image")
+	if err := r.push(ctx, trgtRefTagged, trgtAuth, false, verbose); err != nil {
+		return ratelimit.Attribute(registryOf(trgtRef), fmt.Errorf(
+			"error pushing target image '%s': %v", trgtRefTagged, err))
 	}
 
 	return nil
 }
 
+// registryOf returns the registry of image ref
+func registryOf(ref string) string {
+	reg, _, _ := SplitRef(ref)
+	if strings.ContainsAny(reg, ".:") || reg == "localhost" {
+		return reg
+	}
+	return "docker.io"
+}
+
 //
-func (r *DockerRelay) pull(ref, auth string, allTags, verbose bool) error {
-	return r.client.pullImage(ref, allTags, auth, verbose)
+func (r *DockerRelay) pull(ctx context.Context, ref, auth string,
+	allTags, verbose bool) error {
+	return r.client.pullImage(ctx, ref, allTags, auth, verbose)
 }
 
 //
@@ -190,6 +340,7 @@ func (r *DockerRelay) tag(images []*image, targetRef string) (
 }
 
 //
-func (r *DockerRelay) push(ref, auth string, verbose bool) error {
-	return r.client.pushImage(ref, true, auth, verbose)
+func (r *DockerRelay) push(ctx context.Context, ref, auth string,
+	allTags, verbose bool) error {
+	return r.client.pushImage(ctx, ref, allTags, auth, verbose)
 }
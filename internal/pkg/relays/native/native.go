@@ -0,0 +1,472 @@
+/*
+	Copyright 2020 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package native
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+
+	"github.com/xelalexv/dregsy/internal/pkg/auth"
+	"github.com/xelalexv/dregsy/internal/pkg/ratelimit"
+	"github.com/xelalexv/dregsy/internal/pkg/verify"
+)
+
+const defaultCertsBaseDir = "/etc/skopeo/certs.d"
+
+// Client talks to registries directly via their API. Client certs & keys, as
+// well as CA certs for a registry are picked up from its folder underneath
+// CertsDir.
+type Client struct {
+	CertsDir string
+}
+
+// NewClient creates a client using the certs underneath certsDir; when empty,
+// the default certs dir of the skopeo relay is used
+func NewClient(certsDir string) *Client {
+	if certsDir == "" {
+		certsDir = defaultCertsBaseDir
+	}
+	return &Client{CertsDir: certsDir}
+}
+
+//
+func (c *Client) ListAllTags(ctx context.Context, ref, auth string,
+	skipTLSVerify bool) ([]string, error) {
+
+	repo, err := parseRepository(ref, skipTLSVerify)
+	if err != nil {
+		return nil, err
+	}
+
+	opts, err := c.remoteOptions(ctx, repo.Registry, auth, skipTLSVerify)
+	if err != nil {
+		return nil, err
+	}
+
+	tags, err := remote.List(repo, opts...)
+	if err != nil {
+		return nil, fmt.Errorf(
+			"error listing image tags for ref '%s': %v", ref, err)
+	}
+	return tags, nil
+}
+
+// ImageCreated retrieves the creation time of image ref from its config blob.
+// If ref points to an image index, the image for the default platform is used.
+func (c *Client) ImageCreated(ctx context.Context, ref, auth string,
+	skipTLSVerify bool) (time.Time, error) {
+
+	tag, err := parseTag(ref, skipTLSVerify)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	opts, err := c.remoteOptions(ctx, tag.Registry, auth, skipTLSVerify)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	img, err := remote.Image(tag, opts...)
+	if err != nil {
+		return time.Time{}, fmt.Errorf(
+			"error fetching image '%s': %v", ref, err)
+	}
+
+	conf, err := img.ConfigFile()
+	if err != nil {
+		return time.Time{}, fmt.Errorf(
+			"error fetching config of image '%s': %v", ref, err)
+	}
+
+	return conf.Created.Time, nil
+}
+
+// ManifestDigest retrieves the digest of the manifest referenced by ref, using a
+// HEAD request; ref may reference the manifest by tag or by digest
+func (c *Client) ManifestDigest(ctx context.Context, ref, auth string,
+	skipTLSVerify bool) (string, error) {
+
+	r, err := parseReference(ref, skipTLSVerify)
+	if err != nil {
+		return "", err
+	}
+
+	opts, err := c.remoteOptions(
+		ctx, r.Context().Registry, auth, skipTLSVerify)
+	if err != nil {
+		return "", err
+	}
+
+	desc, err := remote.Head(r, opts...)
+	if err != nil {
+		return "", fmt.Errorf(
+			"error fetching manifest digest for '%s': %v", ref, err)
+	}
+
+	return desc.Digest.String(), nil
+}
+
+// DeleteTag deletes image ref from its registry. Since registries only support
+// deleting manifests by digest, the manifest ref points to is deleted, along
+// with any other tags pointing to it.
+func (c *Client) DeleteTag(ctx context.Context, ref, auth string,
+	skipTLSVerify bool) error {
+
+	tag, err := parseTag(ref, skipTLSVerify)
+	if err != nil {
+		return err
+	}
+
+	opts, err := c.remoteOptions(ctx, tag.Registry, auth, skipTLSVerify)
+	if err != nil {
+		return err
+	}
+
+	desc, err := remote.Head(tag, opts...)
+	if err != nil {
+		return fmt.Errorf("error deleting image '%s': %v", ref, err)
+	}
+
+	if err := remote.Delete(
+		tag.Context().Digest(desc.Digest.String()), opts...); err != nil {
+		return fmt.Errorf("error deleting image '%s': %v", ref, err)
+	}
+
+	return nil
+}
+
+// the annotation holding the signature in a cosign signature artifact
+const cosignSignatureAnnotation = "dev.cosignproject.cosign/signature"
+
+// Signatures retrieves the cosign signatures of the image with digest in
+// repository ref. These are stored under a tag derived from the digest, in the
+// layers of the signature artifact, with the signature itself annotated to each
+// layer. If there is no signature artifact, nil is returned.
+func (c *Client) Signatures(ctx context.Context, ref, digest, auth string,
+	skipTLSVerify bool) ([]*verify.Signature, error) {
+
+	sigTag, err := verify.SignatureTag(digest)
+	if err != nil {
+		return nil, err
+	}
+
+	tag, err := parseTag(fmt.Sprintf("%s:%s", ref, sigTag), skipTLSVerify)
+	if err != nil {
+		return nil, err
+	}
+
+	opts, err := c.remoteOptions(ctx, tag.Registry, auth, skipTLSVerify)
+	if err != nil {
+		return nil, err
+	}
+
+	img, err := remote.Image(tag, opts...)
+	if err != nil {
+		var terr *transport.Error
+		if errors.As(err, &terr) && terr.StatusCode == http.StatusNotFound {
+			return nil, nil
+		}
+		return nil, fmt.Errorf(
+			"error fetching signatures for '%s@%s': %v", ref, digest, err)
+	}
+
+	manifest, err := img.Manifest()
+	if err != nil {
+		return nil, fmt.Errorf(
+			"error fetching signatures for '%s@%s': %v", ref, digest, err)
+	}
+
+	var ret []*verify.Signature
+
+	for _, desc := range manifest.Layers {
+		sig, ok := desc.Annotations[cosignSignatureAnnotation]
+		if !ok {
+			continue
+		}
+		layer, err := img.LayerByDigest(desc.Digest)
+		if err != nil {
+			return nil, err
+		}
+		// the payload is stored as is, so we want the raw blob
+		rc, err := layer.Compressed()
+		if err != nil {
+			return nil, err
+		}
+		payload, err := ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			return nil, fmt.Errorf(
+				"error reading signature payload for '%s@%s': %v",
+				ref, digest, err)
+		}
+		ret = append(ret, &verify.Signature{Payload: payload, Signature: sig})
+	}
+
+	return ret, nil
+}
+
+// Referrers retrieves the digests of the manifests referring to the manifest
+// with digest in repository ref, using the OCI referrers API. If the registry
+// doesn't support that API, nil is returned.
+func (c *Client) Referrers(ctx context.Context, ref, digest, auth string,
+	skipTLSVerify bool) ([]string, error) {
+
+	repo, err := parseRepository(ref, skipTLSVerify)
+	if err != nil {
+		return nil, err
+	}
+
+	a, err := decodeJSONAuth(auth)
+	if err != nil {
+		return nil, err
+	}
+	tr, err := c.newTransport(repo.RegistryStr(), skipTLSVerify)
+	if err != nil {
+		return nil, err
+	}
+	rt, err := transport.New(repo.Registry, a, tr,
+		[]string{repo.Scope(transport.PullScope)})
+	if err != nil {
+		return nil, err
+	}
+
+	u := url.URL{
+		Scheme: repo.Registry.Scheme(),
+		Host:   repo.RegistryStr(),
+		Path: fmt.Sprintf("/v2/%s/referrers/%s",
+			repo.RepositoryStr(), digest),
+	}
+	req, err := http.NewRequestWithContext(
+		ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", string(types.OCIImageIndex))
+
+	resp, err := (&http.Client{Transport: rt}).Do(req)
+	if err != nil {
+		return nil, fmt.Errorf(
+			"error fetching referrers of '%s@%s': %v", ref, digest, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if err := transport.CheckError(resp, http.StatusOK); err != nil {
+		return nil, fmt.Errorf(
+			"error fetching referrers of '%s@%s': %v", ref, digest, err)
+	}
+
+	var index struct {
+		Manifests []struct {
+			Digest string `json:"digest"`
+		} `json:"manifests"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&index); err != nil {
+		return nil, fmt.Errorf(
+			"invalid referrers of '%s@%s': %v", ref, digest, err)
+	}
+
+	var ret []string
+	for _, m := range index.Manifests {
+		ret = append(ret, m.Digest)
+	}
+	return ret, nil
+}
+
+// ArtifactRef returns the reference to tag or digest ref in repository repo
+func ArtifactRef(repo, ref string) string {
+	if strings.HasPrefix(ref, "sha256:") {
+		return fmt.Sprintf("%s@%s", repo, ref)
+	}
+	return fmt.Sprintf("%s:%s", repo, ref)
+}
+
+//
+func parseRepository(ref string, skipTLSVerify bool) (name.Repository, error) {
+	var opts []name.Option
+	if skipTLSVerify {
+		opts = append(opts, name.Insecure)
+	}
+	repo, err := name.NewRepository(ref, opts...)
+	if err != nil {
+		return repo, fmt.Errorf("malformed image ref '%s': %v", ref, err)
+	}
+	return repo, nil
+}
+
+//
+func parseReference(ref string, skipTLSVerify bool) (name.Reference, error) {
+	var opts []name.Option
+	if skipTLSVerify {
+		opts = append(opts, name.Insecure)
+	}
+	r, err := name.ParseReference(ref, opts...)
+	if err != nil {
+		return r, fmt.Errorf("malformed image ref '%s': %v", ref, err)
+	}
+	return r, nil
+}
+
+//
+func parseTag(ref string, skipTLSVerify bool) (name.Tag, error) {
+	var opts []name.Option
+	if skipTLSVerify {
+		opts = append(opts, name.Insecure)
+	}
+	tag, err := name.NewTag(ref, opts...)
+	if err != nil {
+		return tag, fmt.Errorf("malformed image ref '%s': %v", ref, err)
+	}
+	return tag, nil
+}
+
+//
+func (c *Client) remoteOptions(ctx context.Context, reg name.Registry,
+	auth string, skipTLSVerify bool) ([]remote.Option, error) {
+
+	a, err := decodeJSONAuth(auth)
+	if err != nil {
+		return nil, err
+	}
+
+	tr, err := c.newTransport(reg.RegistryStr(), skipTLSVerify)
+	if err != nil {
+		return nil, err
+	}
+
+	return []remote.Option{remote.WithAuth(a), remote.WithTransport(tr),
+		remote.WithContext(ctx)}, nil
+}
+
+//
+func decodeJSONAuth(authBase64 string) (authn.Authenticator, error) {
+
+	creds, err := auth.Decode(authBase64)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case creds == nil:
+		return authn.Anonymous, nil
+	case creds.Token != "":
+		return &authn.Bearer{Token: creds.Token}, nil
+	default:
+		return &authn.Basic{
+			Username: creds.Username, Password: creds.Password}, nil
+	}
+}
+
+// newTransport creates an HTTP transport for talking to registry reg. Client
+// certs & keys, as well as CA certs are picked up from the folder for reg
+// underneath the certs dir. As with the skopeo relay, that folder is named
+// after the registry host without port. For a registry with a port, a folder
+// including the port takes precedence, as used by the Docker daemon.
+func (c *Client) newTransport(reg string, skipTLSVerify bool) (
+	http.RoundTripper, error) {
+
+	conf := &tls.Config{InsecureSkipVerify: skipTLSVerify}
+
+	dir := filepath.Join(c.CertsDir, reg)
+	files, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) && reg != withoutPort(reg) {
+		dir = filepath.Join(c.CertsDir, withoutPort(reg))
+		files, err = ioutil.ReadDir(dir)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	for _, f := range files {
+
+		file := filepath.Join(dir, f.Name())
+
+		switch {
+
+		case strings.HasSuffix(f.Name(), ".crt"):
+			if conf.RootCAs == nil {
+				if conf.RootCAs, err = x509.SystemCertPool(); err != nil {
+					conf.RootCAs = x509.NewCertPool()
+				}
+			}
+			pem, err := ioutil.ReadFile(file)
+			if err != nil {
+				return nil, err
+			}
+			if !conf.RootCAs.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("no valid CA certs in '%s'", file)
+			}
+
+		case strings.HasSuffix(f.Name(), ".cert"):
+			key := strings.TrimSuffix(file, ".cert") + ".key"
+			cert, err := tls.LoadX509KeyPair(file, key)
+			if err != nil {
+				return nil, fmt.Errorf(
+					"cannot load client key pair '%s': %v", file, err)
+			}
+			conf.Certificates = append(conf.Certificates, cert)
+		}
+	}
+
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+	tr.TLSClientConfig = conf
+	return &rateLimitTransport{inner: tr}, nil
+}
+
+// rateLimitTransport passes all responses on to the rate limit tracking, so
+// that quotas get recorded, and registries exceeding their limit get paused
+type rateLimitTransport struct {
+	inner http.RoundTripper
+}
+
+//
+func (t *rateLimitTransport) RoundTrip(req *http.Request) (
+	*http.Response, error) {
+	resp, err := t.inner.RoundTrip(req)
+	if err == nil {
+		ratelimit.Observe(req.URL.Host, resp)
+	}
+	return resp, err
+}
+
+//
+func withoutPort(repo string) string {
+	ix := strings.Index(repo, ":")
+	if ix == -1 {
+		return repo
+	}
+	return repo[:ix]
+}
@@ -0,0 +1,273 @@
+/*
+	Copyright 2020 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package native
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	log "github.com/sirupsen/logrus"
+)
+
+const RelayID = "native"
+
+//
+type RelayConfig struct {
+	CertsDir string `yaml:"certs-dir"`
+}
+
+//
+type NativeRelay struct {
+	client *Client
+	wrOut  io.Writer
+}
+
+//
+func NewNativeRelay(conf *RelayConfig, out io.Writer) *NativeRelay {
+
+	relay := &NativeRelay{}
+
+	if out != nil {
+		relay.wrOut = out
+	}
+
+	certsDir := ""
+	if conf != nil {
+		certsDir = conf.CertsDir
+	}
+	relay.client = NewClient(certsDir)
+
+	return relay
+}
+
+//
+func (r *NativeRelay) Prepare(ctx context.Context) error {
+	log.WithField("relay", RelayID).Info("relay ready")
+	return nil
+}
+
+//
+func (r *NativeRelay) Dispose() error {
+	return nil
+}
+
+//
+func (r *NativeRelay) ListTags(ctx context.Context, ref, auth string,
+	skipTLSVerify bool) ([]string, error) {
+	return r.client.ListAllTags(ctx, ref, auth, skipTLSVerify)
+}
+
+//
+func (r *NativeRelay) ImageCreated(ctx context.Context, ref, auth string,
+	skipTLSVerify bool) (time.Time, error) {
+	return r.client.ImageCreated(ctx, ref, auth, skipTLSVerify)
+}
+
+//
+func (r *NativeRelay) ManifestDigest(ctx context.Context, ref, auth string,
+	skipTLSVerify bool) (string, error) {
+	return r.client.ManifestDigest(ctx, ref, auth, skipTLSVerify)
+}
+
+//
+func (r *NativeRelay) DeleteTag(ctx context.Context, ref, auth string,
+	skipTLSVerify bool) error {
+	return r.client.DeleteTag(ctx, ref, auth, skipTLSVerify)
+}
+
+// Sync copies the given tags, or all tags if none are given, from source to
+// target. When ctx gets cancelled, any transfer in progress is aborted, and the
+// tags not copied yet are reported.
+func (r *NativeRelay) Sync(ctx context.Context,
+	srcRef, srcAuth string, srcSkipTLSVerify bool,
+	trgtRef, trgtAuth string, trgtSkipTLSVerify bool,
+	tags []string, policy string, verbose bool) error {
+
+	srcRepo, err := parseRepository(srcRef, srcSkipTLSVerify)
+	if err != nil {
+		return err
+	}
+	srcOpts, err := r.client.remoteOptions(
+		ctx, srcRepo.Registry, srcAuth, srcSkipTLSVerify)
+	if err != nil {
+		return fmt.Errorf("source: %v", err)
+	}
+
+	trgtRepo, err := parseRepository(trgtRef, trgtSkipTLSVerify)
+	if err != nil {
+		return err
+	}
+	trgtOpts, err := r.client.remoteOptions(
+		ctx, trgtRepo.Registry, trgtAuth, trgtSkipTLSVerify)
+	if err != nil {
+		return fmt.Errorf("target: %v", err)
+	}
+
+	if len(tags) == 0 {
+		if tags, err = remote.List(srcRepo, srcOpts...); err != nil {
+			return fmt.Errorf(
+				"error listing image tags for ref '%s': %v", srcRef, err)
+		}
+	}
+
+	var errs []error
+	for ix, tag := range tags {
+		if ctx.Err() != nil {
+			return fmt.Errorf("sync aborted (%v), tags left incomplete: %s",
+				ctx.Err(), strings.Join(tags[ix:], ", "))
+		}
+		log.WithField("tag", tag).Info("syncing tag")
+		if err := copyRef(srcRepo.Tag(tag), srcOpts,
+			trgtRepo.Tag(tag), trgtOpts); err != nil {
+			if ctx.Err() != nil {
+				return fmt.Errorf(
+					"sync aborted (%v), tags left incomplete: %s",
+					ctx.Err(), strings.Join(tags[ix:], ", "))
+			}
+			log.Error(err)
+			errs = append(errs, err)
+		} else if verbose && r.wrOut != nil {
+			fmt.Fprintf(r.wrOut, "copied %s to %s\n",
+				srcRepo.Tag(tag), trgtRepo.Tag(tag))
+		}
+	}
+
+	if len(errs) > 0 {
+		if len(tags) == 1 {
+			return errs[0]
+		}
+		return fmt.Errorf("errors during sync")
+	}
+
+	return nil
+}
+
+// SyncDigest copies the source manifest with the given digest to tag in the
+// target, regardless of what that tag points to in the source by now.
+// Otherwise, this works the same as Sync.
+func (r *NativeRelay) SyncDigest(ctx context.Context,
+	srcRef, srcAuth string, srcSkipTLSVerify bool,
+	trgtRef, trgtAuth string, trgtSkipTLSVerify bool,
+	tag, digest, policy string, verbose bool) error {
+
+	srcRepo, err := parseRepository(srcRef, srcSkipTLSVerify)
+	if err != nil {
+		return err
+	}
+	srcOpts, err := r.client.remoteOptions(
+		ctx, srcRepo.Registry, srcAuth, srcSkipTLSVerify)
+	if err != nil {
+		return fmt.Errorf("source: %v", err)
+	}
+
+	trgtRepo, err := parseRepository(trgtRef, trgtSkipTLSVerify)
+	if err != nil {
+		return err
+	}
+	trgtOpts, err := r.client.remoteOptions(
+		ctx, trgtRepo.Registry, trgtAuth, trgtSkipTLSVerify)
+	if err != nil {
+		return fmt.Errorf("target: %v", err)
+	}
+
+	log.WithFields(log.Fields{"tag": tag, "digest": digest}).Info(
+		"syncing tag")
+	if err := copyRef(srcRepo.Digest(digest), srcOpts,
+		trgtRepo.Tag(tag), trgtOpts); err != nil {
+		if ctx.Err() != nil {
+			return fmt.Errorf("sync aborted (%v), tags left incomplete: %s",
+				ctx.Err(), tag)
+		}
+		return err
+	}
+	if verbose && r.wrOut != nil {
+		fmt.Fprintf(r.wrOut, "copied %s to %s\n",
+			srcRepo.Digest(digest), trgtRepo.Tag(tag))
+	}
+
+	return nil
+}
+
+// CopyArtifact copies an artifact related to an image, such as a signature,
+// from source to target as is. ref is either the artifact's tag, or its digest.
+func (r *NativeRelay) CopyArtifact(ctx context.Context,
+	srcRef, srcAuth string, srcSkipTLSVerify bool,
+	trgtRef, trgtAuth string, trgtSkipTLSVerify bool, ref string) error {
+
+	src, err := parseReference(ArtifactRef(srcRef, ref), srcSkipTLSVerify)
+	if err != nil {
+		return err
+	}
+	srcOpts, err := r.client.remoteOptions(
+		ctx, src.Context().Registry, srcAuth, srcSkipTLSVerify)
+	if err != nil {
+		return fmt.Errorf("source: %v", err)
+	}
+
+	trgt, err := parseReference(ArtifactRef(trgtRef, ref), trgtSkipTLSVerify)
+	if err != nil {
+		return err
+	}
+	trgtOpts, err := r.client.remoteOptions(
+		ctx, trgt.Context().Registry, trgtAuth, trgtSkipTLSVerify)
+	if err != nil {
+		return fmt.Errorf("target: %v", err)
+	}
+
+	return copyRef(src, srcOpts, trgt, trgtOpts)
+}
+
+// copyRef copies the manifest referenced by src, including all blobs and
+// child manifests, to trgt. Blobs already present in the target repo are
+// skipped, blobs present in another repo on the same registry are mounted.
+func copyRef(src name.Reference, srcOpts []remote.Option,
+	trgt name.Reference, trgtOpts []remote.Option) error {
+
+	desc, err := remote.Get(src, srcOpts...)
+	if err != nil {
+		return fmt.Errorf("error fetching manifest for '%s': %w", src, err)
+	}
+
+	switch desc.MediaType {
+
+	case types.OCIImageIndex, types.DockerManifestList:
+		idx, err := desc.ImageIndex()
+		if err != nil {
+			return err
+		}
+		if err := remote.WriteIndex(trgt, idx, trgtOpts...); err != nil {
+			return fmt.Errorf("error writing index '%s': %w", trgt, err)
+		}
+
+	default:
+		img, err := desc.Image()
+		if err != nil {
+			return err
+		}
+		if err := remote.Write(trgt, img, trgtOpts...); err != nil {
+			return fmt.Errorf("error writing image '%s': %w", trgt, err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,246 @@
+/*
+	Copyright 2020 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package native
+
+import (
+	"context"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/xelalexv/dregsy/internal/pkg/test"
+)
+
+//
+func TestNativeSyncTags(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	src := test.NewRegistry(th)
+	defer src.Close()
+	trgt := test.NewRegistry(th)
+	defer trgt.Close()
+
+	d1 := src.PushImage("library/busybox", "1.0")
+	d2 := src.PushImage("library/busybox", "1.1", "latest")
+
+	relay := NewNativeRelay(nil, nil)
+	th.AssertNoError(relay.Prepare(context.Background()))
+
+	th.AssertNoError(relay.Sync(context.Background(),
+		src.Host()+"/library/busybox", "", false,
+		trgt.Host()+"/mirror/busybox", "", false,
+		[]string{"1.0", "latest"}, "", false))
+
+	th.AssertEquivalentSlices(
+		[]string{"1.0", "latest"}, trgt.ListTags("mirror/busybox"))
+	th.AssertEqual(d1, trgt.Digest("mirror/busybox", "1.0"))
+	th.AssertEqual(d2, trgt.Digest("mirror/busybox", "latest"))
+}
+
+//
+func TestNativeSyncAllTags(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	src := test.NewRegistry(th)
+	defer src.Close()
+	trgt := test.NewRegistry(th)
+	defer trgt.Close()
+
+	src.PushImage("library/busybox", "1.0", "1.1")
+	d := src.PushIndex("library/busybox", "multi", 3)
+
+	relay := NewNativeRelay(nil, nil)
+	th.AssertNoError(relay.Sync(context.Background(),
+		src.Host()+"/library/busybox", "", false,
+		trgt.Host()+"/library/busybox", "", false,
+		nil, "", false))
+
+	th.AssertEquivalentSlices(
+		[]string{"1.0", "1.1", "multi"}, trgt.ListTags("library/busybox"))
+	th.AssertEqual(d, trgt.Digest("library/busybox", "multi"))
+}
+
+//
+func TestNativeSyncMissingTag(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	src := test.NewRegistry(th)
+	defer src.Close()
+	trgt := test.NewRegistry(th)
+	defer trgt.Close()
+
+	src.PushImage("library/busybox", "1.0")
+
+	relay := NewNativeRelay(nil, nil)
+	th.AssertError(relay.Sync(context.Background(),
+		src.Host()+"/library/busybox", "", false,
+		trgt.Host()+"/library/busybox", "", false,
+		[]string{"1.0", "2.0"}, "", false), "errors during sync")
+
+	th.AssertEquivalentSlices([]string{"1.0"}, trgt.ListTags("library/busybox"))
+}
+
+//
+func TestNativeSyncCancelled(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	src := test.NewRegistry(th)
+	defer src.Close()
+	trgt := test.NewRegistry(th)
+	defer trgt.Close()
+
+	src.PushImage("library/busybox", "1.0", "1.1")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	relay := NewNativeRelay(nil, nil)
+	th.AssertError(relay.Sync(ctx,
+		src.Host()+"/library/busybox", "", false,
+		trgt.Host()+"/library/busybox", "", false,
+		[]string{"1.0", "1.1"}, "", false),
+		"sync aborted (context canceled), tags left incomplete: 1.0, 1.1")
+
+	th.AssertEquivalentSlices([]string{}, trgt.ListTags("library/busybox"))
+}
+
+//
+func TestNativeSyncBlobReuse(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	reg := test.NewRegistry(th)
+	defer reg.Close()
+
+	reg.PushImage("library/busybox", "1.0")
+	relay := NewNativeRelay(nil, nil)
+
+	// same registry, so layer gets mounted from source repo, config blob is
+	// uploaded
+	uploads := reg.Uploads
+	th.AssertNoError(relay.Sync(context.Background(),
+		reg.Host()+"/library/busybox", "", false,
+		reg.Host()+"/mirror/busybox", "", false,
+		[]string{"1.0"}, "", false))
+	th.AssertEqual(uploads+1, reg.Uploads)
+	th.AssertEqual(1, reg.Mounts)
+
+	// blobs already in target repo, so neither uploaded nor mounted
+	th.AssertNoError(relay.Sync(context.Background(),
+		reg.Host()+"/library/busybox", "", false,
+		reg.Host()+"/mirror/busybox", "", false,
+		[]string{"1.0"}, "", false))
+	th.AssertEqual(uploads+1, reg.Uploads)
+	th.AssertEqual(1, reg.Mounts)
+}
+
+//
+func TestNativeSyncWithAuth(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	src := test.NewAuthRegistry(th, "anonymous", "anonymous")
+	defer src.Close()
+	trgt := test.NewAuthRegistry(th, "anonymous", "anonymous")
+	defer trgt.Close()
+
+	d := src.PushImage("library/busybox", "1.0")
+
+	// {"username": "anonymous", "password": "anonymous"}
+	auth := "eyJ1c2VybmFtZSI6ICJhbm9ueW1vdXMiLCAicGFzc3dvcmQiOiAiYW5vbnltb3VzIn0K"
+	relay := NewNativeRelay(nil, nil)
+
+	th.AssertError(relay.Sync(context.Background(),
+		src.Host()+"/library/busybox", "", false,
+		trgt.Host()+"/library/busybox", auth, false,
+		[]string{"1.0"}, "", false), "UNAUTHORIZED: invalid credentials")
+
+	th.AssertNoError(relay.Sync(context.Background(),
+		src.Host()+"/library/busybox", auth, false,
+		trgt.Host()+"/library/busybox", auth, false,
+		[]string{"1.0"}, "", false))
+	th.AssertEqual(d, trgt.Digest("library/busybox", "1.0"))
+}
+
+//
+func TestDecodeJSONAuth(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	// {"username": "anonymous", "password": "anonymous"}
+	a, err := decodeJSONAuth(
+		"eyJ1c2VybmFtZSI6ICJhbm9ueW1vdXMiLCAicGFzc3dvcmQiOiAiYW5vbnltb3VzIn0K")
+	th.AssertNoError(err)
+	conf, err := a.Authorization()
+	th.AssertNoError(err)
+	th.AssertEqual("anonymous", conf.Username)
+	th.AssertEqual("anonymous", conf.Password)
+
+	a, err = decodeJSONAuth("eyJyZWdpc3RyeXRva2VuIjoiczNjcjN0In0=")
+	th.AssertNoError(err)
+	conf, err = a.Authorization()
+	th.AssertNoError(err)
+	th.AssertEqual("s3cr3t", conf.RegistryToken)
+
+	_, err = decodeJSONAuth("not base64")
+	th.AssertError(err, "invalid auth, not base64 encoded")
+}
+
+//
+func TestClientCertsDir(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	dir, err := ioutil.TempDir("", "dregsy-certs-")
+	th.AssertNoError(err)
+	defer os.RemoveAll(dir)
+
+	srv := httptest.NewTLSServer(nil)
+	defer srv.Close()
+	ca := pem.EncodeToMemory(
+		&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+
+	// skopeo layout without port, and Docker layout with port
+	for _, reg := range []string{"skopeo.acme.com", "docker.acme.com:5000"} {
+		th.AssertNoError(os.Mkdir(filepath.Join(dir, reg), 0755))
+		th.AssertNoError(ioutil.WriteFile(
+			filepath.Join(dir, reg, "ca.crt"), ca, 0644))
+	}
+
+	c := NewClient(dir)
+
+	for _, reg := range []string{
+		"skopeo.acme.com", "skopeo.acme.com:5000", "docker.acme.com:5000"} {
+		tr, err := c.newTransport(reg, false)
+		th.AssertNoError(err)
+		th.AssertNotNil(tr.(*rateLimitTransport).inner.(*http.Transport).
+			TLSClientConfig.RootCAs)
+	}
+
+	tr, err := c.newTransport("docker.acme.com", false)
+	th.AssertNoError(err)
+	th.AssertNil(tr.(*rateLimitTransport).inner.(*http.Transport).
+		TLSClientConfig.RootCAs)
+}
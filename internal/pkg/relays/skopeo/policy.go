@@ -0,0 +1,182 @@
+/*
+	Copyright 2020 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package skopeo
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+)
+
+// Policy is a containers signature policy (see containers-policy.json(5)),
+// which skopeo enforces when copying images. In the config, it is given either
+// as the path of a policy.json file, or inline as the content of such a file.
+type Policy struct {
+	File     string
+	inline   interface{}
+	rendered []byte
+}
+
+//
+func (p *Policy) UnmarshalYAML(unmarshal func(interface{}) error) error {
+
+	var file string
+	if err := unmarshal(&file); err == nil {
+		p.File = file
+		p.inline = nil
+		p.rendered = nil
+		return nil
+	}
+
+	var inline map[interface{}]interface{}
+	if err := unmarshal(&inline); err != nil {
+		return errors.New(
+			"policy needs to be a file path, or an inline policy")
+	}
+
+	converted, err := toJSONCompatible(inline)
+	if err != nil {
+		return fmt.Errorf("invalid inline policy: %v", err)
+	}
+	p.File = ""
+	p.inline = converted
+	p.rendered = nil
+	return nil
+}
+
+//
+func (p *Policy) MarshalYAML() (interface{}, error) {
+	if p.inline != nil {
+		return p.inline, nil
+	}
+	return p.File, nil
+}
+
+// Validate checks that this policy can be read and has a default requirement.
+// An inline policy only gets rendered into a policy file by Render.
+func (p *Policy) Validate() error {
+
+	if p.inline == nil {
+		if p.File == "" {
+			return errors.New("policy file not set")
+		}
+		data, err := ioutil.ReadFile(p.File)
+		if err != nil {
+			return fmt.Errorf("cannot read policy file: %v", err)
+		}
+		if err := checkPolicy(data); err != nil {
+			return fmt.Errorf("policy file '%s': %v", p.File, err)
+		}
+		return nil
+	}
+
+	data, err := json.MarshalIndent(p.inline, "", "  ")
+	if err != nil {
+		return fmt.Errorf("cannot render inline policy: %v", err)
+	}
+	if err := checkPolicy(data); err != nil {
+		return fmt.Errorf("inline policy: %v", err)
+	}
+	p.rendered = data
+
+	return nil
+}
+
+// Render writes an inline policy into a new file in folder dir, readable only
+// by the current user, which is then used as this policy's File. A policy given
+// as a file, or one that has already been rendered, is left as is.
+func (p *Policy) Render(dir string) error {
+
+	if p.inline == nil || p.File != "" {
+		return nil
+	}
+
+	if p.rendered == nil {
+		if err := p.Validate(); err != nil {
+			return err
+		}
+	}
+
+	f, err := ioutil.TempFile(dir, "policy-*.json")
+	if err != nil {
+		return fmt.Errorf("cannot create policy file: %v", err)
+	}
+	_, err = f.Write(p.rendered)
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return fmt.Errorf("cannot write policy file: %v", err)
+	}
+
+	p.File = f.Name()
+	return nil
+}
+
+// checkPolicy checks that data is a JSON object with a non-empty default
+// requirement, which skopeo insists on
+func checkPolicy(data []byte) error {
+	var policy struct {
+		Default []interface{} `json:"default"`
+	}
+	if err := json.Unmarshal(data, &policy); err != nil {
+		return fmt.Errorf("not valid JSON: %v", err)
+	}
+	if len(policy.Default) == 0 {
+		return errors.New("no default requirement")
+	}
+	return nil
+}
+
+// toJSONCompatible converts the maps in a value decoded from YAML, which have
+// interface{} keys, into maps with string keys
+func toJSONCompatible(v interface{}) (interface{}, error) {
+
+	switch val := v.(type) {
+
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(val))
+		for k, e := range val {
+			key, ok := k.(string)
+			if !ok {
+				return nil, fmt.Errorf("key '%v' is not a string", k)
+			}
+			c, err := toJSONCompatible(e)
+			if err != nil {
+				return nil, err
+			}
+			m[key] = c
+		}
+		return m, nil
+
+	case []interface{}:
+		l := make([]interface{}, len(val))
+		for ix, e := range val {
+			c, err := toJSONCompatible(e)
+			if err != nil {
+				return nil, err
+			}
+			l[ix] = c
+		}
+		return l, nil
+	}
+
+	return v, nil
+}
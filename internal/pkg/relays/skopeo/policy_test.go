@@ -0,0 +1,134 @@
+/*
+	Copyright 2020 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package skopeo
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/xelalexv/dregsy/internal/pkg/test"
+)
+
+//
+func TestPolicyFile(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	dir, err := ioutil.TempDir("", "dregsy-policy-test")
+	th.AssertNoError(err)
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "policy.json")
+	conf := &RelayConfig{}
+	th.AssertNoError(yaml.Unmarshal([]byte("policy: "+file), conf))
+	th.AssertEqual(file, conf.Policy.File)
+
+	th.AssertError(conf.Policy.Validate(), "cannot read policy file")
+
+	th.AssertNoError(ioutil.WriteFile(file, []byte("{"), 0644))
+	th.AssertError(conf.Policy.Validate(), "not valid JSON")
+
+	th.AssertNoError(ioutil.WriteFile(file, []byte(`{"default": []}`), 0644))
+	th.AssertError(conf.Policy.Validate(), "no default requirement")
+
+	th.AssertNoError(ioutil.WriteFile(file,
+		[]byte(`{"default": [{"type": "reject"}]}`), 0644))
+	th.AssertNoError(conf.Policy.Validate())
+	th.AssertEqual(file, conf.Policy.File)
+}
+
+//
+func TestPolicyInline(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	conf := &RelayConfig{}
+	th.AssertNoError(yaml.Unmarshal([]byte(`
+policy:
+  default:
+    - type: reject
+  transports:
+    docker:
+      registry.acme.com:
+        - type: insecureAcceptAnything
+`), conf))
+
+	th.AssertNoError(conf.Policy.Validate())
+	th.AssertEqual("", conf.Policy.File)
+
+	relay := NewSkopeoRelay(conf, nil)
+	th.AssertNoError(relay.SetupPolicy(conf.Policy))
+	th.AssertNotEqual("", conf.Policy.File)
+	defer relay.Dispose()
+
+	info, err := os.Stat(conf.Policy.File)
+	th.AssertNoError(err)
+	th.AssertEqual(os.FileMode(0600), info.Mode().Perm())
+
+	data, err := ioutil.ReadFile(conf.Policy.File)
+	th.AssertNoError(err)
+	th.AssertEqual(`{
+  "default": [
+    {
+      "type": "reject"
+    }
+  ],
+  "transports": {
+    "docker": {
+      "registry.acme.com": [
+        {
+          "type": "insecureAcceptAnything"
+        }
+      ]
+    }
+  }
+}`, string(data))
+
+	// rendered only once, and removed along with the relay's policy folder
+	file := conf.Policy.File
+	th.AssertNoError(relay.SetupPolicy(conf.Policy))
+	th.AssertEqual(file, conf.Policy.File)
+	th.AssertNoError(relay.Dispose())
+	_, err = os.Stat(file)
+	th.AssertTrue(os.IsNotExist(err))
+
+	th.AssertError(yaml.Unmarshal([]byte("policy: [reject]"), conf),
+		"policy needs to be a file path, or an inline policy")
+}
+
+//
+func TestPolicyArgs(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	relay := NewSkopeoRelay(nil, nil)
+	th.AssertEquivalentSlices([]string{"--insecure-policy"},
+		relay.policyArgs(""))
+	th.AssertEquivalentSlices([]string{"--policy=/task/policy.json"},
+		relay.policyArgs("/task/policy.json"))
+
+	relay = NewSkopeoRelay(
+		&RelayConfig{Policy: &Policy{File: "/relay/policy.json"}}, nil)
+	th.AssertEquivalentSlices([]string{"--policy=/relay/policy.json"},
+		relay.policyArgs(""))
+	th.AssertEquivalentSlices([]string{"--policy=/task/policy.json"},
+		relay.policyArgs("/task/policy.json"))
+}
@@ -18,15 +18,21 @@ package skopeo
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha256"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"os"
 	"os/exec"
 	"strings"
+	"time"
 
 	log "github.com/sirupsen/logrus"
+
+	"github.com/xelalexv/dregsy/internal/pkg/auth"
 )
 
 const defaultSkopeoBinary = "skopeo"
@@ -41,12 +47,6 @@ func init() {
 	certsBaseDir = defaultCertsBaseDir
 }
 
-//
-type creds struct {
-	Username string
-	Password string
-}
-
 //
 type tagList struct {
 	Repository string   `json:"Repository"`
@@ -54,8 +54,13 @@ type tagList struct {
 }
 
 //
-func ListAllTags(ref, creds, certDir string, skipTLSVerify bool) (
-	[]string, error) {
+type imageInfo struct {
+	Created time.Time `json:"Created"`
+}
+
+//
+func ListAllTags(ctx context.Context, ref string, creds *auth.Credentials,
+	certDir string, skipTLSVerify bool) ([]string, error) {
 
 	cmd := []string{
 		"list-tags",
@@ -65,9 +70,12 @@ func ListAllTags(ref, creds, certDir string, skipTLSVerify bool) (
 		cmd = append(cmd, "--tls-verify=false")
 	}
 
-	if creds != "" {
-		cmd = append(cmd, fmt.Sprintf("--creds=%s", creds))
+	args, cleanup, err := credsArgs(ref, creds, "")
+	if err != nil {
+		return nil, err
 	}
+	defer cleanup()
+	cmd = append(cmd, args...)
 
 	if certDir != "" {
 		cmd = append(cmd, fmt.Sprintf("--cert-dir=%s", certDir))
@@ -78,7 +86,7 @@ func ListAllTags(ref, creds, certDir string, skipTLSVerify bool) (
 	bufOut := new(bytes.Buffer)
 	bufErr := new(bytes.Buffer)
 
-	if err := runSkopeo(bufOut, bufErr, true, cmd...); err != nil {
+	if err := runSkopeo(ctx, bufOut, bufErr, true, cmd...); err != nil {
 		return nil,
 			fmt.Errorf("error listing image tags for ref '%s': %s, %v",
 				ref, bufErr.String(), err)
@@ -91,6 +99,111 @@ func ListAllTags(ref, creds, certDir string, skipTLSVerify bool) (
 	return list.Tags, nil
 }
 
+//
+func ImageCreated(ctx context.Context, ref string, creds *auth.Credentials,
+	certDir string, skipTLSVerify bool) (time.Time, error) {
+
+	out, err := inspect(ctx, ref, creds, certDir, skipTLSVerify, false)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	var info imageInfo
+	if err := json.Unmarshal(out, &info); err != nil {
+		return time.Time{}, err
+	}
+	return info.Created, nil
+}
+
+// ManifestDigest retrieves the raw manifest referenced by ref, and calculates
+// its digest
+func ManifestDigest(ctx context.Context, ref string, creds *auth.Credentials,
+	certDir string, skipTLSVerify bool) (string, error) {
+
+	out, err := inspect(ctx, ref, creds, certDir, skipTLSVerify, true)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("sha256:%x", sha256.Sum256(out)), nil
+}
+
+// Delete deletes image ref from its registry. As with any registry client, the
+// manifest ref points to is deleted, along with any other tags pointing to it.
+func Delete(ctx context.Context, ref string, creds *auth.Credentials,
+	certDir string, skipTLSVerify bool) error {
+
+	cmd := []string{
+		"delete",
+	}
+
+	if skipTLSVerify {
+		cmd = append(cmd, "--tls-verify=false")
+	}
+
+	args, cleanup, err := credsArgs(ref, creds, "")
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+	cmd = append(cmd, args...)
+
+	if certDir != "" {
+		cmd = append(cmd, fmt.Sprintf("--cert-dir=%s", certDir))
+	}
+
+	cmd = append(cmd, "docker://"+ref)
+
+	bufOut := new(bytes.Buffer)
+	bufErr := new(bytes.Buffer)
+
+	if err := runSkopeo(ctx, bufOut, bufErr, true, cmd...); err != nil {
+		return fmt.Errorf("error deleting image '%s': %s, %v",
+			ref, bufErr.String(), err)
+	}
+
+	return nil
+}
+
+//
+func inspect(ctx context.Context, ref string, creds *auth.Credentials,
+	certDir string, skipTLSVerify, raw bool) ([]byte, error) {
+
+	cmd := []string{
+		"inspect",
+	}
+
+	if raw {
+		cmd = append(cmd, "--raw")
+	}
+
+	if skipTLSVerify {
+		cmd = append(cmd, "--tls-verify=false")
+	}
+
+	args, cleanup, err := credsArgs(ref, creds, "")
+	if err != nil {
+		return nil, err
+	}
+	defer cleanup()
+	cmd = append(cmd, args...)
+
+	if certDir != "" {
+		cmd = append(cmd, fmt.Sprintf("--cert-dir=%s", certDir))
+	}
+
+	cmd = append(cmd, "docker://"+ref)
+
+	bufOut := new(bytes.Buffer)
+	bufErr := new(bytes.Buffer)
+
+	if err := runSkopeo(ctx, bufOut, bufErr, true, cmd...); err != nil {
+		return nil, fmt.Errorf("error inspecting image '%s': %s, %v",
+			ref, bufErr.String(), err)
+	}
+
+	return bufOut.Bytes(), nil
+}
+
 //
 func chooseOutStream(out io.Writer, verbose, isErrorStream bool) io.Writer {
 	if verbose {
@@ -105,10 +218,12 @@ func chooseOutStream(out io.Writer, verbose, isErrorStream bool) io.Writer {
 	return ioutil.Discard
 }
 
-//
-func runSkopeo(outWr, errWr io.Writer, verbose bool, args ...string) error {
+// runSkopeo runs skopeo with args; the skopeo process gets killed when ctx is
+// cancelled before it completes
+func runSkopeo(ctx context.Context, outWr, errWr io.Writer, verbose bool,
+	args ...string) error {
 
-	cmd := exec.Command(skopeoBinary, args...)
+	cmd := exec.CommandContext(ctx, skopeoBinary, args...)
 
 	cmd.Stdout = chooseOutStream(outWr, verbose, false)
 	cmd.Stderr = chooseOutStream(errWr, verbose, true)
@@ -118,6 +233,9 @@ func runSkopeo(outWr, errWr io.Writer, verbose bool, args ...string) error {
 	}
 
 	if err := cmd.Wait(); err != nil {
+		if ctx.Err() != nil {
+			return fmt.Errorf("skopeo aborted: %v", ctx.Err())
+		}
 		return err
 	}
 
@@ -133,26 +251,94 @@ func decodeTagList(tl []byte) (*tagList, error) {
 	return &ret, nil
 }
 
+// credsArgs returns the skopeo options for passing creds for image ref; prefix
+// is 'src-' or 'dest-' for copying, and empty otherwise. Username & password are
+// written to a temporary auth file, so that they don't show up in the process
+// list. Once skopeo is done, the returned cleanup function needs to be called,
+// which removes that file. Bearer tokens are rejected, since skopeo would only
+// take them on the command line.
+func credsArgs(ref string, creds *auth.Credentials, prefix string) (
+	[]string, func(), error) {
+
+	cleanup := func() {}
+
+	switch {
+
+	case creds == nil:
+		return nil, cleanup, nil
+
+	case creds.Token != "":
+		// could only be passed on the command line
+		return nil, cleanup, fmt.Errorf(
+			"token credentials for '%s' are not supported by skopeo relay", ref)
+	}
+
+	file, err := writeAuthFile(ref, creds)
+	if err != nil {
+		return nil, cleanup, err
+	}
+
+	return []string{fmt.Sprintf("--%sauthfile=%s", prefix, file)},
+		func() { os.Remove(file) }, nil
+}
+
+// containersAuth is the content of a containers-auth.json file
+type containersAuth struct {
+	Auths map[string]containersAuthEntry `json:"auths"`
+}
+
 //
-func DecodeJSONAuth(authBase64 string) string {
+type containersAuthEntry struct {
+	Auth string `json:"auth"`
+}
 
-	if authBase64 == "" {
-		return ""
+// writeAuthFile writes a containers-auth.json file readable only by the
+// current user, containing creds for the registry of image ref, and returns
+// its path
+func writeAuthFile(ref string, creds *auth.Credentials) (string, error) {
+
+	data, err := json.Marshal(&containersAuth{
+		Auths: map[string]containersAuthEntry{
+			registryHost(ref): {Auth: base64.StdEncoding.EncodeToString(
+				[]byte(creds.Username + ":" + creds.Password))},
+		},
+	})
+	if err != nil {
+		return "", err
 	}
 
-	decoded, err := base64.StdEncoding.DecodeString(authBase64)
+	// temp files are created with mode 0600
+	f, err := ioutil.TempFile("", "dregsy-auth-*.json")
 	if err != nil {
-		log.Error(err)
-		return ""
+		return "", fmt.Errorf("cannot create auth file: %v", err)
 	}
 
-	var ret creds
-	if err := json.Unmarshal([]byte(decoded), &ret); err != nil {
-		log.Error(err)
-		return ""
+	_, err = f.Write(data)
+	if e := f.Close(); err == nil {
+		err = e
 	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", fmt.Errorf("cannot write auth file: %v", err)
+	}
+
+	return f.Name(), nil
+}
 
-	return fmt.Sprintf("%s:%s", ret.Username, ret.Password)
+// registryHost returns the registry part of image ref the way it is used as key
+// in containers-auth.json files, i.e. Docker Hub is referred to as docker.io
+func registryHost(ref string) string {
+	if ix := strings.Index(ref, "/"); ix > -1 {
+		reg := ref[:ix]
+		if strings.ContainsAny(reg, ".:") || reg == "localhost" {
+			switch reg {
+			case "index.docker.io", "registry-1.docker.io":
+				return "docker.io"
+			}
+			return reg
+		}
+	}
+	return "docker.io"
 }
 
 //
@@ -0,0 +1,346 @@
+/*
+	Copyright 2020 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package skopeo
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/xelalexv/dregsy/internal/pkg/auth"
+	"github.com/xelalexv/dregsy/internal/pkg/ratelimit"
+	"github.com/xelalexv/dregsy/internal/pkg/test"
+)
+
+//
+func TestRunSkopeoCancelled(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	// use sleep as a stand-in for a hanging skopeo
+	defer func(bin string) { skopeoBinary = bin }(skopeoBinary)
+	skopeoBinary = "sleep"
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	th.AssertError(runSkopeo(ctx, nil, nil, false, "10"),
+		"skopeo aborted: context deadline exceeded")
+	th.AssertTrue(time.Since(start) < 5*time.Second)
+}
+
+// TestRelayCancelled checks that listing tags, inspecting, and deleting via
+// the relay can be aborted, using a fake skopeo that hangs
+func TestRelayCancelled(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	dir, err := ioutil.TempDir("", "dregsy-skopeo-test")
+	th.AssertNoError(err)
+	defer os.RemoveAll(dir)
+
+	fake := filepath.Join(dir, "skopeo")
+	th.AssertNoError(
+		ioutil.WriteFile(fake, []byte("#!/bin/sh\nexec sleep 10\n"), 0700))
+
+	defer func(bin string) { skopeoBinary = bin }(skopeoBinary)
+	skopeoBinary = fake
+
+	relay := NewSkopeoRelay(nil, nil)
+	ref := "registry.acme.com/foo:latest"
+
+	for _, call := range []func(ctx context.Context) error{
+		func(ctx context.Context) error {
+			_, err := relay.ListTags(ctx, "registry.acme.com/foo", "", false)
+			return err
+		},
+		func(ctx context.Context) error {
+			_, err := relay.ManifestDigest(ctx, ref, "", false)
+			return err
+		},
+		func(ctx context.Context) error {
+			_, err := relay.ImageCreated(ctx, ref, "", false)
+			return err
+		},
+		func(ctx context.Context) error {
+			return relay.DeleteTag(ctx, ref, "", false)
+		},
+	} {
+		ctx, cancel := context.WithTimeout(
+			context.Background(), 100*time.Millisecond)
+		start := time.Now()
+		th.AssertError(call(ctx), "skopeo aborted: context deadline exceeded")
+		th.AssertTrue(time.Since(start) < 5*time.Second)
+		cancel()
+	}
+}
+
+//
+func TestAttributeRateLimit(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	src := "registry.hub.docker.com/library/busybox"
+	dest := "registry.acme.com/mirror/busybox"
+
+	for _, tc := range []struct {
+		msg  string
+		want string
+	}{
+		{"initializing source docker://busybox:latest: reading manifest " +
+			"latest in docker.io/library/busybox: toomanyrequests: You have " +
+			"reached your pull rate limit", "docker.io"},
+		{"writing blob: initiating layer upload to /v2/mirror/busybox/blobs/" +
+			"uploads/ in registry.acme.com: toomanyrequests: slow down",
+			"registry.acme.com"},
+		{"trying to reuse blob at destination: received unexpected HTTP " +
+			"status: 429 Too Many Requests", "registry.acme.com"},
+		{"reading blob sha256:abc: received unexpected HTTP status: 429 " +
+			"Too Many Requests", "docker.io"},
+		{"received unexpected HTTP status: 429 Too Many Requests", ""},
+	} {
+		err := attributeRateLimit(errors.New(tc.msg), src, dest)
+		th.AssertEqual(tc.msg, err.Error())
+		th.AssertEqual(tc.want, ratelimit.RegistryOf(err))
+	}
+
+	// same registry on both ends
+	th.AssertEqual("registry.acme.com", ratelimit.RegistryOf(attributeRateLimit(
+		errors.New("toomanyrequests"), "registry.acme.com/foo", dest)))
+
+	err := errors.New("manifest unknown")
+	th.AssertEqual(err, attributeRateLimit(err, src, dest))
+}
+
+//
+func TestCredsArgs(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	args, cleanup, err := credsArgs("busybox", nil, "")
+	th.AssertNoError(err)
+	th.AssertEqual(0, len(args))
+	cleanup()
+
+	args, cleanup, err = credsArgs(
+		"registry.acme.com:5000/foo/bar", &auth.Credentials{
+			Username: "alex", Password: "secret"}, "dest-")
+	th.AssertNoError(err)
+	th.AssertEqual(1, len(args))
+	th.AssertTrue(strings.HasPrefix(args[0], "--dest-authfile="))
+	th.AssertFalse(strings.Contains(args[0], "secret"))
+
+	file := strings.TrimPrefix(args[0], "--dest-authfile=")
+	fi, err := os.Stat(file)
+	th.AssertNoError(err)
+	th.AssertEqual(os.FileMode(0600), fi.Mode().Perm())
+
+	data, err := ioutil.ReadFile(file)
+	th.AssertNoError(err)
+	th.AssertEqual(fmt.Sprintf(`{"auths":{"registry.acme.com:5000":{"auth":"%s"}}}`,
+		base64.StdEncoding.EncodeToString([]byte("alex:secret"))), string(data))
+
+	cleanup()
+	_, err = os.Stat(file)
+	th.AssertTrue(os.IsNotExist(err))
+
+	args, cleanup, err = credsArgs(
+		"busybox", &auth.Credentials{Token: "t0ken"}, "src-")
+	th.AssertError(err, "token credentials for 'busybox' are not supported")
+	th.AssertEqual(0, len(args))
+	cleanup()
+}
+
+//
+func TestRegistryHost(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	for ref, want := range map[string]string{
+		"busybox":                        "docker.io",
+		"library/busybox":                "docker.io",
+		"index.docker.io/library/ubuntu": "docker.io",
+		"localhost/foo":                  "localhost",
+		"127.0.0.1:5000/foo/bar":         "127.0.0.1:5000",
+		"gcr.io/project/image":           "gcr.io",
+	} {
+		th.AssertEqual(want, registryHost(ref))
+	}
+}
+
+// TestSyncNoSecretsInArgs uses a fake skopeo that records its arguments and
+// the content of the auth files it gets passed
+func TestSyncNoSecretsInArgs(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	dir, err := ioutil.TempDir("", "dregsy-skopeo-test")
+	th.AssertNoError(err)
+	defer os.RemoveAll(dir)
+
+	record := filepath.Join(dir, "record")
+	fake := filepath.Join(dir, "skopeo")
+	th.AssertNoError(ioutil.WriteFile(fake, []byte(fmt.Sprintf(`#!/bin/sh
+for arg in "$@"; do
+	echo "arg: ${arg}" >> %[1]s
+	case "${arg}" in
+		--*authfile=*) cat "${arg#*=}" >> %[1]s; echo >> %[1]s ;;
+	esac
+done
+`, record)), 0700))
+
+	defer func(bin string) { skopeoBinary = bin }(skopeoBinary)
+	skopeoBinary = fake
+
+	relay := NewSkopeoRelay(nil, nil)
+	srcAuth := (&auth.Credentials{Username: "alex", Password: "s3cret"}).Encode()
+	destAuth := (&auth.Credentials{Username: "bob", Password: "t0psecret"}).Encode()
+
+	th.AssertNoError(relay.Sync(context.Background(),
+		"source.acme.com/foo", srcAuth, false,
+		"dest.acme.com/bar", destAuth, false, []string{"latest"}, "", false))
+
+	data, err := ioutil.ReadFile(record)
+	th.AssertNoError(err)
+
+	var authFiles []string
+	for _, line := range strings.Split(string(data), "\n") {
+		if strings.HasPrefix(line, "arg: ") {
+			th.AssertFalse(strings.Contains(line, "s3cret"))
+			th.AssertFalse(strings.Contains(line, "t0psecret"))
+			if strings.Contains(line, "authfile=") {
+				authFiles = append(authFiles, line[strings.Index(line, "=")+1:])
+			}
+		}
+	}
+
+	th.AssertTrue(strings.Contains(string(data),
+		base64.StdEncoding.EncodeToString([]byte("alex:s3cret"))))
+	th.AssertTrue(strings.Contains(string(data),
+		base64.StdEncoding.EncodeToString([]byte("bob:t0psecret"))))
+
+	// auth files need to be gone after sync
+	th.AssertEqual(2, len(authFiles))
+	for _, f := range authFiles {
+		_, err := os.Stat(f)
+		th.AssertTrue(os.IsNotExist(err))
+	}
+}
+
+//
+func TestCopyArtifact(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	dir, err := ioutil.TempDir("", "dregsy-skopeo-test")
+	th.AssertNoError(err)
+	defer os.RemoveAll(dir)
+
+	record := filepath.Join(dir, "record")
+	fake := filepath.Join(dir, "skopeo")
+	th.AssertNoError(ioutil.WriteFile(fake, []byte(fmt.Sprintf(`#!/bin/sh
+echo "$@" >> %s
+`, record)), 0700))
+
+	defer func(bin string) { skopeoBinary = bin }(skopeoBinary)
+	skopeoBinary = fake
+
+	// signature policies don't apply to artifacts
+	relay := NewSkopeoRelay(
+		&RelayConfig{Policy: &Policy{File: "/relay/policy.json"}}, nil)
+
+	digest := "sha256:" + strings.Repeat("ab", 32)
+	th.AssertNoError(relay.CopyArtifact(context.Background(),
+		"source.acme.com/foo", "", false, "dest.acme.com/bar", "", true,
+		digest))
+	th.AssertNoError(relay.CopyArtifact(context.Background(),
+		"source.acme.com/foo", "", false, "dest.acme.com/bar", "", false,
+		"sha256-"+strings.Repeat("ab", 32)+".sig"))
+
+	data, err := ioutil.ReadFile(record)
+	th.AssertNoError(err)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	th.AssertEqual(2, len(lines))
+
+	sig := "sha256-" + strings.Repeat("ab", 32) + ".sig"
+	for ix, want := range []string{
+		"docker://source.acme.com/foo@" + digest +
+			" docker://dest.acme.com/bar@" + digest,
+		"docker://source.acme.com/foo:" + sig +
+			" docker://dest.acme.com/bar:" + sig,
+	} {
+		th.AssertTrue(strings.HasPrefix(lines[ix],
+			"--insecure-policy copy --all --preserve-digests "))
+		th.AssertTrue(strings.HasSuffix(lines[ix], want))
+	}
+	th.AssertTrue(strings.Contains(lines[0], "--dest-tls-verify=false"))
+	th.AssertFalse(strings.Contains(lines[1], "--dest-tls-verify=false"))
+}
+
+//
+func TestSyncDigest(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	dir, err := ioutil.TempDir("", "dregsy-skopeo-test")
+	th.AssertNoError(err)
+	defer os.RemoveAll(dir)
+
+	record := filepath.Join(dir, "record")
+	fake := filepath.Join(dir, "skopeo")
+	th.AssertNoError(ioutil.WriteFile(fake, []byte(fmt.Sprintf(`#!/bin/sh
+echo "$@" >> %s
+`, record)), 0700))
+
+	defer func(bin string) { skopeoBinary = bin }(skopeoBinary)
+	skopeoBinary = fake
+
+	relay := NewSkopeoRelay(nil, nil)
+	digest := "sha256:" + strings.Repeat("ab", 32)
+	th.AssertNoError(relay.SyncDigest(context.Background(),
+		"source.acme.com/foo", "", false, "dest.acme.com/bar", "", false,
+		"latest", digest, "/task/policy.json", false))
+
+	th.AssertNoError(relay.SyncExact(context.Background(),
+		"source.acme.com/foo", "", false, "dest.acme.com/bar", "", false,
+		"latest", "", "", false))
+
+	data, err := ioutil.ReadFile(record)
+	th.AssertNoError(err)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	th.AssertEqual(2, len(lines))
+
+	th.AssertTrue(strings.HasPrefix(lines[0],
+		"--policy=/task/policy.json copy "))
+	th.AssertFalse(strings.Contains(lines[0], "--preserve-digests"))
+	th.AssertTrue(strings.HasSuffix(lines[0], "docker://source.acme.com/foo@"+
+		digest+" docker://dest.acme.com/bar:latest"))
+
+	th.AssertTrue(strings.HasPrefix(lines[1],
+		"--insecure-policy copy --all --preserve-digests "))
+	th.AssertTrue(strings.HasSuffix(lines[1],
+		"docker://source.acme.com/foo:latest "+
+			"docker://dest.acme.com/bar:latest"))
+}
@@ -18,25 +18,37 @@ package skopeo
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 
+	"github.com/xelalexv/dregsy/internal/pkg/auth"
+	"github.com/xelalexv/dregsy/internal/pkg/ratelimit"
 	"github.com/xelalexv/dregsy/internal/pkg/relays/docker"
+	"github.com/xelalexv/dregsy/internal/pkg/relays/native"
+	"github.com/xelalexv/dregsy/internal/pkg/retry"
 )
 
 const RelayID = "skopeo"
 
 //
 type RelayConfig struct {
-	Binary   string `yaml:"binary"`
-	CertsDir string `yaml:"certs-dir"`
+	Binary   string  `yaml:"binary"`
+	CertsDir string  `yaml:"certs-dir"`
+	Policy   *Policy `yaml:"policy"`
 }
 
 //
 type SkopeoRelay struct {
-	wrOut io.Writer
+	wrOut     io.Writer
+	policy    *Policy
+	policyDir string
 }
 
 //
@@ -54,88 +66,387 @@ func NewSkopeoRelay(conf *RelayConfig, out io.Writer) *SkopeoRelay {
 		if conf.CertsDir != "" {
 			certsBaseDir = conf.CertsDir
 		}
+		relay.policy = conf.Policy
 	}
 
 	return relay
 }
 
 //
-func (r *SkopeoRelay) Prepare() error {
+func (r *SkopeoRelay) Prepare(ctx context.Context) error {
 	bufOut := new(bytes.Buffer)
-	if err := runSkopeo(bufOut, nil, true, "--version"); err != nil {
+	if err := runSkopeo(ctx, bufOut, nil, true, "--version"); err != nil {
 		return fmt.Errorf("cannot execute skopeo: %v", err)
 	}
 	log.Info(bufOut.String())
+	if err := r.SetupPolicy(r.policy); err != nil {
+		return err
+	}
 	log.WithField("relay", RelayID).Info("relay ready")
 	return nil
 }
 
+// SetupPolicy prepares signature policy p for use with this relay. An inline
+// policy gets rendered into a file in a temp folder owned by the relay, which
+// is removed again on Dispose.
+func (r *SkopeoRelay) SetupPolicy(p *Policy) error {
+
+	if p == nil || p.inline == nil {
+		return nil
+	}
+
+	if r.policyDir == "" {
+		dir, err := ioutil.TempDir("", "dregsy-policies-")
+		if err != nil {
+			return fmt.Errorf("cannot create policy folder: %v", err)
+		}
+		r.policyDir = dir
+	}
+
+	return p.Render(r.policyDir)
+}
+
 //
 func (r *SkopeoRelay) Dispose() error {
-	return nil
+	if r.policyDir == "" {
+		return nil
+	}
+	err := os.RemoveAll(r.policyDir)
+	r.policyDir = ""
+	return err
 }
 
 //
-func (r *SkopeoRelay) Sync(srcRef, srcAuth string, srcSkipTLSVerify bool,
-	destRef, destAuth string, destSkipTLSVerify bool,
-	tags []string, verbose bool) error {
-
-	srcCreds := DecodeJSONAuth(srcAuth)
-	destCreds := DecodeJSONAuth(destAuth)
+func (r *SkopeoRelay) ListTags(ctx context.Context, ref, authBase64 string,
+	skipTLSVerify bool) ([]string, error) {
+	creds, err := auth.Decode(authBase64)
+	if err != nil {
+		return nil, err
+	}
+	return ListAllTags(ctx, ref, creds, certDir(ref), skipTLSVerify)
+}
 
-	cmd := []string{
-		"--insecure-policy",
-		"copy",
+//
+func (r *SkopeoRelay) ImageCreated(ctx context.Context,
+	ref, authBase64 string, skipTLSVerify bool) (time.Time, error) {
+	creds, err := auth.Decode(authBase64)
+	if err != nil {
+		return time.Time{}, err
 	}
+	return ImageCreated(ctx, ref, creds, certDir(ref), skipTLSVerify)
+}
 
-	if srcSkipTLSVerify {
-		cmd = append(cmd, "--src-tls-verify=false")
+//
+func (r *SkopeoRelay) ManifestDigest(ctx context.Context,
+	ref, authBase64 string, skipTLSVerify bool) (string, error) {
+	creds, err := auth.Decode(authBase64)
+	if err != nil {
+		return "", err
 	}
-	if destSkipTLSVerify {
-		cmd = append(cmd, "--dest-tls-verify=false")
+	return ManifestDigest(ctx, ref, creds, certDir(ref), skipTLSVerify)
+}
+
+//
+func (r *SkopeoRelay) DeleteTag(ctx context.Context,
+	ref, authBase64 string, skipTLSVerify bool) error {
+	creds, err := auth.Decode(authBase64)
+	if err != nil {
+		return err
 	}
+	return Delete(ctx, ref, creds, certDir(ref), skipTLSVerify)
+}
+
+// Sync copies the given tags, or all tags if none are given, from source to
+// destination. When ctx gets cancelled, the running skopeo process is killed,
+// and the tags not copied yet are reported. The signature policy file to use
+// is given with policy. If empty, the policy configured for the relay is used,
+// and if there is none either, any image is accepted.
+func (r *SkopeoRelay) Sync(ctx context.Context,
+	srcRef, srcAuth string, srcSkipTLSVerify bool,
+	destRef, destAuth string, destSkipTLSVerify bool,
+	tags []string, policy string, verbose bool) error {
 
-	srcCertDir := ""
-	repo, _, _ := docker.SplitRef(srcRef)
-	if repo != "" {
-		srcCertDir = fmt.Sprintf("%s/%s", certsBaseDir, withoutPort(repo))
-		cmd = append(cmd, fmt.Sprintf("--src-cert-dir=%s", srcCertDir))
+	srcCreds, err := auth.Decode(srcAuth)
+	if err != nil {
+		return fmt.Errorf("source: %v", err)
 	}
-	repo, _, _ = docker.SplitRef(destRef)
-	if repo != "" {
-		cmd = append(cmd, fmt.Sprintf(
-			"--dest-cert-dir=%s/%s", certsBaseDir, withoutPort(repo)))
+	destCreds, err := auth.Decode(destAuth)
+	if err != nil {
+		return fmt.Errorf("destination: %v", err)
 	}
 
-	if srcCreds != "" {
-		cmd = append(cmd, fmt.Sprintf("--src-creds=%s", srcCreds))
-	}
-	if destCreds != "" {
-		cmd = append(cmd, fmt.Sprintf("--dest-creds=%s", destCreds))
+	opts, cleanup, err := copyOptions(srcRef, srcCreds, srcSkipTLSVerify,
+		destRef, destCreds, destSkipTLSVerify)
+	if err != nil {
+		return err
 	}
+	defer cleanup()
+
+	cmd := r.policyArgs(policy)
+	cmd = append(cmd, "copy")
+	cmd = append(cmd, opts...)
 
 	if len(tags) == 0 {
-		var err error
-		tags, err = ListAllTags(srcRef, srcCreds, srcCertDir, srcSkipTLSVerify)
+		tags, err = ListAllTags(ctx,
+			srcRef, srcCreds, certDir(srcRef), srcSkipTLSVerify)
 		if err != nil {
 			return err
 		}
 	}
 
-	errs := false
-	for _, tag := range tags {
+	var errs []error
+	for ix, tag := range tags {
+		if ctx.Err() != nil {
+			return fmt.Errorf("sync aborted (%v), tags left incomplete: %s",
+				ctx.Err(), strings.Join(tags[ix:], ", "))
+		}
 		log.WithField("tag", tag).Info("syncing tag")
-		if err := runSkopeo(r.wrOut, r.wrOut, verbose, append(cmd,
+		if err := r.copy(ctx, verbose, append(cmd,
 			fmt.Sprintf("docker://%s:%s", srcRef, tag),
 			fmt.Sprintf("docker://%s:%s", destRef, tag))...); err != nil {
+			if ctx.Err() != nil {
+				return fmt.Errorf(
+					"sync aborted (%v), tags left incomplete: %s",
+					ctx.Err(), strings.Join(tags[ix:], ", "))
+			}
 			log.Error(err)
-			errs = true
+			errs = append(errs, attributeRateLimit(err, srcRef, destRef))
 		}
 	}
 
-	if errs {
+	if len(errs) > 0 {
+		if len(tags) == 1 {
+			return errs[0]
+		}
 		return fmt.Errorf("errors during sync")
 	}
 
 	return nil
 }
+
+// SyncDigest copies the source manifest with the given digest to tag in the
+// destination, regardless of what that tag points to in the source by now.
+// Otherwise, this works the same as Sync.
+func (r *SkopeoRelay) SyncDigest(ctx context.Context,
+	srcRef, srcAuth string, srcSkipTLSVerify bool,
+	destRef, destAuth string, destSkipTLSVerify bool,
+	tag, digest, policy string, verbose bool) error {
+	return r.syncTag(ctx, srcRef, srcAuth, srcSkipTLSVerify,
+		destRef, destAuth, destSkipTLSVerify, tag, digest, policy, false,
+		verbose)
+}
+
+// SyncExact copies tag from source to destination exactly as is, i.e. with all
+// images of a multi-arch image, and keeping the manifest digests. This is what
+// artifacts referring to the image by digest need. If digest is set, the source
+// manifest with that digest is copied, as with SyncDigest.
+func (r *SkopeoRelay) SyncExact(ctx context.Context,
+	srcRef, srcAuth string, srcSkipTLSVerify bool,
+	destRef, destAuth string, destSkipTLSVerify bool,
+	tag, digest, policy string, verbose bool) error {
+	return r.syncTag(ctx, srcRef, srcAuth, srcSkipTLSVerify,
+		destRef, destAuth, destSkipTLSVerify, tag, digest, policy, true,
+		verbose)
+}
+
+// syncTag does the actual work for SyncDigest and SyncExact. The tag is copied
+// from the source manifest with the given digest, or from the source tag if
+// digest is empty.
+func (r *SkopeoRelay) syncTag(ctx context.Context,
+	srcRef, srcAuth string, srcSkipTLSVerify bool,
+	destRef, destAuth string, destSkipTLSVerify bool,
+	tag, digest, policy string, exact, verbose bool) error {
+
+	srcCreds, err := auth.Decode(srcAuth)
+	if err != nil {
+		return fmt.Errorf("source: %v", err)
+	}
+	destCreds, err := auth.Decode(destAuth)
+	if err != nil {
+		return fmt.Errorf("destination: %v", err)
+	}
+
+	opts, cleanup, err := copyOptions(srcRef, srcCreds, srcSkipTLSVerify,
+		destRef, destCreds, destSkipTLSVerify)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	cmd := r.policyArgs(policy)
+	cmd = append(cmd, "copy")
+	if exact {
+		cmd = append(cmd, "--all", "--preserve-digests")
+	}
+	cmd = append(cmd, opts...)
+
+	src := fmt.Sprintf("docker://%s:%s", srcRef, tag)
+	logger := log.WithField("tag", tag)
+	if digest != "" {
+		src = fmt.Sprintf("docker://%s@%s", srcRef, digest)
+		logger = logger.WithField("digest", digest)
+	}
+
+	logger.Info("syncing tag")
+	if err := r.copy(ctx, verbose, append(cmd,
+		src, fmt.Sprintf("docker://%s:%s", destRef, tag))...); err != nil {
+		if ctx.Err() != nil {
+			return fmt.Errorf("sync aborted (%v), tags left incomplete: %s",
+				ctx.Err(), tag)
+		}
+		return attributeRateLimit(err, srcRef, destRef)
+	}
+
+	return nil
+}
+
+// CopyArtifact copies an artifact related to an image, such as a signature,
+// from source to destination as is. ref is either the artifact's tag, or its
+// digest. Signature policies are meant for images, not for the artifacts
+// attached to them, so no policy is enforced here. Copying artifacts therefore
+// is rejected at config validation when a policy is set.
+func (r *SkopeoRelay) CopyArtifact(ctx context.Context,
+	srcRef, srcAuth string, srcSkipTLSVerify bool,
+	destRef, destAuth string, destSkipTLSVerify bool, ref string) error {
+
+	srcCreds, err := auth.Decode(srcAuth)
+	if err != nil {
+		return fmt.Errorf("source: %v", err)
+	}
+	destCreds, err := auth.Decode(destAuth)
+	if err != nil {
+		return fmt.Errorf("destination: %v", err)
+	}
+
+	opts, cleanup, err := copyOptions(srcRef, srcCreds, srcSkipTLSVerify,
+		destRef, destCreds, destSkipTLSVerify)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	cmd := []string{"--insecure-policy", "copy", "--all", "--preserve-digests"}
+	cmd = append(cmd, opts...)
+	cmd = append(cmd, "docker://"+native.ArtifactRef(srcRef, ref),
+		"docker://"+native.ArtifactRef(destRef, ref))
+
+	return attributeRateLimit(r.copy(ctx, false, cmd...), srcRef, destRef)
+}
+
+// copyOptions returns the skopeo copy options for TLS verification, certs, and
+// credentials of source and destination. Unless an error is returned, the
+// returned cleanup function needs to be called once skopeo is done.
+func copyOptions(srcRef string, srcCreds *auth.Credentials,
+	srcSkipTLSVerify bool, destRef string, destCreds *auth.Credentials,
+	destSkipTLSVerify bool) ([]string, func(), error) {
+
+	var opts []string
+
+	if srcSkipTLSVerify {
+		opts = append(opts, "--src-tls-verify=false")
+	}
+	if destSkipTLSVerify {
+		opts = append(opts, "--dest-tls-verify=false")
+	}
+
+	if srcCertDir := certDir(srcRef); srcCertDir != "" {
+		opts = append(opts, fmt.Sprintf("--src-cert-dir=%s", srcCertDir))
+	}
+	if destCertDir := certDir(destRef); destCertDir != "" {
+		opts = append(opts, fmt.Sprintf("--dest-cert-dir=%s", destCertDir))
+	}
+
+	srcArgs, srcCleanup, err := credsArgs(srcRef, srcCreds, "src-")
+	if err != nil {
+		return nil, nil, err
+	}
+	destArgs, destCleanup, err := credsArgs(destRef, destCreds, "dest-")
+	if err != nil {
+		srcCleanup()
+		return nil, nil, err
+	}
+
+	opts = append(opts, srcArgs...)
+	opts = append(opts, destArgs...)
+	return opts, func() {
+		srcCleanup()
+		destCleanup()
+	}, nil
+}
+
+// attributeRateLimit attributes err, received from copying from srcRef to
+// destRef, to the registry that reported that its rate limit was exceeded, as
+// far as this can be told from skopeo's error output. Errors usually mention
+// the registry they were received from, or whether they occurred at source or
+// destination. If it can't be told, err is returned as is.
+func attributeRateLimit(err error, srcRef, destRef string) error {
+
+	if !retry.IsRateLimited(err) {
+		return err
+	}
+
+	src := ratelimit.Key(registryHost(srcRef))
+	dest := ratelimit.Key(registryHost(destRef))
+	msg := strings.ToLower(err.Error())
+	atSrc := strings.Contains(msg, src)
+	atDest := strings.Contains(msg, dest)
+
+	switch {
+	case src == dest:
+		return ratelimit.Attribute(src, err)
+	case atSrc && !atDest:
+		return ratelimit.Attribute(src, err)
+	case atDest && !atSrc:
+		return ratelimit.Attribute(dest, err)
+	case strings.Contains(msg, "destination"), strings.Contains(msg, "writing"):
+		return ratelimit.Attribute(dest, err)
+	case strings.Contains(msg, "source"), strings.Contains(msg, "reading"):
+		return ratelimit.Attribute(src, err)
+	}
+
+	return err
+}
+
+// policyArgs returns the skopeo options for enforcing the signature policy
+// in file policy, or the one configured for the relay
+func (r *SkopeoRelay) policyArgs(policy string) []string {
+	if policy == "" && r.policy != nil {
+		policy = r.policy.File
+	}
+	if policy == "" {
+		return []string{"--insecure-policy"}
+	}
+	return []string{fmt.Sprintf("--policy=%s", policy)}
+}
+
+// copy runs a skopeo copy with args. Skopeo's error output is included in the
+// returned error, so that callers can tell what went wrong.
+func (r *SkopeoRelay) copy(ctx context.Context, verbose bool,
+	args ...string) error {
+
+	bufErr := new(bytes.Buffer)
+	outWr := ioutil.Discard
+	errWr := io.Writer(bufErr)
+
+	if verbose {
+		outWr = chooseOutStream(r.wrOut, true, false)
+		errWr = io.MultiWriter(chooseOutStream(r.wrOut, true, true), bufErr)
+	}
+
+	if err := runSkopeo(ctx, outWr, errWr, true, args...); err != nil {
+		if msg := strings.TrimSpace(bufErr.String()); msg != "" {
+			return fmt.Errorf("%v: %s", err, msg)
+		}
+		return err
+	}
+	return nil
+}
+
+//
+func certDir(ref string) string {
+	repo, _, _ := docker.SplitRef(ref)
+	if repo == "" {
+		return ""
+	}
+	return fmt.Sprintf("%s/%s", certsBaseDir, withoutPort(repo))
+}
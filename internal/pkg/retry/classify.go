@@ -0,0 +1,190 @@
+/*
+	Copyright 2020 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package retry
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+)
+
+// error messages hinting at a permanent failure; checked before the transient
+// ones, since e.g. an authentication failure may also mention a timeout
+var permanentPatterns = []string{
+	"unauthorized",
+	"authentication required",
+	"denied",
+	"forbidden",
+	"manifest unknown",
+	"name unknown",
+	"not found",
+}
+
+// error messages hinting at a transient failure
+var transientPatterns = []string{
+	"toomanyrequests",
+	"too many requests",
+	"rate exceeded",
+	"throttl",
+	"internal server error",
+	"bad gateway",
+	"service unavailable",
+	"gateway timeout",
+	"timeout",
+	"timed out",
+	"connection reset",
+	"connection refused",
+	"broken pipe",
+	"unexpected eof",
+	"temporary failure",
+	"try again",
+}
+
+// error messages hinting at an exceeded rate limit
+var rateLimitPatterns = []string{
+	"toomanyrequests",
+	"too many requests",
+	"rate limit",
+}
+
+// HTTP status codes in error messages, e.g. 'unexpected status code 503' or
+// 'received unexpected HTTP status: 500 Internal Server Error'
+var statusPattern = regexp.MustCompile(`status(?: code)?:? ([1-5][0-9]{2})\b`)
+
+// IsTransient classifies err as transient, i.e. worth retrying, such as server
+// errors, rate limiting, time-outs and connection failures, or as permanent,
+// such as failed authentication or missing images. Unknown errors are
+// considered permanent.
+func IsTransient(err error) bool {
+
+	if err == nil {
+		return false
+	}
+
+	if errors.Is(err, context.Canceled) ||
+		errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+
+	var perr *permanentError
+	if errors.As(err, &perr) {
+		return false
+	}
+
+	var terr *transport.Error
+	if errors.As(err, &terr) {
+		return isTransientStatus(terr.StatusCode)
+	}
+
+	var aerr awserr.Error
+	if errors.As(err, &aerr) {
+		return request.IsErrorRetryable(aerr) || request.IsErrorThrottle(aerr)
+	}
+
+	var nerr net.Error
+	if errors.As(err, &nerr) && nerr.Timeout() {
+		return true
+	}
+
+	msg := strings.ToLower(err.Error())
+
+	if m := statusPattern.FindStringSubmatch(msg); m != nil {
+		status, _ := strconv.Atoi(m[1])
+		return isTransientStatus(status)
+	}
+
+	for _, p := range permanentPatterns {
+		if strings.Contains(msg, p) {
+			return false
+		}
+	}
+
+	for _, p := range transientPatterns {
+		if strings.Contains(msg, p) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// IsRateLimited determines whether err was caused by an exceeded rate limit,
+// i.e. HTTP status 429, or the TOOMANYREQUESTS error code used by registries
+func IsRateLimited(err error) bool {
+
+	if err == nil {
+		return false
+	}
+
+	var terr *transport.Error
+	if errors.As(err, &terr) {
+		return terr.StatusCode == http.StatusTooManyRequests
+	}
+
+	msg := strings.ToLower(err.Error())
+
+	if m := statusPattern.FindStringSubmatch(msg); m != nil {
+		return m[1] == strconv.Itoa(http.StatusTooManyRequests)
+	}
+
+	for _, p := range rateLimitPatterns {
+		if strings.Contains(msg, p) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Permanent marks err as permanent, so that it is not retried, regardless of
+// how it would be classified otherwise
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &permanentError{err: err}
+}
+
+//
+type permanentError struct {
+	err error
+}
+
+//
+func (e *permanentError) Error() string {
+	return e.err.Error()
+}
+
+//
+func (e *permanentError) Unwrap() error {
+	return e.err
+}
+
+//
+func isTransientStatus(status int) bool {
+	return status == http.StatusTooManyRequests ||
+		status == http.StatusRequestTimeout ||
+		status >= http.StatusInternalServerError
+}
@@ -0,0 +1,121 @@
+/*
+	Copyright 2020 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package retry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+//
+const (
+	DefaultAttempts       = 3
+	DefaultInitialBackoff = 2 * time.Second
+	DefaultMaxBackoff     = time.Minute
+)
+
+// Policy determines how often, and with which backoff, an operation failing
+// with a transient error is retried
+type Policy struct {
+	Attempts       int           `yaml:"attempts"`
+	InitialBackoff time.Duration `yaml:"initial-backoff"`
+	MaxBackoff     time.Duration `yaml:"max-backoff"`
+}
+
+// DefaultPolicy returns the policy used when none is configured
+func DefaultPolicy() *Policy {
+	return &Policy{
+		Attempts:       DefaultAttempts,
+		InitialBackoff: DefaultInitialBackoff,
+		MaxBackoff:     DefaultMaxBackoff,
+	}
+}
+
+// Validate checks the policy, and sets defaults for fields that were omitted
+func (p *Policy) Validate() error {
+
+	if p.Attempts < 0 {
+		return errors.New("retry attempts need to be 0 or a positive integer")
+	}
+	if p.InitialBackoff < 0 || p.MaxBackoff < 0 {
+		return errors.New("retry backoffs need to be 0 or positive durations")
+	}
+
+	if p.Attempts == 0 {
+		p.Attempts = DefaultAttempts
+	}
+	if p.InitialBackoff == 0 {
+		p.InitialBackoff = DefaultInitialBackoff
+	}
+	if p.MaxBackoff == 0 {
+		p.MaxBackoff = DefaultMaxBackoff
+	}
+	if p.MaxBackoff < p.InitialBackoff {
+		return fmt.Errorf(
+			"retry max-backoff %s is shorter than initial-backoff %s",
+			p.MaxBackoff, p.InitialBackoff)
+	}
+
+	return nil
+}
+
+// Backoff returns the time to wait before the given retry, starting at 1, i.e.
+// the initial backoff, doubled with each further retry, up to max backoff
+func (p *Policy) Backoff(retry int) time.Duration {
+	b := p.InitialBackoff
+	for i := 1; i < retry && b < p.MaxBackoff; i++ {
+		b *= 2
+	}
+	if b > p.MaxBackoff {
+		b = p.MaxBackoff
+	}
+	return b
+}
+
+// Do runs op, and retries it according to policy p as long as it fails with a
+// transient error, or until ctx is done. A nil policy means no retries. The
+// last error is returned.
+func Do(ctx context.Context, p *Policy, logger *log.Entry, op func() error) error {
+
+	attempts := 1
+	if p != nil {
+		attempts = p.Attempts
+	}
+
+	for i := 1; ; i++ {
+
+		err := op()
+		if err == nil || i >= attempts || !IsTransient(err) ||
+			ctx.Err() != nil {
+			return err
+		}
+
+		backoff := p.Backoff(i)
+		logger.WithField("attempt", i).Warnf(
+			"transient error, retrying in %s: %v", backoff, err)
+
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return err
+		}
+	}
+}
@@ -0,0 +1,184 @@
+/*
+	Copyright 2020 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package retry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/xelalexv/dregsy/internal/pkg/test"
+)
+
+//
+func TestIsTransient(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	for _, e := range []string{
+		"toomanyrequests: You have reached your pull rate limit",
+		"received unexpected HTTP status: 500 Internal Server Error",
+		"unexpected status code 503 Service Unavailable",
+		"Error writing blob: 502 Bad Gateway",
+		"read tcp 10.0.0.1:443: connection reset by peer",
+		"net/http: TLS handshake timeout",
+		"unexpected EOF",
+	} {
+		if !IsTransient(errors.New(e)) {
+			t.Errorf("should be transient: %s", e)
+		}
+	}
+
+	for _, e := range []string{
+		"unauthorized: authentication required",
+		"manifest for busybox:2.0 not found: manifest unknown",
+		"denied: requested access to the resource is denied",
+		"unexpected status code 404 Not Found",
+		"status code 401",
+		"exit status 1",
+		"something we have never seen before",
+	} {
+		if IsTransient(errors.New(e)) {
+			t.Errorf("should be permanent: %s", e)
+		}
+	}
+
+	th.AssertFalse(IsTransient(nil))
+	th.AssertFalse(IsTransient(context.Canceled))
+	th.AssertFalse(IsTransient(
+		fmt.Errorf("aborted: %w", context.DeadlineExceeded)))
+
+	th.AssertTrue(IsTransient(fmt.Errorf("error writing image: %w",
+		&transport.Error{StatusCode: 429})))
+	th.AssertFalse(IsTransient(fmt.Errorf("error fetching manifest: %w",
+		&transport.Error{StatusCode: 404})))
+
+	th.AssertTrue(IsTransient(awserr.New("ThrottlingException", "slow down", nil)))
+	th.AssertFalse(IsTransient(
+		awserr.New("RepositoryNotFoundException", "no such repo", nil)))
+}
+
+//
+func TestIsRateLimited(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	th.AssertTrue(IsRateLimited(errors.New(
+		"toomanyrequests: You have reached your pull rate limit")))
+	th.AssertTrue(IsRateLimited(errors.New(
+		"unexpected status code 429 Too Many Requests")))
+	th.AssertTrue(IsRateLimited(fmt.Errorf("error writing image: %w",
+		&transport.Error{StatusCode: 429})))
+
+	th.AssertFalse(IsRateLimited(nil))
+	th.AssertFalse(IsRateLimited(errors.New(
+		"unexpected status code 503 Service Unavailable")))
+	th.AssertFalse(IsRateLimited(&transport.Error{StatusCode: 500}))
+
+	err := errors.New("503 Service Unavailable")
+	th.AssertTrue(IsTransient(err))
+	th.AssertFalse(IsTransient(Permanent(err)))
+	th.AssertEqual(err.Error(), Permanent(err).Error())
+	th.AssertTrue(errors.Is(Permanent(err), err))
+	th.AssertNil(Permanent(nil))
+}
+
+//
+func TestBackoff(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	p := &Policy{InitialBackoff: time.Second, MaxBackoff: 5 * time.Second}
+	th.AssertNoError(p.Validate())
+	th.AssertEqual(DefaultAttempts, p.Attempts)
+
+	th.AssertEqual(time.Second, p.Backoff(1))
+	th.AssertEqual(2*time.Second, p.Backoff(2))
+	th.AssertEqual(4*time.Second, p.Backoff(3))
+	th.AssertEqual(5*time.Second, p.Backoff(4))
+	th.AssertEqual(5*time.Second, p.Backoff(10))
+
+	th.AssertError((&Policy{Attempts: -1}).Validate(),
+		"retry attempts need to be 0 or a positive integer")
+	th.AssertError((&Policy{InitialBackoff: time.Minute,
+		MaxBackoff: time.Second}).Validate(), "is shorter than initial-backoff")
+}
+
+//
+func TestDo(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	p := &Policy{Attempts: 3, InitialBackoff: time.Millisecond}
+	th.AssertNoError(p.Validate())
+	logger := log.WithField("test", t.Name())
+
+	// transient error, succeeds on last attempt
+	calls := 0
+	th.AssertNoError(Do(context.Background(), p, logger, func() error {
+		if calls++; calls < 3 {
+			return errors.New("503 Service Unavailable")
+		}
+		return nil
+	}))
+	th.AssertEqual(3, calls)
+
+	// transient error, attempts exhausted
+	calls = 0
+	th.AssertError(Do(context.Background(), p, logger, func() error {
+		calls++
+		return errors.New("503 Service Unavailable")
+	}), "Service Unavailable")
+	th.AssertEqual(3, calls)
+
+	// permanent error
+	calls = 0
+	th.AssertError(Do(context.Background(), p, logger, func() error {
+		calls++
+		return errors.New("manifest unknown")
+	}), "manifest unknown")
+	th.AssertEqual(1, calls)
+
+	// no policy
+	calls = 0
+	th.AssertError(Do(context.Background(), nil, logger, func() error {
+		calls++
+		return errors.New("503 Service Unavailable")
+	}), "Service Unavailable")
+	th.AssertEqual(1, calls)
+
+	// cancelled while backing off
+	ctx, cancel := context.WithCancel(context.Background())
+	p.InitialBackoff = time.Hour
+	p.MaxBackoff = time.Hour
+	calls = 0
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		cancel()
+	}()
+	th.AssertError(Do(ctx, p, logger, func() error {
+		calls++
+		return errors.New("503 Service Unavailable")
+	}), "Service Unavailable")
+	th.AssertEqual(1, calls)
+}
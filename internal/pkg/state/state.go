@@ -0,0 +1,136 @@
+/*
+	Copyright 2020 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package state
+
+import (
+	"sync"
+	"time"
+)
+
+//
+const (
+	OutcomeSynced       = "synced"
+	OutcomeUpToDate     = "up-to-date"
+	OutcomeFailed       = "failed"
+	OutcomePolicyFailed = "policy-failed"
+	OutcomePruned       = "pruned"
+)
+
+// Store persists the sync state of tasks across runs of dregsy
+type Store interface {
+	// Task returns the recorded state of the named task, or an empty state if
+	// nothing has been recorded yet
+	Task(name string) (*TaskState, error)
+	// Save records the state of the named task
+	Save(name string, ts *TaskState) error
+	// Close releases any resources held by the store
+	Close() error
+}
+
+// TaskState is the recorded state of a task
+type TaskState struct {
+	LastRun     time.Time                       `json:"last-run"`
+	LastSuccess time.Time                       `json:"last-success"`
+	Failed      bool                            `json:"failed"`
+	Mappings    map[string]map[string]*TagState `json:"mappings"`
+	//
+	mutex sync.Mutex
+}
+
+// TagState is the recorded state of a single tag within a mapping
+type TagState struct {
+	SourceDigest string    `json:"source-digest"`
+	TargetDigest string    `json:"target-digest,omitempty"`
+	Time         time.Time `json:"time"`
+	Outcome      string    `json:"outcome"`
+	Error        string    `json:"error,omitempty"`
+}
+
+//
+func NewTaskState() *TaskState {
+	return &TaskState{Mappings: make(map[string]map[string]*TagState)}
+}
+
+// Tag returns the recorded state of tag within mapping, or nil if there is none
+func (ts *TaskState) Tag(mapping, tag string) *TagState {
+	ts.mutex.Lock()
+	defer ts.mutex.Unlock()
+	return ts.Mappings[mapping][tag]
+}
+
+// SetTag records the state of tag within mapping
+func (ts *TaskState) SetTag(mapping, tag string, s *TagState) {
+	ts.mutex.Lock()
+	defer ts.mutex.Unlock()
+	if ts.Mappings == nil {
+		ts.Mappings = make(map[string]map[string]*TagState)
+	}
+	if ts.Mappings[mapping] == nil {
+		ts.Mappings[mapping] = make(map[string]*TagState)
+	}
+	ts.Mappings[mapping][tag] = s
+}
+
+// RemoveTag removes the recorded state of tag within mapping
+func (ts *TaskState) RemoveTag(mapping, tag string) {
+	ts.mutex.Lock()
+	defer ts.mutex.Unlock()
+	delete(ts.Mappings[mapping], tag)
+}
+
+// Purge removes the recorded state of all mappings that are not in keep. For
+// the mappings in keep, the state of all tags not in their tag list is removed.
+// A mapping with a nil tag list is left as is, e.g. when its tags could not be
+// determined.
+func (ts *TaskState) Purge(keep map[string][]string) {
+
+	ts.mutex.Lock()
+	defer ts.mutex.Unlock()
+
+	for mapping, tags := range ts.Mappings {
+		list, ok := keep[mapping]
+		if !ok {
+			delete(ts.Mappings, mapping)
+			continue
+		}
+		if list == nil {
+			continue
+		}
+		current := make(map[string]bool, len(list))
+		for _, t := range list {
+			current[t] = true
+		}
+		for t := range tags {
+			if !current[t] {
+				delete(tags, t)
+			}
+		}
+		if len(tags) == 0 {
+			delete(ts.Mappings, mapping)
+		}
+	}
+}
+
+// IsUpToDate determines whether tag within mapping was successfully synced
+// when the source manifest had digest srcDigest, and the target manifest has
+// not changed since then, i.e. still has digest trgtDigest
+func (ts *TaskState) IsUpToDate(mapping, tag, srcDigest, trgtDigest string) bool {
+	s := ts.Tag(mapping, tag)
+	return s != nil && s.Outcome != OutcomeFailed &&
+		s.Outcome != OutcomePolicyFailed && srcDigest != "" &&
+		s.SourceDigest == srcDigest && s.TargetDigest == trgtDigest
+}
@@ -0,0 +1,147 @@
+/*
+	Copyright 2020 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package state
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// memoryStore keeps state only for the lifetime of the process; it's used
+// when no state dir is configured
+type memoryStore struct {
+	mutex sync.Mutex
+	tasks map[string]*TaskState
+}
+
+//
+func NewMemoryStore() Store {
+	return &memoryStore{tasks: make(map[string]*TaskState)}
+}
+
+//
+func (s *memoryStore) Task(name string) (*TaskState, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if ts, ok := s.tasks[name]; ok {
+		return ts, nil
+	}
+	return NewTaskState(), nil
+}
+
+//
+func (s *memoryStore) Save(name string, ts *TaskState) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.tasks[name] = ts
+	return nil
+}
+
+//
+func (s *memoryStore) Close() error {
+	return nil
+}
+
+// fileStore keeps the state of each task in a JSON file inside the state dir
+type fileStore struct {
+	dir   string
+	mutex sync.Mutex
+}
+
+//
+func NewFileStore(dir string) (Store, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("cannot create state dir '%s': %v", dir, err)
+	}
+	log.WithField("dir", dir).Info("using state dir")
+	return &fileStore{dir: dir}, nil
+}
+
+//
+func (s *fileStore) Task(name string) (*TaskState, error) {
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	data, err := ioutil.ReadFile(s.file(name))
+	if os.IsNotExist(err) {
+		return NewTaskState(), nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf(
+			"cannot read state of task '%s': %v", name, err)
+	}
+
+	ts := NewTaskState()
+	if err := json.Unmarshal(data, ts); err != nil {
+		return nil, fmt.Errorf(
+			"cannot parse state of task '%s': %v", name, err)
+	}
+	return ts, nil
+}
+
+//
+func (s *fileStore) Save(name string, ts *TaskState) error {
+
+	ts.mutex.Lock()
+	data, err := json.MarshalIndent(ts, "", "  ")
+	ts.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	// write to temp file first and rename, so that we never leave a partially
+	// written state file behind
+	tmp, err := ioutil.TempFile(s.dir, ".state-")
+	if err != nil {
+		return fmt.Errorf("cannot save state of task '%s': %v", name, err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("cannot save state of task '%s': %v", name, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("cannot save state of task '%s': %v", name, err)
+	}
+
+	if err := os.Rename(tmp.Name(), s.file(name)); err != nil {
+		return fmt.Errorf("cannot save state of task '%s': %v", name, err)
+	}
+	return nil
+}
+
+//
+func (s *fileStore) Close() error {
+	return nil
+}
+
+//
+func (s *fileStore) file(task string) string {
+	return filepath.Join(s.dir, url.PathEscape(task)+".json")
+}
@@ -0,0 +1,128 @@
+/*
+	Copyright 2020 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package state
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/xelalexv/dregsy/internal/pkg/test"
+)
+
+//
+func TestFileStore(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	dir, err := ioutil.TempDir("", "dregsy-state-")
+	th.AssertNoError(err)
+	defer os.RemoveAll(dir)
+
+	store, err := NewFileStore(filepath.Join(dir, "state"))
+	th.AssertNoError(err)
+
+	ts, err := store.Task("task/1")
+	th.AssertNoError(err)
+	th.AssertTrue(ts.LastRun.IsZero())
+	th.AssertNil(ts.Tag("a -> b", "latest"))
+
+	now := time.Now().Round(time.Second)
+	ts.LastRun = now
+	ts.SetTag("a -> b", "latest", &TagState{
+		SourceDigest: "sha256:1",
+		TargetDigest: "sha256:2",
+		Time:         now,
+		Outcome:      OutcomeSynced,
+	})
+	th.AssertNoError(store.Save("task/1", ts))
+	th.AssertNoError(store.Close())
+
+	// re-open
+	store, err = NewFileStore(filepath.Join(dir, "state"))
+	th.AssertNoError(err)
+
+	ts, err = store.Task("task/1")
+	th.AssertNoError(err)
+	th.AssertTrue(now.Equal(ts.LastRun))
+	rec := ts.Tag("a -> b", "latest")
+	th.AssertNotNil(rec)
+	th.AssertEqual("sha256:1", rec.SourceDigest)
+	th.AssertEqual(OutcomeSynced, rec.Outcome)
+
+	ts, err = store.Task("task2")
+	th.AssertNoError(err)
+	th.AssertTrue(ts.LastRun.IsZero())
+
+	// corrupt state
+	th.AssertNoError(ioutil.WriteFile(
+		filepath.Join(dir, "state", "task2.json"), []byte("{"), 0600))
+	_, err = store.Task("task2")
+	th.AssertError(err, "cannot parse state of task 'task2'")
+}
+
+//
+func TestIsUpToDate(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	ts := NewTaskState()
+	th.AssertFalse(ts.IsUpToDate("m", "t", "sha256:1", "sha256:2"))
+
+	ts.SetTag("m", "t", &TagState{
+		SourceDigest: "sha256:1",
+		TargetDigest: "sha256:2",
+		Outcome:      OutcomeSynced,
+	})
+	th.AssertTrue(ts.IsUpToDate("m", "t", "sha256:1", "sha256:2"))
+	th.AssertFalse(ts.IsUpToDate("m", "t", "sha256:3", "sha256:2"))
+	th.AssertFalse(ts.IsUpToDate("m", "t", "sha256:1", "sha256:3"))
+	th.AssertFalse(ts.IsUpToDate("m", "u", "sha256:1", "sha256:2"))
+
+	ts.SetTag("m", "t", &TagState{
+		SourceDigest: "sha256:1",
+		TargetDigest: "sha256:2",
+		Outcome:      OutcomeFailed,
+	})
+	th.AssertFalse(ts.IsUpToDate("m", "t", "sha256:1", "sha256:2"))
+}
+
+//
+func TestPurge(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	ts := NewTaskState()
+	for _, m := range []string{"a -> b", "c -> d", "e -> f"} {
+		for _, tag := range []string{"1.0", "2.0"} {
+			ts.SetTag(m, tag, &TagState{Outcome: OutcomeSynced})
+		}
+	}
+
+	ts.Purge(map[string][]string{"a -> b": {"2.0", "3.0"}, "c -> d": nil})
+
+	th.AssertNil(ts.Tag("a -> b", "1.0"))
+	th.AssertNotNil(ts.Tag("a -> b", "2.0"))
+	th.AssertNotNil(ts.Tag("c -> d", "1.0"))
+	th.AssertNotNil(ts.Tag("c -> d", "2.0"))
+	th.AssertEqual(2, len(ts.Mappings))
+
+	ts.Purge(map[string][]string{"a -> b": {}})
+	th.AssertEqual(0, len(ts.Mappings))
+}
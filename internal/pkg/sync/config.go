@@ -17,15 +17,19 @@
 package sync
 
 import (
+	"errors"
 	"fmt"
 	"io/ioutil"
+	"strings"
 	"time"
 
 	"gopkg.in/yaml.v2"
 
 	log "github.com/sirupsen/logrus"
 
+	"github.com/xelalexv/dregsy/internal/pkg/metrics"
 	"github.com/xelalexv/dregsy/internal/pkg/relays/docker"
+	"github.com/xelalexv/dregsy/internal/pkg/relays/native"
 	"github.com/xelalexv/dregsy/internal/pkg/relays/skopeo"
 )
 
@@ -35,12 +39,24 @@ const minimumAuthRefreshInterval = time.Hour
 
 //
 type SyncConfig struct {
-	Relay      string              `yaml:"relay"`
-	Docker     *docker.RelayConfig `yaml:"docker"`
-	Skopeo     *skopeo.RelayConfig `yaml:"skopeo"`
-	DockerHost string              `yaml:"dockerhost"`  // DEPRECATED
-	APIVersion string              `yaml:"api-version"` // DEPRECATED
-	Tasks      []*Task             `yaml:"tasks"`
+	Relay              string              `yaml:"relay"`
+	Docker             *docker.RelayConfig `yaml:"docker"`
+	Skopeo             *skopeo.RelayConfig `yaml:"skopeo"`
+	Native             *native.RelayConfig `yaml:"native"`
+	DockerHost         string              `yaml:"dockerhost"`  // DEPRECATED
+	APIVersion         string              `yaml:"api-version"` // DEPRECATED
+	StateDir           string              `yaml:"state-dir"`
+	Metrics            *metrics.Config     `yaml:"metrics"`
+	Health             *HealthConfig       `yaml:"health"`
+	MaxConcurrentTasks int                 `yaml:"max-concurrent-tasks"`
+	MaxConcurrentTags  int                 `yaml:"max-concurrent-tags"`
+	WatchConfig        bool                `yaml:"watch-config"`
+	Tasks              []*Task             `yaml:"tasks"`
+
+	//
+	file        string // the file this config was loaded from, if any
+	fingerprint string // of all settings except tasks
+	oneOff      bool
 }
 
 //
@@ -83,7 +99,13 @@ func (c *SyncConfig) validate() error {
 			}
 		}
 
-	case skopeo.RelayID:
+	case skopeo.RelayID, native.RelayID:
+		if c.Relay == skopeo.RelayID && c.Skopeo != nil &&
+			c.Skopeo.Policy != nil {
+			if err := c.Skopeo.Policy.Validate(); err != nil {
+				return fmt.Errorf("skopeo relay: %v", err)
+			}
+		}
 		if c.DockerHost != "" {
 			return fmt.Errorf(
 				"setting 'dockerhost' implies '%s' relay, but relay is set to '%s'",
@@ -92,14 +114,82 @@ func (c *SyncConfig) validate() error {
 
 	default:
 		return fmt.Errorf(
-			"invalid relay type: '%s', must be either '%s' or '%s'",
-			c.Relay, docker.RelayID, skopeo.RelayID)
+			"invalid relay type: '%s', must be one of '%s', '%s', or '%s'",
+			c.Relay, docker.RelayID, skopeo.RelayID, native.RelayID)
+	}
+
+	if c.MaxConcurrentTasks < 0 {
+		return errors.New(
+			"max-concurrent-tasks needs to be 0 or a positive integer")
+	}
+
+	if c.MaxConcurrentTags < 0 {
+		return errors.New(
+			"max-concurrent-tags needs to be 0 or a positive integer")
+	}
+
+	if c.Relay == docker.RelayID && c.MaxConcurrentTags > 1 {
+		log.Warn("the 'docker' relay syncs one tag at a time, " +
+			"ignoring max-concurrent-tags")
+		c.MaxConcurrentTags = 1
+	}
+
+	if c.Metrics != nil {
+		if err := c.Metrics.Validate(); err != nil {
+			return err
+		}
+	}
+
+	if c.Health != nil {
+		if err := c.Health.validate(); err != nil {
+			return err
+		}
 	}
 
+	names := make(map[string]bool, len(c.Tasks))
 	for _, t := range c.Tasks {
+		if t.Policy != nil && c.Relay != skopeo.RelayID {
+			return fmt.Errorf(
+				"task '%s': a policy is only supported by the '%s' relay",
+				t.Name, skopeo.RelayID)
+		}
 		if err := t.validate(); err != nil {
 			return err
 		}
+		if c.Relay == skopeo.RelayID {
+			// skopeo takes bearer tokens only on the command line, where they
+			// would show up in the process list
+			for i, l := range []*Location{t.Source, t.Target} {
+				if l.hasToken() {
+					return fmt.Errorf("%s registry in task '%s' invalid: "+
+						"token credentials are not supported by the '%s' relay",
+						[]string{"source", "target"}[i], t.Name, skopeo.RelayID)
+				}
+			}
+		}
+		if c.Relay == skopeo.RelayID && (t.Policy != nil ||
+			(c.Skopeo != nil && c.Skopeo.Policy != nil)) {
+			// artifacts are copied as is, which would bypass the policy
+			for _, m := range t.Mappings {
+				if t.copiesReferrers(m) {
+					return fmt.Errorf("task '%s': copy-referrers cannot be "+
+						"combined with a signature policy", t.Name)
+				}
+			}
+		}
+		if c.Relay == docker.RelayID {
+			for _, m := range t.Mappings {
+				if t.copiesReferrers(m) {
+					return fmt.Errorf("task '%s': copy-referrers is only "+
+						"supported by the '%s' and '%s' relays", t.Name,
+						skopeo.RelayID, native.RelayID)
+				}
+			}
+		}
+		if names[t.Name] {
+			return fmt.Errorf("duplicate task name '%s'", t.Name)
+		}
+		names[t.Name] = true
 	}
 	return nil
 }
@@ -113,15 +203,106 @@ func LoadConfig(file string) (*SyncConfig, error) {
 		return nil, fmt.Errorf("error loading config file '%s': %v", file, err)
 	}
 
+	if data, err = expandEnv(data); err != nil {
+		return nil, fmt.Errorf("error parsing config file '%s': %v", file, err)
+	}
+
 	config := &SyncConfig{}
 
 	if err = yaml.Unmarshal(data, config); err != nil {
 		return nil, fmt.Errorf("error parsing config file '%s': %v", file, err)
 	}
 
+	// fingerprints need to be taken before validation, which may alter the
+	// settings, e.g. when mappings get loaded from a file
+	if err = config.takeFingerprints(); err != nil {
+		return nil, fmt.Errorf("error parsing config file '%s': %v", file, err)
+	}
+
 	if err = config.validate(); err != nil {
 		return nil, err
 	}
 
+	config.file = file
 	return config, nil
 }
+
+// takeFingerprints records the current settings of the config and each of its
+// tasks, so that changes can be detected when reloading the config
+func (c *SyncConfig) takeFingerprints() error {
+
+	for _, t := range c.Tasks {
+		data, err := yaml.Marshal(t)
+		if err != nil {
+			return err
+		}
+		// credentials are masked when marshaling, so they're added separately
+		t.fingerprint = string(data) + t.Source.credentialsFingerprint() +
+			t.Target.credentialsFingerprint()
+	}
+
+	global := *c
+	global.Tasks = nil
+	data, err := yaml.Marshal(&global)
+	if err != nil {
+		return err
+	}
+	c.fingerprint = string(data)
+
+	return nil
+}
+
+// reloadable determines whether this config can be reloaded while syncing,
+// which requires that it has been loaded from a file, and is not a one-off
+// config
+func (c *SyncConfig) reloadable() bool {
+	return c.file != "" && !c.oneOff
+}
+
+// OneOff turns the tasks in this config into one-off tasks, i.e. each task is
+// run exactly once, regardless of its interval or schedule. If names are
+// given, only the tasks with these names are kept.
+func (c *SyncConfig) OneOff(names []string) error {
+
+	if len(names) > 0 {
+		byName := make(map[string]*Task, len(c.Tasks))
+		for _, t := range c.Tasks {
+			byName[t.Name] = t
+		}
+		var selected []*Task
+		seen := make(map[string]bool)
+		for _, n := range names {
+			t, ok := byName[n]
+			if !ok {
+				return fmt.Errorf("no task named '%s'", n)
+			}
+			if !seen[n] {
+				selected = append(selected, t)
+				seen[n] = true
+			}
+		}
+		c.Tasks = selected
+	}
+
+	for _, t := range c.Tasks {
+		t.Interval = 0
+		t.Schedule = ""
+		t.schedule = nil
+	}
+	c.oneOff = true
+
+	return nil
+}
+
+// location returns the first source or target location of the tasks in this
+// config that points to registry, or nil if there is none
+func (c *SyncConfig) location(registry string) *Location {
+	for _, t := range c.Tasks {
+		for _, l := range []*Location{t.Source, t.Target} {
+			if l != nil && strings.EqualFold(l.Registry, registry) {
+				return l
+			}
+		}
+	}
+	return nil
+}
@@ -17,8 +17,12 @@
 package sync
 
 import (
+	"io/ioutil"
+	"os"
+	"strings"
 	"testing"
 
+	"github.com/xelalexv/dregsy/internal/pkg/relays/skopeo"
 	"github.com/xelalexv/dregsy/internal/pkg/test"
 )
 
@@ -36,6 +40,12 @@ func TestValidSyncConfigs(t *testing.T) {
 	th.AssertNoError(e)
 	th.AssertNotNil(c)
 	th.AssertEqual("docker", c.Relay)
+
+	c, e = LoadConfig(th.GetFixture("config/native-valid.yaml"))
+	th.AssertNoError(e)
+	th.AssertNotNil(c)
+	th.AssertEqual("native", c.Relay)
+	th.AssertFalse(c.Tasks[0].Mappings[0].tagSet.IsVerbatim())
 }
 
 //
@@ -48,12 +58,38 @@ func TestInvalidSyncConfigs(t *testing.T) {
 	tryConfig(th, "config/multiple-relays.yaml",
 		"setting 'dockerhost' implies 'docker' relay")
 
+	// concurrency
+	tryConfig(th, "config/bad-concurrency.yaml",
+		"max-concurrent-tasks needs to be 0 or a positive integer")
+
+	// metrics
+	tryConfig(th, "config/metrics-no-listen.yaml",
+		"metrics listen address not set")
+
 	// task
 	tryConfig(th, "config/task-no-name.yaml", "a task requires a name")
 	tryConfig(th, "config/task-low-interval.yaml",
 		"minimum task interval is 30 seconds")
 	tryConfig(th, "config/task-bad-interval.yaml",
 		"task interval needs to be 0 or a positive integer")
+	tryConfig(th, "config/task-interval-and-schedule.yaml",
+		"task 'test' can have either an interval or a schedule, not both")
+	tryConfig(th, "config/task-bad-schedule.yaml",
+		"schedule of task 'test' invalid: invalid schedule 'every night'")
+	tryConfig(th, "config/task-bad-max-age.yaml",
+		"max-age of task 'test' needs to be a positive duration")
+	tryConfig(th, "config/task-bad-timeout.yaml",
+		"timeout of task 'test' needs to be a positive duration")
+	tryConfig(th, "config/task-duplicate-name.yaml",
+		"duplicate task name 'test'")
+	tryConfig(th, "config/task-bad-retry.yaml",
+		"task 'test': retry max-backoff 10s is shorter than initial-backoff 1m0s")
+	tryConfig(th, "config/task-bad-verify.yaml",
+		"task 'test': verify requires at least one key")
+	tryConfig(th, "config/referrers-docker.yaml", "task 'test': copy-referrers "+
+		"is only supported by the 'skopeo' and 'native' relays")
+	tryConfig(th, "config/referrers-policy.yaml", "task 'test': copy-referrers "+
+		"cannot be combined with a signature policy")
 	tryConfig(th, "config/task-no-source.yaml",
 		"source registry in task 'test' invalid: location is nil")
 	tryConfig(th, "config/task-no-target.yaml",
@@ -63,9 +99,123 @@ func TestInvalidSyncConfigs(t *testing.T) {
 	tryConfig(th, "config/source-no-registry.yaml",
 		"source registry in task 'test' invalid: registry not set")
 	tryConfig(th, "config/source-not-ecr.yaml", "is not an ECR registry")
+	tryConfig(th, "config/location-password-file-no-username.yaml",
+		"target registry in task 'test' invalid: "+
+			"password and password-file require username")
+	tryConfig(th, "config/location-bad-auth.yaml",
+		"source registry in task 'test' invalid: invalid auth, not JSON")
+	tryConfig(th, "config/skopeo-token.yaml",
+		"source registry in task 'test' invalid: token credentials are not "+
+			"supported by the 'skopeo' relay")
+
+	// signature policy
+	tryConfig(th, "config/policy-no-default.yaml",
+		"task 'test': inline policy: no default requirement")
+	tryConfig(th, "config/policy-not-skopeo.yaml",
+		"task 'test': a policy is only supported by the 'skopeo' relay")
+
+	// environment
+	tryConfig(th, "config/env-undefined.yaml",
+		"environment variable 'DREGSY_TEST_UNDEFINED' is not set")
 
 	// mappings
 	tryConfig(th, "config/mapping-no-from.yaml", "mapping without 'From' path")
+	tryConfig(th, "config/mapping-bad-regex.yaml", "invalid regex '^1\\.(29'")
+	tryConfig(th, "config/mapping-bad-semver.yaml",
+		"exclude list: invalid semver constraint 'latest'")
+	tryConfig(th, "config/mapping-bad-keep.yaml", "invalid keep-latest-by: 'age'")
+	tryConfig(th, "config/mapping-bad-prune-protect.yaml",
+		"invalid prune-protect expression '^release-('")
+	tryConfig(th, "config/mapping-bad-filter.yaml",
+		"unknown tag filter type 'glob'")
+}
+
+//
+func TestTagFilterMapConfig(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	c, e := tryConfig(th, "config/mapping-filter-map.yaml", "")
+	if e != nil {
+		return
+	}
+
+	m := c.Tasks[0].Mappings[0]
+	th.AssertEquivalentSlices([]string{"semver: >=1.20 <2.0",
+		`regex: ^v[0-9]+\.[0-9]+$`, "latest"}, m.Tags)
+	th.AssertEquivalentSlices([]string{"regex: -rc[0-9]*$"}, m.Exclude)
+
+	list, err := m.tagSet.Expand(func() ([]string, error) {
+		return []string{"1.19.3", "1.20.1", "1.22.0-rc1", "v1.21", "v1.21-rc1",
+			"2.0.0", "latest", "nightly"}, nil
+	})
+	th.AssertNoError(err)
+	th.AssertEquivalentSlices([]string{"1.20.1", "latest", "v1.21"}, list)
+}
+
+//
+func TestEnvConfig(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	env := map[string]string{
+		"DREGSY_TEST_INTERVAL":        "60",
+		"DREGSY_TEST_REGISTRY":        "registry.acme.com",
+		"DREGSY_TEST_AUTH":            "eyJ1c2VybmFtZSI6ICJhIn0K",
+		"DREGSY_TEST_SKIP_TLS_VERIFY": "true",
+		"DREGSY_TEST_PREFIX":          "mirror",
+	}
+	for k, v := range env {
+		th.AssertNoError(os.Setenv(k, v))
+		defer os.Unsetenv(k)
+	}
+
+	c, e := tryConfig(th, "config/env-valid.yaml", "")
+	if e != nil {
+		return
+	}
+	task := c.Tasks[0]
+	th.AssertEqual(60, task.Interval)
+	th.AssertEqual("registry.acme.com", task.Source.Registry)
+	th.AssertEqual("eyJ1c2VybmFtZSI6ICJhIn0K", task.Target.Auth)
+	th.AssertTrue(task.Target.SkipTLSVerify)
+	th.AssertEqual("/mirror/library/busybox", task.Mappings[0].To)
+	th.AssertEqual(`regex: ^1\.${DREGSY_TEST_ESCAPED}$`, task.Mappings[0].Tags[0])
+}
+
+//
+func TestPolicyConfig(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	c, e := tryConfig(th, "config/skopeo-policy.yaml", "")
+	if e != nil {
+		return
+	}
+
+	// inline policies only get rendered by the relay
+	th.AssertEqual("", c.Skopeo.Policy.File)
+	th.AssertEqual("", c.Tasks[1].policyFile())
+
+	relay := skopeo.NewSkopeoRelay(c.Skopeo, nil)
+	defer relay.Dispose()
+	th.AssertNoError(relay.SetupPolicy(c.Skopeo.Policy))
+	th.AssertNoError(relay.SetupPolicy(c.Tasks[1].Policy))
+
+	relayPolicy := c.Skopeo.Policy.File
+	th.AssertNotEqual("", relayPolicy)
+	data, err := ioutil.ReadFile(relayPolicy)
+	th.AssertNoError(err)
+	th.AssertTrue(strings.Contains(string(data), `"insecureAcceptAnything"`))
+
+	th.AssertEqual("", c.Tasks[0].policyFile())
+
+	taskPolicy := c.Tasks[1].policyFile()
+	th.AssertNotEqual("", taskPolicy)
+	th.AssertNotEqual(relayPolicy, taskPolicy)
+	data, err = ioutil.ReadFile(taskPolicy)
+	th.AssertNoError(err)
+	th.AssertTrue(strings.Contains(string(data), `"keyPath": "/etc/pki/acme.gpg"`))
 }
 
 //
@@ -85,3 +235,34 @@ func tryConfig(th *test.TestHelper, file, err string) (*SyncConfig, error) {
 
 	return c, e
 }
+
+//
+func TestOneOff(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	conf := &SyncConfig{Tasks: []*Task{
+		{Name: "a", Interval: 60, schedule: &schedule{}},
+		{Name: "b", Schedule: "0 2 * * *", schedule: &schedule{}},
+		{Name: "c"},
+	}}
+
+	th.AssertError(conf.OneOff([]string{"a", "d"}), "no task named 'd'")
+	th.AssertEqual(3, len(conf.Tasks))
+
+	th.AssertNoError(conf.OneOff([]string{"b", "a", "b"}))
+	th.AssertEqual(2, len(conf.Tasks))
+	th.AssertEqual("b", conf.Tasks[0].Name)
+	th.AssertEqual("a", conf.Tasks[1].Name)
+	for _, task := range conf.Tasks {
+		th.AssertFalse(task.isPeriodic())
+		th.AssertEqual(0, task.Interval)
+		th.AssertEqual("", task.Schedule)
+	}
+
+	conf = &SyncConfig{Tasks: []*Task{
+		{Name: "a", Interval: 60, schedule: &schedule{}}, {Name: "b"}}}
+	th.AssertNoError(conf.OneOff(nil))
+	th.AssertEqual(2, len(conf.Tasks))
+	th.AssertFalse(conf.Tasks[0].isPeriodic())
+}
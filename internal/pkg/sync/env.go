@@ -0,0 +1,128 @@
+/*
+	Copyright 2020 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package sync
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// envRef matches references to environment variables, and escaped references
+var envRef = regexp.MustCompile(`\$\$\{|\$\{([^}]*)\}`)
+
+//
+var envName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// expandEnv replaces references to environment variables of the form ${VAR}
+// in all values of YAML document data. A literal ${ can be written as $${.
+// Referencing an undefined variable is an error. Since this works on the parsed
+// document, comments are left alone, and variables cannot change the structure
+// of the document, even if their values contain YAML syntax.
+func expandEnv(data []byte) ([]byte, error) {
+
+	if !strings.Contains(string(data), "${") {
+		return data, nil
+	}
+
+	var doc interface{}
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+
+	doc, err := expandEnvIn(doc)
+	if err != nil {
+		return nil, err
+	}
+
+	return yaml.Marshal(doc)
+}
+
+//
+func expandEnvIn(node interface{}) (interface{}, error) {
+
+	switch n := node.(type) {
+
+	case map[interface{}]interface{}:
+		for k, v := range n {
+			x, err := expandEnvIn(v)
+			if err != nil {
+				return nil, err
+			}
+			n[k] = x
+		}
+
+	case []interface{}:
+		for ix, v := range n {
+			x, err := expandEnvIn(v)
+			if err != nil {
+				return nil, err
+			}
+			n[ix] = x
+		}
+
+	case string:
+		return expandEnvString(n)
+	}
+
+	return node, nil
+}
+
+// expandEnvString expands all references in s. If s consists of a single
+// reference, and the value is an integer or boolean, that's returned instead of
+// a string, so that variables can also be used for settings such as intervals.
+func expandEnvString(s string) (interface{}, error) {
+
+	var err error
+
+	ret := envRef.ReplaceAllStringFunc(s, func(ref string) string {
+		if ref == "$${" {
+			return "${"
+		}
+		name := ref[2 : len(ref)-1]
+		if !envName.MatchString(name) {
+			if err == nil {
+				err = fmt.Errorf("invalid variable reference '%s'", ref)
+			}
+			return ref
+		}
+		val, ok := os.LookupEnv(name)
+		if !ok && err == nil {
+			err = fmt.Errorf("environment variable '%s' is not set", name)
+		}
+		return val
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	if envRef.FindString(s) == s && s != "$${" {
+		if i, err := strconv.Atoi(ret); err == nil && strconv.Itoa(i) == ret {
+			return i, nil
+		}
+		if ret == "true" || ret == "false" {
+			return ret == "true", nil
+		}
+	}
+
+	return ret, nil
+}
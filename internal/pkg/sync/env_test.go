@@ -0,0 +1,72 @@
+/*
+	Copyright 2020 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package sync
+
+import (
+	"os"
+	"testing"
+
+	"github.com/xelalexv/dregsy/internal/pkg/test"
+)
+
+//
+func TestExpandEnv(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	th.AssertNoError(os.Setenv("DREGSY_TEST_USER", "alex"))
+	defer os.Unsetenv("DREGSY_TEST_USER")
+	th.AssertNoError(os.Setenv("DREGSY_TEST_NUMBER", "0123"))
+	defer os.Unsetenv("DREGSY_TEST_NUMBER")
+	th.AssertNoError(os.Setenv("DREGSY_TEST_YAML", "a: [b"))
+	defer os.Unsetenv("DREGSY_TEST_YAML")
+
+	for _, c := range []struct {
+		in  string
+		out interface{}
+		err string
+	}{
+		{in: "plain", out: "plain"},
+		{in: "$VAR and $", out: "$VAR and $"},
+		{in: "${DREGSY_TEST_USER}", out: "alex"},
+		{in: "user ${DREGSY_TEST_USER}!", out: "user alex!"},
+		{in: "$${DREGSY_TEST_USER}", out: "${DREGSY_TEST_USER}"},
+		{in: "$${", out: "${"},
+		{in: "${DREGSY_TEST_NUMBER}", out: "0123"},
+		{in: "${DREGSY_TEST_YAML}", out: "a: [b"},
+		{in: "${DREGSY_TEST_UNDEFINED}",
+			err: "environment variable 'DREGSY_TEST_UNDEFINED' is not set"},
+		{in: "${not valid}", err: "invalid variable reference '${not valid}'"},
+	} {
+		out, err := expandEnvString(c.in)
+		if c.err != "" {
+			th.AssertError(err, c.err)
+		} else {
+			th.AssertNoError(err)
+			th.AssertEqual(c.out, out)
+		}
+	}
+
+	th.AssertNoError(os.Setenv("DREGSY_TEST_NUMBER", "60"))
+	out, err := expandEnvString("${DREGSY_TEST_NUMBER}")
+	th.AssertNoError(err)
+	th.AssertEqual(60, out)
+
+	out, err = expandEnvString("${DREGSY_TEST_NUMBER}s")
+	th.AssertNoError(err)
+	th.AssertEqual("60s", out)
+}
@@ -0,0 +1,184 @@
+/*
+	Copyright 2020 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package sync
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	gosync "sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+//
+const defaultStallTimeout = time.Hour
+const heartbeatInterval = 10 * time.Second
+
+//
+type HealthConfig struct {
+	StallTimeout *time.Duration `yaml:"stall-timeout"`
+}
+
+//
+func (c *HealthConfig) validate() error {
+	if c.StallTimeout != nil && *c.StallTimeout <= 0 {
+		return fmt.Errorf("stall-timeout needs to be a positive duration")
+	}
+	return nil
+}
+
+// health tracks readiness & liveness of dregsy. It's ready once the relay has
+// been prepared successfully. It's alive as long as the scheduler loop keeps
+// making progress, and no task exceeds its maximum age since last success.
+type health struct {
+	mutex        gosync.Mutex
+	ready        bool
+	heartbeat    time.Time
+	stallTimeout time.Duration
+	tasks        map[string]*watchedTask // by name
+}
+
+// watchedTask is a task whose age is tracked
+type watchedTask struct {
+	task        *Task
+	lastSuccess time.Time
+}
+
+//
+func newHealth(conf *HealthConfig) *health {
+	h := &health{
+		heartbeat:    time.Now(),
+		stallTimeout: defaultStallTimeout,
+		tasks:        make(map[string]*watchedTask),
+	}
+	if conf != nil && conf.StallTimeout != nil {
+		h.stallTimeout = *conf.StallTimeout
+	}
+	return h
+}
+
+//
+func (h *health) setReady(r bool) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.ready = r
+}
+
+// beat signals that the scheduler loop is making progress
+func (h *health) beat() {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.heartbeat = time.Now()
+}
+
+// watch starts tracking the age of task t, beginning with its recorded last
+// success, or now if there is none
+func (h *health) watch(t *Task) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	last := t.state.LastSuccess
+	if last.IsZero() {
+		last = time.Now()
+	}
+	h.tasks[t.Name] = &watchedTask{task: t, lastSuccess: last}
+}
+
+// unwatch stops tracking the age of task t
+func (h *health) unwatch(t *Task) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if w, ok := h.tasks[t.Name]; ok && w.task == t {
+		delete(h.tasks, t.Name)
+	}
+}
+
+// succeeded records a successful run of task t; tasks are tracked by name, so
+// that a run of a task that got replaced by a config reload in the meantime
+// still counts
+func (h *health) succeeded(t *Task) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if w, ok := h.tasks[t.Name]; ok {
+		w.lastSuccess = time.Now()
+	}
+}
+
+//
+func (h *health) checkReady() error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if !h.ready {
+		return fmt.Errorf("relay not prepared")
+	}
+	return nil
+}
+
+//
+func (h *health) checkAlive() error {
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	var problems []string
+
+	if since := time.Since(h.heartbeat); since > h.stallTimeout {
+		problems = append(problems, fmt.Sprintf(
+			"scheduler stalled, no progress for %s", since.Round(time.Second)))
+	}
+
+	for _, w := range h.tasks {
+		if w.task.MaxAge == nil {
+			continue
+		}
+		if age := time.Since(w.lastSuccess); age > *w.task.MaxAge {
+			problems = append(problems, fmt.Sprintf(
+				"task '%s' exceeded max-age, last success %s ago",
+				w.task.Name, age.Round(time.Second)))
+		}
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("%s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+//
+func (h *health) readyHandler() http.Handler {
+	return healthHandler(h.checkReady)
+}
+
+//
+func (h *health) liveHandler() http.Handler {
+	return healthHandler(h.checkAlive)
+}
+
+//
+func healthHandler(check func() error) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		if err := check(); err != nil {
+			log.WithField("path", r.URL.Path).Warnf("health check failed: %v", err)
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprintln(w, err)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	})
+}
@@ -0,0 +1,85 @@
+/*
+	Copyright 2020 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package sync
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/xelalexv/dregsy/internal/pkg/state"
+	"github.com/xelalexv/dregsy/internal/pkg/test"
+)
+
+//
+func TestHealthReady(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+	h := newHealth(nil)
+
+	code, body := probe(h.readyHandler())
+	th.AssertEqual(http.StatusServiceUnavailable, code)
+	th.AssertTrue(strings.Contains(body, "relay not prepared"))
+
+	h.setReady(true)
+	code, _ = probe(h.readyHandler())
+	th.AssertEqual(http.StatusOK, code)
+}
+
+//
+func TestHealthAlive(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	stall := time.Minute
+	h := newHealth(&HealthConfig{StallTimeout: &stall})
+
+	maxAge := time.Hour
+	task := &Task{Name: "test", MaxAge: &maxAge, state: state.NewTaskState()}
+	task.state.LastSuccess = time.Now().Add(-30 * time.Minute)
+	h.watch(task)
+	h.watch(&Task{Name: "no-max-age", state: state.NewTaskState()})
+
+	code, _ := probe(h.liveHandler())
+	th.AssertEqual(http.StatusOK, code)
+
+	// scheduler stalled
+	h.heartbeat = time.Now().Add(-2 * time.Minute)
+	code, body := probe(h.liveHandler())
+	th.AssertEqual(http.StatusServiceUnavailable, code)
+	th.AssertTrue(strings.Contains(body, "scheduler stalled"))
+	h.beat()
+
+	// task too old
+	h.tasks[task.Name].lastSuccess = time.Now().Add(-2 * time.Hour)
+	code, body = probe(h.liveHandler())
+	th.AssertEqual(http.StatusServiceUnavailable, code)
+	th.AssertTrue(strings.Contains(body, "task 'test' exceeded max-age"))
+
+	h.succeeded(task)
+	code, _ = probe(h.liveHandler())
+	th.AssertEqual(http.StatusOK, code)
+}
+
+//
+func probe(h http.Handler) (int, string) {
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	return rec.Code, rec.Body.String()
+}
@@ -17,11 +17,21 @@
 package sync
 
 import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"io/ioutil"
+	"strings"
 	"time"
 
 	log "github.com/sirupsen/logrus"
+
+	"github.com/xelalexv/dregsy/internal/pkg/auth"
+	"github.com/xelalexv/dregsy/internal/pkg/metrics"
+	"github.com/xelalexv/dregsy/internal/pkg/redact"
+	"github.com/xelalexv/dregsy/internal/pkg/retry"
 )
 
 //
@@ -33,10 +43,18 @@ type authRefresher interface {
 type Location struct {
 	Registry      string         `yaml:"registry"`
 	Auth          string         `yaml:"auth"`
+	AuthConfig    string         `yaml:"auth-config"`
+	AuthFile      string         `yaml:"auth-file"`
+	Username      string         `yaml:"username"`
+	Password      string         `yaml:"password"`
+	PasswordFile  string         `yaml:"password-file"`
+	Token         string         `yaml:"token"`
 	SkipTLSVerify bool           `yaml:"skip-tls-verify"`
 	AuthRefresh   *time.Duration `yaml:"auth-refresh"`
+	Retry         *retry.Policy  `yaml:"retry"`
 	//
-	refresher authRefresher
+	refresher   authRefresher
+	derivedAuth bool // Auth was set from the other credential settings
 }
 
 //
@@ -50,6 +68,16 @@ func (l *Location) validate() error {
 		return errors.New("registry not set")
 	}
 
+	if l.Retry != nil {
+		if err := l.Retry.Validate(); err != nil {
+			return err
+		}
+	}
+
+	if err := l.validateCredentials(); err != nil {
+		return err
+	}
+
 	var interval time.Duration
 
 	if l.AuthRefresh != nil {
@@ -63,6 +91,10 @@ func (l *Location) validate() error {
 	}
 
 	if l.IsECR() {
+		if interval > 0 && l.hasCredentialSettings() {
+			return errors.New("auth-refresh cannot be combined with " +
+				"auth-config, auth-file, username, or token")
+		}
 		l.refresher = newECRAuthRefresher(l, interval)
 	} else if interval > 0 {
 		return fmt.Errorf(
@@ -70,7 +102,7 @@ func (l *Location) validate() error {
 			l.Registry)
 	}
 
-	if l.IsGCR() && l.Auth != "none" {
+	if l.IsGCR() && l.Auth != "none" && !l.hasCredentialSettings() {
 		l.refresher = newGCRAuthRefresher(l)
 	}
 
@@ -78,13 +110,238 @@ func (l *Location) validate() error {
 		l.Auth = ""
 	}
 
+	l.registerSecrets()
+
 	return nil
 }
 
+// validateCredentials checks that at most one way of passing credentials is
+// used, and that the credentials are well-formed. Unless given via auth, the
+// credentials are encoded into Auth, the form in which relays expect them.
+func (l *Location) validateCredentials() error {
+
+	if l.Password != "" && l.PasswordFile != "" {
+		return errors.New("password cannot be combined with password-file")
+	}
+
+	if l.Username != "" && l.Password == "" && l.PasswordFile == "" {
+		return errors.New("username requires password or password-file")
+	}
+
+	if l.Username == "" && (l.Password != "" || l.PasswordFile != "") {
+		return errors.New("password and password-file require username")
+	}
+
+	settings := 0
+	for _, s := range []string{l.AuthConfig, l.AuthFile, l.Username, l.Token} {
+		if s != "" {
+			settings++
+		}
+	}
+	if l.Auth != "" && !l.derivedAuth {
+		settings++
+	}
+	if settings > 1 {
+		return errors.New("only one of auth, auth-config, auth-file, " +
+			"username, or token can be set")
+	}
+
+	switch {
+
+	case l.hasAuthFiles():
+		return l.readAuthFiles()
+
+	case l.Username != "":
+		l.setDerivedAuth(&auth.Credentials{
+			Username: l.Username, Password: l.Password})
+
+	case l.Token != "":
+		l.setDerivedAuth(&auth.Credentials{Token: l.Token})
+
+	case l.Auth != "" && l.Auth != "none":
+		if _, err := auth.Decode(l.Auth); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// hasCredentialSettings determines whether credentials are given by any other
+// means than auth
+func (l *Location) hasCredentialSettings() bool {
+	return l.AuthConfig != "" || l.AuthFile != "" || l.Username != "" ||
+		l.Token != ""
+}
+
+// hasToken determines whether the credentials of this location are a bearer
+// token, either set directly or obtained from a file or credential helper
+func (l *Location) hasToken() bool {
+	if l.Auth == "" || l.Auth == "none" {
+		return false
+	}
+	creds, err := auth.Decode(l.Auth)
+	return err == nil && creds.Token != ""
+}
+
 //
+func (l *Location) setDerivedAuth(creds *auth.Credentials) {
+	l.Auth = creds.Encode()
+	l.derivedAuth = true
+	l.registerSecrets()
+}
+
+// registerSecrets makes sure the credentials of this location, in any of the
+// forms in which they get passed around, never show up in log output
+func (l *Location) registerSecrets() {
+
+	redact.Register(l.Password, l.Token)
+
+	if creds, err := auth.Decode(l.Auth); err == nil && creds != nil {
+		redact.Register(l.Auth, creds.Password, creds.Token)
+		if creds.Password != "" {
+			redact.Register(base64.StdEncoding.EncodeToString(
+				[]byte(creds.Username + ":" + creds.Password)))
+		}
+	}
+}
+
+// String returns a description of this location, with credentials masked
+func (l Location) String() string {
+
+	m := l.masked()
+	parts := []string{"registry: " + m.Registry}
+
+	for _, s := range []struct{ key, val string }{
+		{"auth", m.Auth},
+		{"auth-config", m.AuthConfig},
+		{"auth-file", m.AuthFile},
+		{"username", m.Username},
+		{"password", m.Password},
+		{"password-file", m.PasswordFile},
+		{"token", m.Token},
+	} {
+		if s.val != "" {
+			parts = append(parts, s.key+": "+s.val)
+		}
+	}
+
+	if m.SkipTLSVerify {
+		parts = append(parts, "skip-tls-verify: true")
+	}
+	if m.AuthRefresh != nil {
+		parts = append(parts, "auth-refresh: "+m.AuthRefresh.String())
+	}
+
+	return "{" + strings.Join(parts, ", ") + "}"
+}
+
+// credentialsFingerprint returns a hash of the credentials that get masked when
+// marshaling this location, for detecting changes to them
+func (l *Location) credentialsFingerprint() string {
+	if l == nil {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(
+		strings.Join([]string{l.Auth, l.Password, l.Token}, "\x00")))
+	return hex.EncodeToString(sum[:])
+}
+
+// location has the same fields as Location, but no MarshalYAML
+type location Location
+
+// MarshalYAML marshals this location with credentials masked
+func (l Location) MarshalYAML() (interface{}, error) {
+	m := l.masked()
+	return (*location)(&m), nil
+}
+
+// masked returns a copy of this location with credentials replaced by a mask
+func (l Location) masked() Location {
+	for _, s := range []*string{&l.Auth, &l.Password, &l.Token} {
+		if *s != "" {
+			*s = redact.Mask
+		}
+	}
+	return l
+}
+
+//
+func (l *Location) hasAuthFiles() bool {
+	return l.AuthConfig != "" || l.AuthFile != "" || l.PasswordFile != ""
+}
+
+// readAuthFiles sets the credentials of this location from its Docker config,
+// its auth file, or its username and password file. The files are read again
+// each time this is called, so that changes, e.g. to a mounted Kubernetes
+// secret, are picked up. Credential helpers configured in the Docker config
+// are run each time as well, so they can take care of refreshing credentials.
+func (l *Location) readAuthFiles() error {
+
+	var creds *auth.Credentials
+
+	if l.AuthConfig != "" {
+		var err error
+		if creds, err = auth.FromDockerConfig(
+			l.AuthConfig, l.Registry); err != nil {
+			return err
+		}
+		if creds == nil {
+			return fmt.Errorf("no credentials for registry in Docker config '%s'",
+				l.AuthConfig)
+		}
+
+	} else if l.AuthFile != "" {
+		data, err := ioutil.ReadFile(l.AuthFile)
+		if err != nil {
+			return fmt.Errorf("cannot read auth file: %v", err)
+		}
+		if creds, err = auth.Decode(
+			strings.TrimSpace(string(data))); err != nil {
+			return fmt.Errorf("auth file '%s': %v", l.AuthFile, err)
+		}
+		if creds == nil {
+			return fmt.Errorf("auth file '%s' is empty", l.AuthFile)
+		}
+
+	} else {
+		data, err := ioutil.ReadFile(l.PasswordFile)
+		if err != nil {
+			return fmt.Errorf("cannot read password file: %v", err)
+		}
+		creds = &auth.Credentials{Username: l.Username,
+			Password: strings.TrimRight(string(data), "\r\n")}
+	}
+
+	prev := l.Auth
+	l.setDerivedAuth(creds)
+	if prev != "" && prev != l.Auth {
+		log.WithField("registry", l.Registry).Info(
+			"credentials changed, using new ones")
+	}
+
+	return nil
+}
+
+// RefreshAuth updates the credentials of this location, if they are read from
+// files, or are retrieved from ECR or GCR
 func (l *Location) RefreshAuth() error {
-	if l.refresher == nil {
+
+	var err error
+
+	switch {
+	case l.hasAuthFiles():
+		if err = l.readAuthFiles(); err != nil {
+			err = fmt.Errorf("registry '%s': %v", l.Registry, err)
+		}
+	case l.refresher != nil:
+		err = l.refresher.refresh()
+	default:
 		return nil
 	}
-	return l.refresher.refresh()
+
+	if err != nil {
+		metrics.AuthRefreshFailed(l.Registry)
+	}
+	return err
 }
@@ -26,6 +26,8 @@ import (
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/ecr"
 	log "github.com/sirupsen/logrus"
+
+	"github.com/xelalexv/dregsy/internal/pkg/auth"
 )
 
 //
@@ -104,8 +106,9 @@ func (rf *ecrAuthRefresher) refresh() error {
 		user := strings.TrimSpace(split[0])
 		pass := strings.TrimSpace(split[1])
 
-		rf.loc.Auth = base64.StdEncoding.EncodeToString([]byte(
-			fmt.Sprintf(`{"username": "%s", "password": "%s"}`, user, pass)))
+		rf.loc.Auth = (&auth.Credentials{
+			Username: user, Password: pass}).Encode()
+		rf.loc.registerSecrets()
 		rf.expiry = time.Now().Add(rf.interval)
 
 		return nil
@@ -17,7 +17,6 @@
 package sync
 
 import (
-	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
@@ -30,6 +29,8 @@ import (
 	"golang.org/x/oauth2/google"
 
 	log "github.com/sirupsen/logrus"
+
+	"github.com/xelalexv/dregsy/internal/pkg/auth"
 )
 
 //
@@ -82,8 +83,9 @@ func (rf *gcrAuthRefresher) refresh() error {
 		return fmt.Errorf("no auth token received")
 	}
 
-	rf.loc.Auth = base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf(
-		`{"username": "oauth2accesstoken", "password": "%s"}`, authToken)))
+	rf.loc.Auth = (&auth.Credentials{
+		Username: "oauth2accesstoken", Password: authToken}).Encode()
+	rf.loc.registerSecrets()
 	rf.expiry = expiry
 
 	return nil
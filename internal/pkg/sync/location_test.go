@@ -0,0 +1,194 @@
+/*
+	Copyright 2020 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package sync
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/xelalexv/dregsy/internal/pkg/auth"
+	"github.com/xelalexv/dregsy/internal/pkg/redact"
+	"github.com/xelalexv/dregsy/internal/pkg/test"
+)
+
+//
+const onlyOne = "only one of auth, auth-config, auth-file, username, or token"
+
+//
+func TestCredentials(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	// {"username": "anonymous", "password": "anonymous"}
+	anonymous := "eyJ1c2VybmFtZSI6ICJhbm9ueW1vdXMiLCAicGFzc3dvcmQiOiAiYW5vbnltb3VzIn0K"
+
+	l := &Location{Registry: "registry.acme.com", Auth: anonymous}
+	th.AssertNoError(l.validate())
+	th.AssertEqual(anonymous, l.Auth)
+
+	l = &Location{Registry: "registry.acme.com", Username: "alex",
+		Password: "s3cr\"t"}
+	th.AssertNoError(l.validate())
+	th.AssertEqual((&auth.Credentials{
+		Username: "alex", Password: "s3cr\"t"}).Encode(), l.Auth)
+	th.AssertNoError(l.validate())
+
+	l = &Location{Registry: "registry.acme.com", Token: "t0ken"}
+	th.AssertNoError(l.validate())
+	th.AssertEqual((&auth.Credentials{Token: "t0ken"}).Encode(), l.Auth)
+
+	hour := time.Hour
+	for _, c := range []struct {
+		loc *Location
+		err string
+	}{
+		{&Location{Auth: "not base64"}, "invalid auth, not base64 encoded"},
+		{&Location{Auth: "YWxleDpzZWNyZXQ="}, "invalid auth, not JSON"},
+		{&Location{Username: "alex"},
+			"username requires password or password-file"},
+		{&Location{Password: "secret"},
+			"password and password-file require username"},
+		{&Location{Username: "alex", Password: "secret", PasswordFile: "pw"},
+			"password cannot be combined with password-file"},
+		{&Location{Username: "alex", Password: "secret", Token: "t0ken"},
+			onlyOne},
+		{&Location{Auth: anonymous, Token: "t0ken"},
+			onlyOne},
+		{&Location{Registry: "123456789012.dkr.ecr.eu-central-1.amazonaws.com",
+			Token: "t0ken", AuthRefresh: &hour},
+			"auth-refresh cannot be combined with auth-config"},
+	} {
+		if c.loc.Registry == "" {
+			c.loc.Registry = "registry.acme.com"
+		}
+		th.AssertError(c.loc.validate(), c.err)
+	}
+}
+
+//
+func TestAuthFiles(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	dir, err := ioutil.TempDir("", "dregsy-auth-")
+	th.AssertNoError(err)
+	defer os.RemoveAll(dir)
+
+	authFile := filepath.Join(dir, "auth")
+	passwordFile := filepath.Join(dir, "password")
+	creds := &auth.Credentials{Username: "alex", Password: "secret"}
+	th.AssertNoError(ioutil.WriteFile(authFile, []byte(creds.Encode()+"\n"), 0600))
+	th.AssertNoError(ioutil.WriteFile(passwordFile, []byte("s3cr\"t\n"), 0600))
+
+	// auth file contains encoded credentials
+	l := &Location{Registry: "registry.acme.com", AuthFile: authFile}
+	th.AssertNoError(l.validate())
+	th.AssertEqual(creds.Encode(), l.Auth)
+	th.AssertNoError(l.validate())
+
+	// password file is combined with username, and re-read on refresh
+	l = &Location{Registry: "registry.acme.com", Username: "alex",
+		PasswordFile: passwordFile}
+	th.AssertNoError(l.validate())
+	th.AssertEqual((&auth.Credentials{
+		Username: "alex", Password: "s3cr\"t"}).Encode(), l.Auth)
+
+	th.AssertNoError(ioutil.WriteFile(passwordFile, []byte("changed"), 0600))
+	th.AssertNoError(l.RefreshAuth())
+	th.AssertEqual(
+		(&auth.Credentials{Username: "alex", Password: "changed"}).Encode(), l.Auth)
+
+	th.AssertNoError(os.Remove(passwordFile))
+	th.AssertError(l.RefreshAuth(),
+		"registry 'registry.acme.com': cannot read password file")
+
+	// invalid combinations & contents
+	th.AssertError((&Location{Registry: "registry.acme.com", AuthFile: authFile,
+		Auth: "none"}).validate(),
+		onlyOne)
+	th.AssertError((&Location{Registry: "registry.acme.com", AuthFile: authFile,
+		Username: "alex", PasswordFile: passwordFile}).validate(),
+		onlyOne)
+	th.AssertError((&Location{Registry: "registry.acme.com",
+		AuthFile: filepath.Join(dir, "missing")}).validate(),
+		"cannot read auth file")
+
+	// Docker config, alex:secret
+	dockerConfig := filepath.Join(dir, "config.json")
+	th.AssertNoError(ioutil.WriteFile(dockerConfig, []byte(
+		`{"auths": {"registry.acme.com": {"auth": "YWxleDpzZWNyZXQ="}}}`), 0600))
+	l = &Location{Registry: "registry.acme.com", AuthConfig: dockerConfig}
+	th.AssertNoError(l.validate())
+	th.AssertEqual(creds.Encode(), l.Auth)
+	th.AssertError((&Location{Registry: "other.acme.com",
+		AuthConfig: dockerConfig}).validate(),
+		"no credentials for registry in Docker config")
+
+	th.AssertNoError(ioutil.WriteFile(authFile, []byte("alex:secret"), 0600))
+	th.AssertError((&Location{Registry: "registry.acme.com",
+		AuthFile: authFile}).validate(), "invalid auth, not base64 encoded")
+}
+
+//
+func TestLocationMasked(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	l := &Location{Registry: "registry.acme.com", Username: "alex",
+		Password: "hush-hush"}
+	th.AssertNoError(l.validate())
+
+	th.AssertEqual("{registry: registry.acme.com, auth: ***, username: alex, "+
+		"password: ***}", l.String())
+	th.AssertEqual("alex:***", redact.String("alex:hush-hush"))
+	th.AssertEqual("***", redact.String(l.Auth))
+
+	data, err := yaml.Marshal(struct{ Source *Location }{l})
+	th.AssertNoError(err)
+	th.AssertFalse(strings.Contains(string(data), "hush-hush"))
+	th.AssertFalse(strings.Contains(string(data), l.Auth))
+	th.AssertTrue(strings.Contains(string(data), "password: '***'"))
+	th.AssertTrue(strings.Contains(string(data), "username: alex"))
+
+	// masking works on a copy
+	th.AssertEqual("hush-hush", l.Password)
+}
+
+//
+func TestCredentialsFingerprint(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	task := func(password string) *Task {
+		return &Task{Name: "task", Source: &Location{Registry: "source.io",
+			Username: "alex", Password: password},
+			Target: &Location{Registry: "target.io"}}
+	}
+
+	c := &SyncConfig{Tasks: []*Task{task("one-password"), task("one-password"),
+		task("another-password")}}
+	th.AssertNoError(c.takeFingerprints())
+
+	th.AssertEqual(c.Tasks[0].fingerprint, c.Tasks[1].fingerprint)
+	th.AssertNotEqual(c.Tasks[0].fingerprint, c.Tasks[2].fingerprint)
+}
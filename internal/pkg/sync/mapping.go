@@ -18,13 +18,32 @@ package sync
 
 import (
 	"errors"
+	"fmt"
+	"regexp"
+
+	"github.com/xelalexv/dregsy/internal/pkg/tags"
+	"github.com/xelalexv/dregsy/internal/pkg/verify"
 )
 
 //
 type Mapping struct {
-	From string   `yaml:"from"`
-	To   string   `yaml:"to"`
-	Tags []string `yaml:"tags"`
+	From    string       `yaml:"from"`
+	To      string       `yaml:"to"`
+	Tags    tags.Filters `yaml:"tags"`
+	Exclude tags.Filters `yaml:"exclude"`
+	//
+	KeepLatest   int    `yaml:"keep-latest"`
+	KeepLatestBy string `yaml:"keep-latest-by"`
+	//
+	Prune        bool     `yaml:"prune"`
+	PruneDryRun  bool     `yaml:"prune-dry-run"`
+	PruneProtect []string `yaml:"prune-protect"`
+	//
+	Verify        *verify.Config `yaml:"verify"`
+	CopyReferrers *bool          `yaml:"copy-referrers"`
+	//
+	tagSet  *tags.TagSet
+	protect []*regexp.Regexp
 }
 
 //
@@ -42,5 +61,46 @@ func (m *Mapping) validate() error {
 		m.To = m.From
 	}
 
+	ts, err := tags.NewTagSet(m.Tags, m.Exclude)
+	if err != nil {
+		return fmt.Errorf("invalid tags: %v", err)
+	}
+	m.tagSet = ts
+
+	if err := tags.ValidateKeepLatest(m.KeepLatest, m.KeepLatestBy); err != nil {
+		return err
+	}
+
+	m.protect = nil
+	for _, p := range m.PruneProtect {
+		re, err := regexp.Compile(p)
+		if err != nil {
+			return fmt.Errorf("invalid prune-protect expression '%s': %v", p, err)
+		}
+		m.protect = append(m.protect, re)
+	}
+
+	if m.Verify != nil {
+		if err := m.Verify.Validate(); err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
+
+// isProtected determines whether tag matches any of the prune-protect
+// expressions of this mapping
+func (m *Mapping) isProtected(tag string) bool {
+	for _, re := range m.protect {
+		if re.MatchString(tag) {
+			return true
+		}
+	}
+	return false
+}
+
+// key identifies this mapping within its task
+func (m *Mapping) key() string {
+	return fmt.Sprintf("%s -> %s", m.From, m.To)
+}
@@ -0,0 +1,255 @@
+/*
+	Copyright 2020 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package sync
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+
+	"github.com/xelalexv/dregsy/internal/pkg/watch"
+)
+
+// loadMappings reads and validates the mappings in the mapping file of the
+// task. If that's a directory, the mappings in all YAML files directly inside
+// of it are merged, in lexical order of file names. The task itself is not
+// changed.
+func (t *Task) loadMappings() ([]*Mapping, error) {
+
+	path := *t.MappingFile
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("issue with mapping file '%s': %v", path, err)
+	}
+
+	files := []string{path}
+	if fi.IsDir() {
+		if files, err = mappingFilesInDir(path); err != nil {
+			return nil, err
+		}
+	}
+
+	var ret []*Mapping
+	defined := make(map[string]string) // mapping key -> file
+
+	for _, f := range files {
+
+		mappings, err := readMappingFile(f)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, m := range mappings {
+			if prev, ok := defined[m.key()]; ok {
+				return nil, fmt.Errorf(
+					"mapping '%s' in file '%s' already defined in file '%s'",
+					m.key(), f, prev)
+			}
+			defined[m.key()] = f
+		}
+		ret = append(ret, mappings...)
+	}
+
+	return ret, nil
+}
+
+// mappingFilesInDir lists the YAML files directly inside of dir, sorted by
+// name. Hidden files are skipped, such as the '..data' entries Kubernetes
+// creates when mounting config maps.
+func mappingFilesInDir(dir string) ([]string, error) {
+
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("issue with mapping dir '%s': %v", dir, err)
+	}
+
+	var ret []string
+	for _, e := range entries {
+		name := e.Name()
+		ext := filepath.Ext(name)
+		if strings.HasPrefix(name, ".") || (ext != ".yaml" && ext != ".yml") {
+			continue
+		}
+		file := filepath.Join(dir, name)
+		// config map entries are symlinks, so stat the file they point to
+		if fi, err := os.Stat(file); err != nil || !fi.Mode().IsRegular() {
+			continue
+		}
+		ret = append(ret, file)
+	}
+
+	sort.Strings(ret)
+	return ret, nil
+}
+
+//
+func readMappingFile(file string) ([]*Mapping, error) {
+
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("issue with mapping file '%s': %v", file, err)
+	}
+
+	maplist := &MappingList{}
+	if err = yaml.Unmarshal(data, maplist); err != nil {
+		return nil, fmt.Errorf(
+			"error parsing mappings config file '%s': %v", file, err)
+	}
+
+	for _, m := range maplist.Mappings {
+		if m == nil {
+			return nil, fmt.Errorf("empty mapping in file '%s'", file)
+		}
+	}
+
+	if err := validateMappings(maplist.Mappings); err != nil {
+		return nil, fmt.Errorf("%v, in file '%s'", err, file)
+	}
+
+	return maplist.Mappings, nil
+}
+
+// refreshMapping reloads the mappings from the mapping file of the task. If
+// they are invalid, the current mappings are kept, and an error is returned.
+func (t *Task) refreshMapping() error {
+
+	mappings, err := t.loadMappings()
+	if err != nil {
+		return fmt.Errorf("keeping current mappings of task '%s': %v",
+			t.Name, err)
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	logMappingChanges(log.WithField("task", t.Name), t.Mappings, mappings)
+	t.Mappings = mappings
+
+	return nil
+}
+
+// currentMappings returns the mappings of the task; they may get replaced at
+// any time when read from a mapping file, so use this instead of Mappings
+// while syncing
+func (t *Task) currentMappings() []*Mapping {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.Mappings
+}
+
+// logMappingChanges logs which mappings were added, changed, and removed when
+// going from mappings before to after
+func logMappingChanges(logger *log.Entry, before, after []*Mapping) {
+
+	old := make(map[string]string, len(before))
+	for _, m := range before {
+		old[m.key()] = mappingFingerprint(m)
+	}
+
+	changes := 0
+	for _, m := range after {
+		fields := log.Fields{"from": m.From, "to": m.To}
+		fp, ok := old[m.key()]
+		delete(old, m.key())
+		switch {
+		case !ok:
+			logger.WithFields(fields).Info("mapping added")
+		case fp != mappingFingerprint(m):
+			logger.WithFields(fields).Info("mapping changed")
+		default:
+			continue
+		}
+		changes++
+	}
+
+	for _, m := range before {
+		if _, ok := old[m.key()]; ok {
+			logger.WithFields(log.Fields{"from": m.From, "to": m.To}).Info(
+				"mapping removed")
+			changes++
+		}
+	}
+
+	if changes == 0 {
+		logger.Debug("mappings unchanged")
+	}
+}
+
+//
+func mappingFingerprint(m *Mapping) string {
+	data, _ := yaml.Marshal(m)
+	return string(data)
+}
+
+// watchMappings starts watching the mapping file of the task, if it has one,
+// and refreshes the mappings whenever it changes. If the file can't be
+// watched, it's read before every run instead.
+func (t *Task) watchMappings() {
+
+	if t.MappingFile == nil {
+		return
+	}
+
+	logger := log.WithFields(log.Fields{"task": t.Name, "file": *t.MappingFile})
+
+	w, err := watch.New(*t.MappingFile)
+	if err != nil {
+		logger.Warnf(
+			"cannot watch mapping file, reading it before every run: %v", err)
+		return
+	}
+
+	t.mutex.Lock()
+	t.watcher = w
+	t.mutex.Unlock()
+
+	logger.Debug("watching mapping file")
+
+	go func() {
+		for range w.Changes() {
+			logger.Info("mapping file changed, refreshing mappings")
+			if err := t.refreshMapping(); err != nil {
+				logger.Error(err)
+			}
+		}
+	}()
+}
+
+// stopWatchingMappings stops watching the mapping file of the task
+func (t *Task) stopWatchingMappings() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.watcher != nil {
+		t.watcher.Close()
+		t.watcher = nil
+	}
+}
+
+// isWatchingMappings determines whether the mapping file of the task is
+// watched for changes
+func (t *Task) isWatchingMappings() bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.watcher != nil
+}
@@ -0,0 +1,121 @@
+/*
+	Copyright 2020 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package sync
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/xelalexv/dregsy/internal/pkg/test"
+	"github.com/xelalexv/dregsy/internal/pkg/watch"
+)
+
+//
+func TestMappingDir(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	dir, err := ioutil.TempDir("", "dregsy-mappings-")
+	th.AssertNoError(err)
+	defer os.RemoveAll(dir)
+
+	writeMappings(th, dir, "b.yml", "- from: library/busybox\n")
+	writeMappings(th, dir, "a.yaml", "- from: library/alpine\n  to: alpine\n")
+	writeMappings(th, dir, ".hidden.yaml", "- from: library/hidden\n")
+	writeMappings(th, dir, "notes.txt", "- from: library/notes\n")
+
+	task := newMappingFileTask(dir)
+	th.AssertNoError(task.validate())
+	th.AssertEqual(2, len(task.Mappings))
+	th.AssertEqual("/library/alpine", task.Mappings[0].From)
+	th.AssertEqual("/alpine", task.Mappings[0].To)
+	th.AssertEqual("/library/busybox", task.Mappings[1].From)
+
+	writeMappings(th, dir, "c.yaml", "- from: library/busybox\n")
+	_, err = task.loadMappings()
+	th.AssertError(err, "mapping '/library/busybox -> /library/busybox' in file")
+	th.AssertError(err, "already defined in file")
+}
+
+//
+func TestMappingFileRefresh(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	dir, err := ioutil.TempDir("", "dregsy-mappings-")
+	th.AssertNoError(err)
+	defer os.RemoveAll(dir)
+
+	file := writeMappings(th, dir, "mappings.yaml", "- from: library/busybox\n")
+	task := newMappingFileTask(file)
+	th.AssertNoError(task.validate())
+	th.AssertEqual(1, len(task.currentMappings()))
+
+	// invalid mappings are rejected, and the last good ones kept
+	writeMappings(th, dir, "mappings.yaml", "- to: library/busybox\n")
+	th.AssertError(task.refreshMapping(), "mapping without 'From' path")
+	th.AssertEqual(1, len(task.currentMappings()))
+	th.AssertEqual("/library/busybox", task.currentMappings()[0].From)
+
+	writeMappings(th, dir, "mappings.yaml", "mappings: [")
+	th.AssertError(task.refreshMapping(), "error parsing mappings config file")
+	th.AssertEqual(1, len(task.currentMappings()))
+
+	// changes are picked up when watching
+	settle := watch.Settle
+	watch.Settle = 50 * time.Millisecond
+	defer func() { watch.Settle = settle }()
+
+	task.watchMappings()
+	th.AssertTrue(task.isWatchingMappings())
+
+	writeMappings(th, dir, "mappings.yaml",
+		"- from: library/busybox\n- from: library/alpine\n")
+	for deadline := time.Now().Add(5 * time.Second); len(
+		task.currentMappings()) != 2 && time.Now().Before(deadline); {
+		time.Sleep(20 * time.Millisecond)
+	}
+	th.AssertEqual(2, len(task.currentMappings()))
+	th.AssertEqual("/library/alpine", task.currentMappings()[1].From)
+
+	task.stopWatchingMappings()
+	th.AssertFalse(task.isWatchingMappings())
+}
+
+// writeMappings writes a mapping file with the given list of mappings to dir,
+// and returns its path
+func writeMappings(th *test.TestHelper, dir, name, mappings string) string {
+	file := filepath.Join(dir, name)
+	if mappings != "" && mappings[0] == '-' {
+		mappings = "mappings:\n" + mappings
+	}
+	th.AssertNoError(ioutil.WriteFile(file, []byte(mappings), 0644))
+	return file
+}
+
+//
+func newMappingFileTask(file string) *Task {
+	return &Task{
+		Name:        "test",
+		Source:      &Location{Registry: "registry.acme.com"},
+		Target:      &Location{Registry: "localhost:5000"},
+		MappingFile: &file,
+	}
+}
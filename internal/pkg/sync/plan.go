@@ -0,0 +1,175 @@
+/*
+	Copyright 2020 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package sync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// actions in a plan
+const (
+	planCopy          = "copy"
+	planSkipUnchanged = "skip-unchanged"
+	planPrune         = "would-prune"
+	planCreateRepo    = "would-create-repo"
+)
+
+// Plan determines for all tasks in conf what a sync would do, and writes this
+// as a plan to out, without syncing, deleting, or creating anything. For every
+// mapping, the plan lists the tags to copy, the tags that are unchanged and get
+// skipped, the tags that would get pruned, and whether the target repository
+// would get created. An error is returned if planning failed for any mapping.
+func (s *Sync) Plan(conf *SyncConfig, out io.Writer) error {
+
+	ctx := context.Background()
+	if err := s.relay.Prepare(ctx); err != nil {
+		return err
+	}
+
+	var stats planStats
+	failed := false
+
+	for _, t := range conf.Tasks {
+		if !s.planTask(ctx, t, out, &stats) {
+			failed = true
+		}
+	}
+
+	fmt.Fprintf(out,
+		"\nplan: %d to copy, %d unchanged, %d to prune, %d repos to create\n",
+		stats.copy, stats.unchanged, stats.prune, stats.createRepo)
+
+	if failed {
+		return errors.New("errors during planning")
+	}
+	return nil
+}
+
+//
+type planStats struct {
+	copy       int
+	unchanged  int
+	prune      int
+	createRepo int
+}
+
+// planTask writes the plan for task t to out, and returns false if there were
+// errors
+func (s *Sync) planTask(ctx context.Context, t *Task, out io.Writer,
+	stats *planStats) bool {
+
+	fmt.Fprintf(out, "\ntask '%s' (%s -> %s)\n",
+		t.Name, t.Source.Registry, t.Target.Registry)
+
+	fail := func(err error) bool {
+		log.Error(err)
+		fmt.Fprintf(out, "  error: %v\n", err)
+		return false
+	}
+
+	if err := s.loadState(t); err != nil {
+		return fail(err)
+	}
+	if err := t.Source.RefreshAuth(); err != nil {
+		return fail(err)
+	}
+	if err := t.Target.RefreshAuth(); err != nil {
+		return fail(err)
+	}
+
+	ok := true
+	for _, m := range t.currentMappings() {
+		if !s.planMapping(ctx, t, m, out, stats) {
+			ok = false
+		}
+	}
+	return ok
+}
+
+// planMapping writes the plan for mapping m of task t to out, and returns
+// false if there were errors
+func (s *Sync) planMapping(ctx context.Context, t *Task, m *Mapping,
+	out io.Writer, stats *planStats) bool {
+
+	fmt.Fprintf(out, "  mapping %s -> %s\n", m.From, m.To)
+
+	action := func(a, subject string) {
+		fmt.Fprintf(out, "    %-18s %s\n", a, subject)
+	}
+	fail := func(err error) bool {
+		log.Error(err)
+		fmt.Fprintf(out, "    error: %v\n", err)
+		return false
+	}
+
+	src, trgt := t.mappingRefs(m)
+
+	tagList, err := s.mappingTags(ctx, t, m, src)
+	if err != nil {
+		return fail(err)
+	}
+	if len(tagList) == 0 {
+		fmt.Fprintln(out, "    no matching tags")
+		return true
+	}
+
+	exists, err := t.targetExists(trgt)
+	if err != nil {
+		return fail(err)
+	}
+	if !exists {
+		action(planCreateRepo, trgt)
+		stats.createRepo++
+	}
+
+	toCopy := 0
+	for _, c := range s.checkTags(ctx, t, m, src, trgt, tagList) {
+		if c.upToDate {
+			action(planSkipUnchanged, c.tag)
+			stats.unchanged++
+		} else {
+			action(planCopy, c.tag)
+			stats.copy++
+			toCopy++
+		}
+	}
+
+	if !m.Prune || m.PruneDryRun || !exists {
+		return true
+	}
+
+	prune, _, err := s.pruneCandidates(ctx, t, m, trgt, tagList)
+	if err != nil {
+		// a target repository that doesn't exist yet, and hence can't be
+		// listed, has nothing to prune
+		if toCopy == len(tagList) {
+			return true
+		}
+		return fail(fmt.Errorf("cannot determine tags to prune: %v", err))
+	}
+	for _, tag := range prune {
+		action(planPrune, tag)
+		stats.prune++
+	}
+
+	return true
+}
@@ -0,0 +1,88 @@
+/*
+	Copyright 2020 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package sync
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/xelalexv/dregsy/internal/pkg/test"
+)
+
+//
+func TestPlan(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	src := test.NewRegistry(th)
+	defer src.Close()
+	trgt := test.NewRegistry(th)
+	defer trgt.Close()
+
+	src.PushImage("library/busybox", "1.0")
+	src.PushImage("library/busybox", "1.1")
+	trgt.PushImage("library/busybox", "0.9")
+
+	m := &Mapping{From: "library/busybox", Tags: []string{"1.0"}}
+	s, task := newTestSync(th, src, trgt, m)
+	s.syncTask(context.Background(), task)
+	th.AssertFalse(task.failed)
+
+	m.Tags = []string{"regex: ^1\\."}
+	m.Prune = true
+	th.AssertNoError(task.validateMappings())
+
+	var out bytes.Buffer
+	th.AssertNoError(s.Plan(&SyncConfig{Tasks: []*Task{task}}, &out))
+
+	plan := out.String()
+	for _, l := range []string{
+		"task 'test' (" + src.Host() + " -> " + trgt.Host() + ")",
+		"  mapping /library/busybox -> /library/busybox",
+		"    skip-unchanged     1.0",
+		"    copy               1.1",
+		"    would-prune        0.9",
+		"plan: 1 to copy, 1 unchanged, 1 to prune, 0 repos to create",
+	} {
+		if !strings.Contains(plan, l+"\n") {
+			t.Errorf("plan does not contain '%s':\n%s", l, plan)
+		}
+	}
+
+	// nothing was touched
+	th.AssertEquivalentSlices([]string{"0.9", "1.0"},
+		trgt.ListTags("library/busybox"))
+	th.AssertEqual(0, trgt.ManifestDeletes)
+
+	// with prune dry-run, nothing would get pruned
+	m.PruneDryRun = true
+	out.Reset()
+	th.AssertNoError(s.Plan(&SyncConfig{Tasks: []*Task{task}}, &out))
+	th.AssertFalse(strings.Contains(out.String(), "would-prune"))
+
+	// errors are reported in the plan
+	task.Mappings = append(task.Mappings,
+		&Mapping{From: "library/missing", Tags: []string{"regex: .*"}})
+	th.AssertNoError(task.validateMappings())
+	out.Reset()
+	th.AssertError(s.Plan(&SyncConfig{Tasks: []*Task{task}}, &out),
+		"errors during planning")
+	th.AssertTrue(strings.Contains(out.String(),
+		"  mapping /library/missing -> /library/missing\n    error: "))
+}
@@ -0,0 +1,184 @@
+/*
+	Copyright 2020 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package sync
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/xelalexv/dregsy/internal/pkg/metrics"
+	"github.com/xelalexv/dregsy/internal/pkg/state"
+)
+
+// pruneTags deletes those tags from target image trgt of mapping m in task t,
+// which are neither in keep, i.e. the tags resolved for the source, nor
+// protected, nor tags of copied referrers. In dry-run mode, the tags are only
+// logged.
+func (s *Sync) pruneTags(ctx context.Context, t *Task, m *Mapping,
+	trgt string, keep []string) {
+
+	logger := log.WithFields(log.Fields{"from": m.From, "to": m.To})
+
+	prune, digests, err := s.pruneCandidates(ctx, t, m, trgt, keep)
+	if err != nil {
+		logger.Errorf("not pruning: %v", err)
+		t.fail(true)
+		return
+	}
+
+	if len(prune) == 0 {
+		return
+	}
+
+	if m.PruneDryRun {
+		logger.WithField("tags", strings.Join(prune, ", ")).Info(
+			"dry run, would prune tags")
+		return
+	}
+
+	var pruned []string
+	isEcr, _, _ := t.Target.GetECR()
+
+	if isEcr {
+		pruned, err = t.deleteFromECR(trgt, prune)
+		if err != nil {
+			logger.Error(err)
+			t.fail(true)
+		}
+
+	} else {
+		deleted := make(map[string]bool)
+		for _, tag := range prune {
+			// deleting a manifest takes along all its tags
+			if d := digests[tag]; !deleted[d] {
+				if err := s.relay.DeleteTag(ctx,
+					fmt.Sprintf("%s:%s", trgt, tag),
+					t.Target.Auth, t.Target.SkipTLSVerify); err != nil {
+					logger.WithField("tag", tag).Errorf(
+						"cannot prune tag: %v", err)
+					t.fail(true)
+					continue
+				}
+				deleted[d] = true
+			}
+			pruned = append(pruned, tag)
+		}
+	}
+
+	for _, tag := range pruned {
+		t.state.RemoveTag(m.key(), tag)
+		metrics.TagOutcome(t.Name, state.OutcomePruned)
+	}
+
+	if len(pruned) > 0 {
+		logger.WithField("tags", strings.Join(pruned, ", ")).Info(
+			"pruned tags")
+	}
+}
+
+// pruneCandidates determines the tags to delete from target image trgt of
+// mapping m in task t, without deleting anything; see pruneTags. Except for
+// ECR targets, the manifest digests of the tags are also returned.
+func (s *Sync) pruneCandidates(ctx context.Context, t *Task, m *Mapping,
+	trgt string, keep []string) ([]string, map[string]string, error) {
+
+	trgtTags, err := s.relay.ListTags(
+		ctx, trgt, t.Target.Auth, t.Target.SkipTLSVerify)
+	if err != nil {
+		return nil, nil, fmt.Errorf("cannot list target tags: %v", err)
+	}
+
+	keepSet := make(map[string]bool, len(keep))
+	for _, tag := range keep {
+		keepSet[tag] = true
+	}
+
+	// artifacts copied along with the images are not pruned
+	referrers := t.copiesReferrers(m)
+
+	var prune, kept []string
+	for _, tag := range trgtTags {
+		if keepSet[tag] || m.isProtected(tag) ||
+			(referrers && isReferrerTag(tag)) {
+			kept = append(kept, tag)
+		} else {
+			prune = append(prune, tag)
+		}
+	}
+
+	if len(prune) == 0 {
+		return nil, nil, nil
+	}
+
+	if isEcr, _, _ := t.Target.GetECR(); isEcr {
+		return prune, nil, nil
+	}
+
+	digests, err := s.prunableDigests(ctx, t, trgt, prune, kept)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var ret []string
+	for _, tag := range prune {
+		if _, ok := digests[tag]; ok {
+			ret = append(ret, tag)
+		}
+	}
+	return ret, digests, nil
+}
+
+// prunableDigests determines the manifest digests of the tags in prune, and
+// returns those tags along with their digests that don't share a manifest with
+// any of the tags in kept. Since a registry can only delete a manifest, and not
+// just a tag, deleting one of those would also take along the kept tag.
+func (s *Sync) prunableDigests(ctx context.Context, t *Task, trgt string,
+	prune, kept []string) (map[string]string, error) {
+
+	keptDigests := make(map[string]string, len(kept))
+	for _, tag := range kept {
+		d, err := s.relay.ManifestDigest(ctx, fmt.Sprintf("%s:%s", trgt, tag),
+			t.Target.Auth, t.Target.SkipTLSVerify)
+		if err != nil {
+			return nil, fmt.Errorf(
+				"cannot get digest of tag '%s' to keep: %v", tag, err)
+		}
+		keptDigests[d] = tag
+	}
+
+	ret := make(map[string]string, len(prune))
+	for _, tag := range prune {
+		logger := log.WithField("tag", tag)
+		d, err := s.relay.ManifestDigest(ctx, fmt.Sprintf("%s:%s", trgt, tag),
+			t.Target.Auth, t.Target.SkipTLSVerify)
+		if err != nil {
+			logger.Warnf("cannot get digest, not pruning: %v", err)
+			continue
+		}
+		if k, ok := keptDigests[d]; ok {
+			logger.Warnf(
+				"shares its manifest with tag '%s' to keep, not pruning", k)
+			continue
+		}
+		ret[tag] = d
+	}
+
+	return ret, nil
+}
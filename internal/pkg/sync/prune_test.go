@@ -0,0 +1,96 @@
+/*
+	Copyright 2020 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package sync
+
+import (
+	"context"
+	"testing"
+
+	"github.com/xelalexv/dregsy/internal/pkg/state"
+	"github.com/xelalexv/dregsy/internal/pkg/test"
+)
+
+//
+func TestPrune(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	src := test.NewRegistry(th)
+	defer src.Close()
+	trgt := test.NewRegistry(th)
+	defer trgt.Close()
+
+	src.PushImage("library/busybox", "1.0")
+	src.PushImage("library/busybox", "1.1")
+
+	trgt.PushImage("library/busybox", "0.9")
+	trgt.PushImage("library/busybox", "0.8", "stable")
+	trgt.PushImage("library/busybox", "0.7", "0.6")
+
+	m := &Mapping{
+		From:         "library/busybox",
+		Tags:         []string{"regex: ^1\\."},
+		Prune:        true,
+		PruneDryRun:  true,
+		PruneProtect: []string{"^stable$"},
+	}
+	s, task := newTestSync(th, src, trgt, m)
+
+	// dry run only syncs
+	s.syncTask(context.Background(), task)
+	th.AssertFalse(task.failed)
+	th.AssertEqual(0, trgt.ManifestDeletes)
+	th.AssertEquivalentSlices(
+		[]string{"0.6", "0.7", "0.8", "0.9", "1.0", "1.1", "stable"},
+		trgt.ListTags("library/busybox"))
+
+	// 0.8 shares its manifest with protected tag stable, and 0.6 & 0.7 go
+	// with a single delete
+	task.state.SetTag(m.key(), "0.9", &state.TagState{})
+	m.PruneDryRun = false
+	s.syncTask(context.Background(), task)
+	th.AssertFalse(task.failed)
+	th.AssertEqual(2, trgt.ManifestDeletes)
+	th.AssertEquivalentSlices([]string{"0.8", "1.0", "1.1", "stable"},
+		trgt.ListTags("library/busybox"))
+	th.AssertNil(task.state.Tag(m.key(), "0.9"))
+
+	// nothing left to prune
+	s.syncTask(context.Background(), task)
+	th.AssertFalse(task.failed)
+	th.AssertEqual(2, trgt.ManifestDeletes)
+}
+
+//
+func TestPruneProtect(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	m := &Mapping{
+		From:         "library/busybox",
+		PruneProtect: []string{"^latest$", "^release-"},
+	}
+	th.AssertNoError(m.validate())
+
+	th.AssertTrue(m.isProtected("latest"))
+	th.AssertTrue(m.isProtected("release-1.0"))
+	th.AssertFalse(m.isProtected("latest-rc"))
+	th.AssertFalse(m.isProtected("1.0"))
+
+	m.PruneProtect = []string{"("}
+	th.AssertError(m.validate(), "invalid prune-protect expression '('")
+}
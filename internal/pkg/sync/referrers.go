@@ -0,0 +1,158 @@
+/*
+	Copyright 2020 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package sync
+
+import (
+	"context"
+	"regexp"
+	"sort"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/xelalexv/dregsy/internal/pkg/relays/native"
+	"github.com/xelalexv/dregsy/internal/pkg/retry"
+	"github.com/xelalexv/dregsy/internal/pkg/state"
+)
+
+// tags under which artifacts referring to an image are stored, when registries
+// don't support the OCI referrers API; these are the OCI referrers tag schema,
+// i.e. sha256-<digest>, and the tags cosign uses for signatures, attestations,
+// and SBOMs
+var referrerTag = regexp.MustCompile(
+	`^sha256-[a-f0-9]{64}(\.sig|\.att|\.sbom)?$`)
+
+// isReferrerTag determines whether tag is one under which artifacts referring
+// to an image are stored
+func isReferrerTag(tag string) bool {
+	return referrerTag.MatchString(tag)
+}
+
+// referrerTags returns those of tags under which artifacts referring to the
+// manifest with digest are stored
+func referrerTags(digest string, tags []string) []string {
+	prefix := strings.Replace(digest, ":", "-", 1)
+	var ret []string
+	for _, tag := range tags {
+		if (tag == prefix || strings.HasPrefix(tag, prefix+".")) &&
+			isReferrerTag(tag) {
+			ret = append(ret, tag)
+		}
+	}
+	return ret
+}
+
+// syncReferrers copies the artifacts referring to the images of mapping m in
+// task t, such as signatures, attestations, and SBOMs, for all tags out of
+// tagList that are in sync. Artifacts are discovered via the tags under which
+// they're stored, and via the OCI referrers API, if the source registry
+// supports it. Artifacts already present in the target are skipped.
+func (s *Sync) syncReferrers(ctx context.Context, t *Task, m *Mapping,
+	src, trgt string, tagList []string) {
+
+	logger := log.WithFields(log.Fields{"from": m.From, "to": m.To})
+
+	relay, ok := s.relay.(ArtifactRelay)
+	if !ok {
+		logger.Warn("relay cannot copy referrers, skipping")
+		return
+	}
+
+	var digests []string
+	seen := make(map[string]bool)
+	for _, tag := range tagList {
+		rec := t.state.Tag(m.key(), tag)
+		if rec == nil || rec.SourceDigest == "" || seen[rec.SourceDigest] ||
+			(rec.Outcome != state.OutcomeSynced &&
+				rec.Outcome != state.OutcomeUpToDate) {
+			continue
+		}
+		seen[rec.SourceDigest] = true
+		digests = append(digests, rec.SourceDigest)
+	}
+	if len(digests) == 0 {
+		return
+	}
+	sort.Strings(digests)
+
+	srcTags, err := s.relay.ListTags(
+		ctx, src, t.Source.Auth, t.Source.SkipTLSVerify)
+	if err != nil {
+		t.checkRateLimit(t.Source.Registry, err)
+		logger.Warnf("cannot list source tags for finding referrers: %v", err)
+	}
+
+	copied := 0
+	for _, d := range digests {
+
+		if ctx.Err() != nil {
+			return
+		}
+
+		refs := referrerTags(d, srcTags)
+		referrers, err := s.registry.Referrers(ctx,
+			src, d, t.Source.Auth, t.Source.SkipTLSVerify)
+		if err != nil {
+			logger.WithField("digest", d).Warnf(
+				"cannot query referrers API: %v", err)
+		}
+		refs = append(refs, referrers...)
+
+		for _, ref := range refs {
+			done, err := s.syncReferrer(ctx, t, relay, src, trgt, ref)
+			if err != nil {
+				logger.WithFields(log.Fields{"digest": d, "ref": ref}).Errorf(
+					"cannot copy referrer: %v", err)
+				t.fail(true)
+			} else if done {
+				copied++
+			}
+		}
+	}
+
+	if copied > 0 {
+		logger.WithField("count", copied).Info("copied referrers")
+	}
+}
+
+// syncReferrer copies the artifact with tag or digest ref from source to
+// target, unless it's already present there. It returns whether the artifact
+// was copied.
+func (s *Sync) syncReferrer(ctx context.Context, t *Task, relay ArtifactRelay,
+	src, trgt, ref string) (bool, error) {
+
+	srcRef := native.ArtifactRef(src, ref)
+	trgtRef := native.ArtifactRef(trgt, ref)
+
+	srcDigest, err := s.relay.ManifestDigest(
+		ctx, srcRef, t.Source.Auth, t.Source.SkipTLSVerify)
+	if err != nil {
+		return false, err
+	}
+	if trgtDigest, err := s.relay.ManifestDigest(ctx, trgtRef, t.Target.Auth,
+		t.Target.SkipTLSVerify); err == nil && trgtDigest == srcDigest {
+		return false, nil
+	}
+
+	log.WithField("ref", ref).Info("copying referrer")
+	return true, retry.Do(ctx, t.syncRetryPolicy(), log.WithField("ref", ref),
+		func() error {
+			return relay.CopyArtifact(ctx, src, t.Source.Auth,
+				t.Source.SkipTLSVerify, trgt, t.Target.Auth,
+				t.Target.SkipTLSVerify, ref)
+		})
+}
@@ -0,0 +1,142 @@
+/*
+	Copyright 2020 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package sync
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/xelalexv/dregsy/internal/pkg/test"
+)
+
+//
+func TestReferrerTags(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	digest := "sha256:" + strings.Repeat("ab", 32)
+	other := "sha256-" + strings.Repeat("cd", 32)
+	prefix := strings.Replace(digest, ":", "-", 1)
+
+	th.AssertEquivalentSlices(
+		[]string{prefix, prefix + ".sig", prefix + ".att", prefix + ".sbom"},
+		referrerTags(digest, []string{"latest", prefix, prefix + ".sig",
+			prefix + ".att", prefix + ".sbom", prefix + ".foo", other + ".sig"}))
+
+	th.AssertTrue(isReferrerTag(other + ".sig"))
+	th.AssertFalse(isReferrerTag("sha256-abc.sig"))
+	th.AssertFalse(isReferrerTag("1.0"))
+}
+
+//
+func TestSyncReferrers(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	src := test.NewRegistry(th)
+	defer src.Close()
+	src.EnableReferrers()
+	trgt := test.NewRegistry(th)
+	defer trgt.Close()
+
+	repo := "library/busybox"
+	d := src.PushImage(repo, "1.0")
+	src.PushImage(repo, "2.0")
+	prefix := strings.Replace(d, ":", "-", 1)
+
+	src.PushCosignSignature(repo, d, test.CosignPayload(d), []byte("sig"))
+	src.PushArtifact(repo, prefix+".att", &test.ArtifactLayer{
+		MediaType: "application/vnd.dsse.envelope.v1+json",
+		Data:      []byte(`{"payloadType":"application/vnd.in-toto+json"}`),
+	})
+	sbom := src.PushReferrer(repo, d, "application/spdx+json",
+		[]byte(`{"spdxVersion":"SPDX-2.3"}`))
+
+	m := &Mapping{From: repo, Tags: []string{"1.0", "2.0"}, Prune: true}
+	s, task := newTestSync(th, src, trgt, m)
+	task.CopyReferrers = true
+
+	s.syncTask(context.Background(), task)
+	th.AssertFalse(task.failed)
+
+	th.AssertEquivalentSlices(
+		[]string{"1.0", "2.0", prefix + ".att", prefix + ".sig"},
+		trgt.ListTags(repo))
+	for _, tag := range []string{prefix + ".att", prefix + ".sig"} {
+		th.AssertEqual(src.Digest(repo, tag), trgt.Digest(repo, tag))
+	}
+	th.AssertEqual(sbom, trgt.Digest(repo, sbom))
+
+	// all present, nothing to copy; referrer tags don't get pruned
+	puts := trgt.ManifestPuts
+	s.syncTask(context.Background(), task)
+	th.AssertFalse(task.failed)
+	th.AssertEqual(puts, trgt.ManifestPuts)
+	th.AssertEqual(4, len(trgt.ListTags(repo)))
+
+	// mapping setting overrides task setting
+	trgt2 := test.NewRegistry(th)
+	defer trgt2.Close()
+	off := false
+	m = &Mapping{From: repo, Tags: []string{"1.0"}, CopyReferrers: &off}
+	s, task = newTestSync(th, src, trgt2, m)
+	task.CopyReferrers = true
+
+	s.syncTask(context.Background(), task)
+	th.AssertFalse(task.failed)
+	th.AssertEquivalentSlices([]string{"1.0"}, trgt2.ListTags(repo))
+}
+
+//
+func TestMappingTagsSkipReferrers(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	src := test.NewRegistry(th)
+	defer src.Close()
+	trgt := test.NewRegistry(th)
+	defer trgt.Close()
+
+	repo := "library/busybox"
+	d := src.PushImage(repo, "1.0")
+	src.PushImage(repo, "2.0")
+	prefix := strings.Replace(d, ":", "-", 1)
+	src.PushCosignSignature(repo, d, test.CosignPayload(d), []byte("sig"))
+
+	// without a tag filter, artifact tags are not synced as images
+	m := &Mapping{From: repo}
+	s, task := newTestSync(th, src, trgt, m)
+	task.CopyReferrers = true
+	from, _ := task.mappingRefs(m)
+
+	list, err := s.mappingTags(context.Background(), task, m, from)
+	th.AssertNoError(err)
+	th.AssertEquivalentSlices([]string{"1.0", "2.0"}, list)
+
+	s.syncTask(context.Background(), task)
+	th.AssertFalse(task.failed)
+	th.AssertNil(task.state.Tag(m.key(), prefix+".sig"))
+	th.AssertEquivalentSlices([]string{"1.0", "2.0", prefix + ".sig"},
+		trgt.ListTags(repo))
+
+	// unless artifacts are not copied
+	task.CopyReferrers = false
+	list, err = s.mappingTags(context.Background(), task, m, from)
+	th.AssertNoError(err)
+	th.AssertEquivalentSlices([]string{"1.0", "2.0", prefix + ".sig"}, list)
+}
@@ -0,0 +1,114 @@
+/*
+	Copyright 2020 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package sync
+
+import (
+	"fmt"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// reloadConfig loads the config from the file conf was loaded from, and applies
+// changes to its tasks to sched. Tasks are matched by name. Unchanged tasks are
+// left alone, changed tasks replaced, with a run in progress allowed to finish,
+// and removed tasks stopped, aborting a run in progress. Changes to settings
+// other than tasks only take effect after a restart. If the new config is
+// invalid, an error is returned and nothing is changed.
+func (s *Sync) reloadConfig(conf *SyncConfig, sched *scheduler) (
+	*SyncConfig, error) {
+
+	next, err := LoadConfig(conf.file)
+	if err != nil {
+		return nil, fmt.Errorf(
+			"config reload failed, keeping current config: %v", err)
+	}
+
+	current := make(map[string]*Task, len(sched.tasks))
+	for _, t := range sched.tasks {
+		current[t.Name] = t
+	}
+
+	// load state of new tasks, and set up policies of new and changed tasks
+	// first, so that nothing gets changed if this fails
+	for _, t := range next.Tasks {
+		old, ok := current[t.Name]
+		if !ok {
+			if err := s.loadState(t); err != nil {
+				return nil, fmt.Errorf(
+					"config reload failed, keeping current config: %v", err)
+			}
+		}
+		if !ok || old.fingerprint != t.fingerprint {
+			if err := s.setupPolicy(t); err != nil {
+				return nil, fmt.Errorf(
+					"config reload failed, keeping current config: %v", err)
+			}
+		}
+	}
+
+	if next.fingerprint != conf.fingerprint {
+		log.Warn("settings other than tasks changed, " +
+			"restart required for them to take effect")
+	}
+
+	var tasks []*Task
+	var added, changed, removed int
+
+	for _, t := range next.Tasks {
+
+		logger := log.WithField("task", t.Name)
+		old, ok := current[t.Name]
+		delete(current, t.Name)
+
+		switch {
+		case !ok:
+			logger.Info("adding task")
+			added++
+		case old.fingerprint == t.fingerprint:
+			tasks = append(tasks, old)
+			continue
+		default:
+			logger.Info("updating task")
+			sched.stop(old, false)
+			t.state = old.state
+			changed++
+		}
+
+		s.health.watch(t)
+		sched.start(t)
+		tasks = append(tasks, t)
+	}
+
+	for _, t := range current {
+		log.WithField("task", t.Name).Info("removing task")
+		sched.stop(t, true)
+		s.health.unwatch(t)
+		removed++
+	}
+
+	sched.tasks = tasks
+
+	log.WithFields(log.Fields{
+		"added":   added,
+		"changed": changed,
+		"removed": removed}).Info("config reloaded")
+
+	// settings other than tasks stay as they are
+	ret := *conf
+	ret.Tasks = tasks
+	return &ret, nil
+}
@@ -0,0 +1,148 @@
+/*
+	Copyright 2020 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package sync
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/xelalexv/dregsy/internal/pkg/test"
+)
+
+//
+func TestReload(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	src := test.NewRegistry(th)
+	defer src.Close()
+	trgt := test.NewRegistry(th)
+	defer trgt.Close()
+
+	src.PushImage("library/busybox", "1.0")
+	src.PushImage("library/alpine", "3.12", "3.13")
+	src.PushImage("library/nginx", "1.19")
+
+	dir, err := ioutil.TempDir("", "dregsy-reload-")
+	th.AssertNoError(err)
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "config.yaml")
+
+	writeConfig := func(tasks ...string) {
+		conf := "relay: native\ntasks:\n" + strings.Join(tasks, "")
+		th.AssertNoError(ioutil.WriteFile(file, []byte(conf), 0644))
+	}
+
+	task := func(name, repo, extra string, tags ...string) string {
+		return fmt.Sprintf(`
+  - name: %s
+%s
+    source:
+      registry: %s
+    target:
+      registry: %s
+    mappings:
+      - from: %s
+        tags: ['%s']
+`, name, extra, src.Host(), trgt.Host(), repo, strings.Join(tags, "', '"))
+	}
+
+	// a periodic task keeps the sync running, one-off tasks run right away
+	writeConfig(
+		task("busybox", "library/busybox", "    interval: 60", "1.0"),
+		task("alpine", "library/alpine", "", "3.12"))
+	conf, err := LoadConfig(file)
+	th.AssertNoError(err)
+	busybox := conf.Tasks[0]
+
+	s, err := New(conf)
+	th.AssertNoError(err)
+	relay := &trackingRelay{Relay: s.relay}
+	s.relay = relay
+
+	res := make(chan error)
+	go func() { res <- s.SyncFromConfig(conf) }()
+
+	waitForTags(th, trgt, "library/busybox", "1.0")
+	waitForTags(th, trgt, "library/alpine", "3.12")
+
+	// changed task is run again, new task is started, unchanged task is kept
+	writeConfig(
+		task("busybox", "library/busybox", "    interval: 60", "1.0"),
+		task("alpine", "library/alpine", "", "3.12", "3.13"),
+		task("nginx", "library/nginx", "", "1.19"))
+	th.AssertNoError(s.Reload())
+
+	waitForTags(th, trgt, "library/alpine", "3.12", "3.13")
+	waitForTags(th, trgt, "library/nginx", "1.19")
+	th.AssertEqual(busybox, healthTask(s, "busybox"))
+	th.AssertNotNil(healthTask(s, "nginx"))
+
+	// removed task is stopped
+	writeConfig(
+		task("busybox", "library/busybox", "    interval: 60", "1.0"),
+		task("alpine", "library/alpine", "", "3.12", "3.13"))
+	th.AssertNoError(s.Reload())
+	th.AssertNil(healthTask(s, "nginx"))
+	th.AssertEqual(busybox, healthTask(s, "busybox"))
+
+	// invalid config is rejected, and current one kept
+	writeConfig(task("busybox", "library/busybox", "    interval: 10", "1.0"))
+	th.AssertError(s.Reload(),
+		"config reload failed, keeping current config: "+
+			"minimum task interval is 30 seconds")
+	th.AssertEqual(busybox, healthTask(s, "busybox"))
+	th.AssertNotNil(healthTask(s, "alpine"))
+
+	// busybox once, alpine twice, nginx once
+	relay.mutex.Lock()
+	th.AssertEqual(4, relay.total)
+	relay.mutex.Unlock()
+
+	s.Shutdown()
+	th.AssertNoError(<-res)
+}
+
+// healthTask returns the task with the given name tracked by health, or nil
+func healthTask(s *Sync, name string) *Task {
+	s.health.mutex.Lock()
+	defer s.health.mutex.Unlock()
+	if w, ok := s.health.tasks[name]; ok {
+		return w.task
+	}
+	return nil
+}
+
+// waitForTags waits until repo in reg has the given tags
+func waitForTags(th *test.TestHelper, reg *test.Registry, repo string,
+	tags ...string) {
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		if len(reg.ListTags(repo)) == len(tags) {
+			break
+		}
+		if time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	th.AssertEquivalentSlices(tags, reg.ListTags(repo))
+}
@@ -0,0 +1,108 @@
+/*
+	Copyright 2020 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package sync
+
+import (
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/robfig/cron/v3"
+)
+
+// schedule determines when a periodic task fires. It's either a fixed interval,
+// or a cron expression, optionally with a random jitter added to each firing.
+type schedule struct {
+	cron     cron.Schedule
+	interval time.Duration // only set for interval schedules
+	jitter   time.Duration
+}
+
+// parseSchedule parses spec, which is either a duration such as 15m, or a cron
+// expression such as '0 2 * * *'. Cron expressions are evaluated in time zone
+// tz, or in local time if tz is empty.
+func parseSchedule(spec, tz string, jitter time.Duration) (*schedule, error) {
+
+	if jitter < 0 {
+		return nil, fmt.Errorf("jitter needs to be 0 or a positive duration")
+	}
+
+	ret := &schedule{jitter: jitter}
+
+	if d, err := time.ParseDuration(spec); err == nil {
+		if d < minimumTaskInterval*time.Second {
+			return nil, fmt.Errorf(
+				"minimum task interval is %d seconds", minimumTaskInterval)
+		}
+		ret.interval = d
+		ret.cron = cron.Every(d)
+		return ret, nil
+	}
+
+	sched, err := cron.ParseStandard(spec)
+	if err != nil {
+		return nil, fmt.Errorf("invalid schedule '%s': %v", spec, err)
+	}
+
+	if tz != "" {
+		loc, err := time.LoadLocation(tz)
+		if err != nil {
+			return nil, fmt.Errorf("invalid time zone '%s': %v", tz, err)
+		}
+		if s, ok := sched.(*cron.SpecSchedule); ok {
+			s.Location = loc
+		}
+	}
+	ret.cron = sched
+
+	return ret, nil
+}
+
+// first determines when to fire for the first time after a start at now. An
+// interval schedule fires right away, a cron schedule at its next activation
+// time. If there is a recorded last run, the first firing is at the next
+// activation time after that, or right away if that was missed.
+func (s *schedule) first(now, lastRun time.Time) time.Time {
+
+	var ret time.Time
+
+	switch {
+	case !lastRun.IsZero():
+		if ret = s.cron.Next(lastRun); ret.Before(now) {
+			ret = now
+		}
+	case s.interval > 0:
+		ret = now
+	default:
+		ret = s.cron.Next(now)
+	}
+
+	return ret.Add(s.randomJitter())
+}
+
+// next determines when to fire next after now
+func (s *schedule) next(now time.Time) time.Time {
+	return s.cron.Next(now).Add(s.randomJitter())
+}
+
+//
+func (s *schedule) randomJitter() time.Duration {
+	if s.jitter <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(s.jitter)))
+}
@@ -0,0 +1,94 @@
+/*
+	Copyright 2020 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package sync
+
+import (
+	"testing"
+	"time"
+
+	"github.com/xelalexv/dregsy/internal/pkg/test"
+)
+
+//
+func TestScheduleInterval(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	s, err := parseSchedule("15m", "", 0)
+	th.AssertNoError(err)
+
+	now := time.Date(2020, 11, 20, 10, 3, 0, 0, time.UTC)
+	th.AssertEqual(now, s.first(now, time.Time{}))
+	th.AssertEqual(now.Add(15*time.Minute), s.next(now))
+
+	// recent last run delays first firing
+	last := now.Add(-5 * time.Minute)
+	th.AssertEqual(last.Add(15*time.Minute), s.first(now, last))
+	// missed run fires right away
+	th.AssertEqual(now, s.first(now, now.Add(-time.Hour)))
+
+	_, err = parseSchedule("10s", "", 0)
+	th.AssertError(err, "minimum task interval is 30 seconds")
+}
+
+//
+func TestScheduleCron(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	s, err := parseSchedule("0 2 * * *", "Europe/Berlin", 0)
+	th.AssertNoError(err)
+
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	th.AssertNoError(err)
+
+	now := time.Date(2020, 11, 20, 10, 3, 0, 0, berlin)
+	nightly := time.Date(2020, 11, 21, 2, 0, 0, 0, berlin)
+	th.AssertTrue(nightly.Equal(s.first(now, time.Time{})))
+	th.AssertTrue(nightly.Equal(s.next(now)))
+
+	// last nightly run was missed
+	last := time.Date(2020, 11, 19, 2, 0, 0, 0, berlin)
+	th.AssertTrue(now.Equal(s.first(now, last)))
+	// last nightly run happened
+	last = time.Date(2020, 11, 20, 2, 0, 0, 0, berlin)
+	th.AssertTrue(nightly.Equal(s.first(now, last)))
+
+	_, err = parseSchedule("0 25 * * *", "", 0)
+	th.AssertError(err, "invalid schedule '0 25 * * *'")
+	_, err = parseSchedule("0 2 * * *", "Mars/Olympus_Mons", 0)
+	th.AssertError(err, "invalid time zone 'Mars/Olympus_Mons'")
+}
+
+//
+func TestScheduleJitter(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	s, err := parseSchedule("1h", "", 10*time.Minute)
+	th.AssertNoError(err)
+
+	now := time.Date(2020, 11, 20, 10, 3, 0, 0, time.UTC)
+	for i := 0; i < 100; i++ {
+		next := s.next(now)
+		th.AssertFalse(next.Before(now.Add(time.Hour)))
+		th.AssertTrue(next.Before(now.Add(time.Hour + 10*time.Minute)))
+	}
+
+	_, err = parseSchedule("1h", "", -time.Minute)
+	th.AssertError(err, "jitter needs to be 0 or a positive duration")
+}
@@ -0,0 +1,108 @@
+/*
+	Copyright 2020 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package sync
+
+import (
+	"context"
+)
+
+// scheduler keeps track of the tasks handled by SyncFromConfig, which of them
+// are waiting for a free worker, and which are currently running
+type scheduler struct {
+	tasks    []*Task
+	pending  []*Task
+	running  map[string]context.CancelFunc // by task name
+	fire     chan *Task
+	finished chan *Task
+}
+
+//
+func newScheduler(tasks []*Task) *scheduler {
+	return &scheduler{
+		tasks:    tasks,
+		running:  make(map[string]context.CancelFunc),
+		fire:     make(chan *Task),
+		finished: make(chan *Task),
+	}
+}
+
+// start queues task t right away if it's a one-off task, or else lets it fire
+// according to its schedule, watching its mapping file for changes
+func (s *scheduler) start(t *Task) {
+	if t.isPeriodic() {
+		t.startTicking(s.fire)
+		t.watchMappings()
+	} else {
+		s.pending = append(s.pending, t)
+	}
+}
+
+// stop stops task t from firing, and removes it from the pending tasks. If
+// abort is set, the task is also aborted if currently running.
+func (s *scheduler) stop(t *Task, abort bool) {
+
+	t.stopTicking()
+	t.stopWatchingMappings()
+
+	var pending []*Task
+	for _, p := range s.pending {
+		if p != t {
+			pending = append(pending, p)
+		}
+	}
+	s.pending = pending
+
+	if cancel, ok := s.running[t.Name]; ok && abort {
+		cancel()
+	}
+}
+
+// next removes the first pending task from the queue and returns it, skipping
+// tasks for which a run is still in progress; returns nil if there is none
+func (s *scheduler) next() *Task {
+	for ix, t := range s.pending {
+		if _, ok := s.running[t.Name]; !ok {
+			s.pending = append(s.pending[:ix:ix], s.pending[ix+1:]...)
+			return t
+		}
+	}
+	return nil
+}
+
+// isScheduled determines whether a task with the given name is pending or
+// running
+func (s *scheduler) isScheduled(name string) bool {
+	if _, ok := s.running[name]; ok {
+		return true
+	}
+	for _, t := range s.pending {
+		if t.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// ticking determines whether any of the tasks is periodic
+func (s *scheduler) ticking() bool {
+	for _, t := range s.tasks {
+		if t.isPeriodic() {
+			return true
+		}
+	}
+	return false
+}
@@ -17,32 +17,89 @@
 package sync
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"os"
 	"os/signal"
+	"strings"
+	gosync "sync"
 	"syscall"
 	"time"
 
 	log "github.com/sirupsen/logrus"
 
+	"github.com/xelalexv/dregsy/internal/pkg/metrics"
+	"github.com/xelalexv/dregsy/internal/pkg/ratelimit"
 	"github.com/xelalexv/dregsy/internal/pkg/relays/docker"
+	"github.com/xelalexv/dregsy/internal/pkg/relays/native"
 	"github.com/xelalexv/dregsy/internal/pkg/relays/skopeo"
+	"github.com/xelalexv/dregsy/internal/pkg/retry"
+	"github.com/xelalexv/dregsy/internal/pkg/state"
+	"github.com/xelalexv/dregsy/internal/pkg/tags"
+	"github.com/xelalexv/dregsy/internal/pkg/watch"
 )
 
 //
 type Relay interface {
-	Prepare() error
+	Prepare(ctx context.Context) error
 	Dispose() error
-	Sync(srcRef, srcAuth string, srcSkiptTLSVerify bool,
+	ListTags(ctx context.Context, ref, auth string, skipTLSVerify bool) (
+		[]string, error)
+	ImageCreated(ctx context.Context, ref, auth string, skipTLSVerify bool) (
+		time.Time, error)
+	ManifestDigest(ctx context.Context, ref, auth string,
+		skipTLSVerify bool) (string, error)
+	DeleteTag(ctx context.Context, ref, auth string, skipTLSVerify bool) error
+	Sync(ctx context.Context, srcRef, srcAuth string, srcSkiptTLSVerify bool,
 		trgtRef, trgtAuth string, trgtSkiptTLSVerify bool,
-		tags []string, verbose bool) error
+		tags []string, policy string, verbose bool) error
+	// SyncDigest syncs tag from the source manifest with the given digest,
+	// rather than from whatever the tag points to in the source by now
+	SyncDigest(ctx context.Context,
+		srcRef, srcAuth string, srcSkipTLSVerify bool,
+		trgtRef, trgtAuth string, trgtSkipTLSVerify bool,
+		tag, digest, policy string, verbose bool) error
+}
+
+// ArtifactRelay is implemented by relays that can copy artifacts related to
+// images, such as signatures, attestations, and SBOMs, by tag or by digest
+type ArtifactRelay interface {
+	CopyArtifact(ctx context.Context,
+		srcRef, srcAuth string, srcSkiptTLSVerify bool,
+		trgtRef, trgtAuth string, trgtSkiptTLSVerify bool, ref string) error
+}
+
+// ExactRelay is a Relay that doesn't necessarily copy images exactly as is by
+// default, but can be asked to do so, with all images of a multi-arch image,
+// and keeping manifest digests. This is needed when copying referrers, which
+// refer to images by digest. If digest is set, the tag is synced from the
+// source manifest with that digest, as with Relay.SyncDigest.
+type ExactRelay interface {
+	SyncExact(ctx context.Context,
+		srcRef, srcAuth string, srcSkipTLSVerify bool,
+		trgtRef, trgtAuth string, trgtSkipTLSVerify bool,
+		tag, digest, policy string, verbose bool) error
+}
+
+// PolicyRelay is a Relay that enforces signature policies, which need to be set
+// up with the relay before they can be used
+type PolicyRelay interface {
+	SetupPolicy(p *skopeo.Policy) error
 }
 
 //
 type Sync struct {
 	relay    Relay
+	registry *native.Client
+	store    state.Store
+	server   *metrics.Server
+	health   *health
+	maxTasks int
+	maxTags  int
 	shutdown chan bool
 	ticks    chan bool
+	reloads  chan chan error
 }
 
 //
@@ -53,15 +110,33 @@ func New(conf *SyncConfig) (*Sync, error) {
 	var relay Relay
 	var err error
 
+	// certs for talking to registries directly, e.g. for fetching signatures,
+	// are taken from where the relay looks for them
+	var certsDir string
+
 	switch conf.Relay {
 
 	case docker.RelayID:
 		relay, err = docker.NewDockerRelay(
 			conf.Docker, log.StandardLogger().WriterLevel(log.DebugLevel))
+		certsDir = docker.DefaultCertsDir
+		if conf.Docker != nil && conf.Docker.CertsDir != "" {
+			certsDir = conf.Docker.CertsDir
+		}
 
 	case skopeo.RelayID:
 		relay = skopeo.NewSkopeoRelay(
 			conf.Skopeo, log.StandardLogger().WriterLevel(log.DebugLevel))
+		if conf.Skopeo != nil {
+			certsDir = conf.Skopeo.CertsDir
+		}
+
+	case native.RelayID:
+		relay = native.NewNativeRelay(
+			conf.Native, log.StandardLogger().WriterLevel(log.DebugLevel))
+		if conf.Native != nil {
+			certsDir = conf.Native.CertsDir
+		}
 
 	default:
 		err = fmt.Errorf("relay type '%s' not supported", conf.Relay)
@@ -71,9 +146,39 @@ func New(conf *SyncConfig) (*Sync, error) {
 		return nil, fmt.Errorf("cannot create sync relay: %v", err)
 	}
 
+	if conf.StateDir != "" {
+		if sync.store, err = state.NewFileStore(conf.StateDir); err != nil {
+			return nil, err
+		}
+	} else {
+		sync.store = state.NewMemoryStore()
+	}
+
+	sync.health = newHealth(conf.Health)
+
+	if conf.Metrics != nil {
+		if sync.server, err = metrics.NewServer(conf.Metrics); err != nil {
+			sync.store.Close()
+			return nil, err
+		}
+		sync.server.Handle("/healthz", sync.health.liveHandler())
+		sync.server.Handle("/readyz", sync.health.readyHandler())
+		sync.server.Start()
+	}
+
 	sync.relay = relay
+	sync.registry = native.NewClient(certsDir)
+	sync.maxTasks = conf.MaxConcurrentTasks
+	if sync.maxTasks == 0 {
+		sync.maxTasks = 1
+	}
+	sync.maxTags = conf.MaxConcurrentTags
+	if sync.maxTags == 0 {
+		sync.maxTags = 1
+	}
 	sync.shutdown = make(chan bool)
 	sync.ticks = make(chan bool, 1)
+	sync.reloads = make(chan chan error)
 
 	return sync, nil
 }
@@ -84,6 +189,16 @@ func (s *Sync) Shutdown() {
 	s.WaitForTick()
 }
 
+// Reload reloads the config from the file it was loaded from, and applies any
+// changes to its tasks. It must only be called while SyncFromConfig is running.
+// If the new config is invalid, an error is returned and the current config is
+// kept.
+func (s *Sync) Reload() error {
+	reply := make(chan error, 1)
+	s.reloads <- reply
+	return <-reply
+}
+
 //
 func (s *Sync) tick() {
 	select {
@@ -100,56 +215,184 @@ func (s *Sync) WaitForTick() {
 //
 func (s *Sync) Dispose() {
 	s.relay.Dispose()
+	s.store.Close()
+	if s.server != nil {
+		s.server.Close()
+	}
 }
 
-//
+// ListTags lists the tags of image ref. If any source or target location in
+// conf points to the registry of ref, its credentials and TLS settings are used.
+func (s *Sync) ListTags(conf *SyncConfig, ref string) ([]string, error) {
+
+	var auth string
+	var skipTLSVerify bool
+
+	reg, _, _ := docker.SplitRef(ref)
+	if l := conf.location(reg); l != nil {
+		if err := l.RefreshAuth(); err != nil {
+			return nil, err
+		}
+		auth = l.Auth
+		skipTLSVerify = l.SkipTLSVerify
+	}
+
+	return s.relay.ListTags(context.Background(), ref, auth, skipTLSVerify)
+}
+
+// SyncFromConfig runs the tasks in conf until all one-off tasks are done and
+// there are no periodic tasks, or until interrupted. If conf has been loaded
+// from a file, it gets reloaded on SIGHUP, and whenever the file changes if
+// watch-config is set.
 func (s *Sync) SyncFromConfig(conf *SyncConfig) error {
 
-	if err := s.relay.Prepare(); err != nil {
+	// an interrupt signal or a flagged shutdown cancels ctx, which aborts any
+	// sync in progress
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(sigs)
+
+	go func() {
+		select {
+		case sig := <-sigs:
+			log.WithField("signal", sig).Info("received signal, stopping ...")
+		case <-s.shutdown:
+			log.Info("shutdown flagged, stopping ...")
+		case <-ctx.Done():
+			return
+		}
+		cancel()
+	}()
+
+	var hups chan os.Signal
+	var changes <-chan string
+
+	if conf.reloadable() {
+		hups = make(chan os.Signal, 1)
+		signal.Notify(hups, syscall.SIGHUP)
+		defer signal.Stop(hups)
+		if conf.WatchConfig {
+			w, err := watch.New(conf.file)
+			if err != nil {
+				return fmt.Errorf("cannot watch config file: %v", err)
+			}
+			defer w.Close()
+			changes = w.Changes()
+		}
+	}
+
+	if err := s.relay.Prepare(ctx); err != nil {
 		return err
 	}
+	s.health.setReady(true)
 
-	// one-off tasks
 	for _, t := range conf.Tasks {
-		if t.Interval == 0 {
-			s.syncTask(t)
+		if err := s.loadState(t); err != nil {
+			return err
+		}
+		if err := s.setupPolicy(t); err != nil {
+			return err
 		}
+		s.health.watch(t)
 	}
 
-	// periodic tasks
-	c := make(chan *Task)
-	ticking := false
-
+	// all tasks go through a worker pool, with one-off tasks queued right
+	// away, and periodic tasks queued whenever they fire
+	sched := newScheduler(conf.Tasks)
 	for _, t := range conf.Tasks {
-		if t.Interval > 0 {
-			t.startTicking(c)
-			ticking = true
-		}
+		sched.start(t)
 	}
 
-	sigs := make(chan os.Signal, 1)
-	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	heartbeat := time.NewTicker(heartbeatInterval)
+	defer heartbeat.Stop()
 
-	for ticking {
+	if sched.ticking() && len(sched.pending) == 0 {
 		log.Info("waiting for next sync task...")
+	}
+
+	for ctx.Err() == nil {
+
+		for len(sched.running) < s.maxTasks {
+			t := sched.next()
+			if t == nil {
+				break
+			}
+			taskCtx, cancelTask := context.WithCancel(ctx)
+			sched.running[t.Name] = cancelTask
+			go func() {
+				s.syncTask(taskCtx, t)
+				cancelTask()
+				sched.finished <- t
+			}()
+		}
+
+		if !sched.ticking() && len(sched.running) == 0 {
+			break
+		}
+
 		select {
-		case t := <-c: // actual task
-			s.syncTask(t)
+		case t := <-sched.fire: // task fired
+			if sched.isScheduled(t.Name) {
+				log.WithField("task", t.Name).Info(
+					"task still pending or running, skipping")
+			} else {
+				sched.pending = append(sched.pending, t)
+			}
+		case t := <-sched.finished:
+			delete(sched.running, t.Name)
 			s.tick() // send a tick
-		case sig := <-sigs: // interrupt signal
-			log.WithField("signal", sig).Info("received signal, stopping ...")
-			ticking = false
-		case <-s.shutdown: // shutdown flagged
-			log.Info("shutdown flagged, stopping ...")
-			ticking = false
-			s.tick() // send a final tick to release shutdown client
+			if sched.ticking() && len(sched.running) == 0 &&
+				len(sched.pending) == 0 {
+				log.Info("waiting for next sync task...")
+			}
+		case <-heartbeat.C:
+			// keep liveness up while idle; while tasks are running, they
+			// signal progress themselves
+			if len(sched.running) == 0 {
+				s.health.beat()
+			}
+		case <-hups:
+			log.Info("received SIGHUP, reloading config")
+			if c, err := s.reloadConfig(conf, sched); err != nil {
+				log.Error(err)
+			} else {
+				conf = c
+			}
+		case <-changes:
+			log.WithField("file", conf.file).Info(
+				"config file changed, reloading config")
+			if c, err := s.reloadConfig(conf, sched); err != nil {
+				log.Error(err)
+			} else {
+				conf = c
+			}
+		case reply := <-s.reloads:
+			if !conf.reloadable() {
+				reply <- errors.New("config cannot be reloaded")
+			} else if c, err := s.reloadConfig(conf, sched); err != nil {
+				reply <- err
+			} else {
+				conf = c
+				reply <- nil
+			}
+		case <-ctx.Done(): // interrupt signal or shutdown flagged
 		}
 	}
 
+	// running tasks get aborted via ctx, wait for them to wrap up
+	for len(sched.running) > 0 {
+		delete(sched.running, (<-sched.finished).Name)
+	}
+	s.tick() // send a final tick to release shutdown client
+
 	log.Debug("stopping tasks")
 	errs := false
-	for _, t := range conf.Tasks {
+	for _, t := range sched.tasks {
 		t.stopTicking()
+		t.stopWatchingMappings()
 		errs = errs || t.failed
 	}
 
@@ -162,27 +405,77 @@ func (s *Sync) SyncFromConfig(conf *SyncConfig) error {
 	return nil
 }
 
-//
-func (s *Sync) syncTask(t *Task) {
+// setupPolicy sets up the signature policy of task t with the relay, if the
+// task has one
+func (s *Sync) setupPolicy(t *Task) error {
+	if r, ok := s.relay.(PolicyRelay); ok && t.Policy != nil {
+		if err := r.SetupPolicy(t.Policy); err != nil {
+			return fmt.Errorf("task '%s': %v", t.Name, err)
+		}
+	}
+	return nil
+}
 
-    if t.MappingFile !=nil{
-        t.refreshMapping()
-    }
+// syncTask runs task t. If ctx gets cancelled or the task's timeout expires
+// while syncing, the sync is aborted, and the tags left incomplete reported.
+func (s *Sync) syncTask(ctx context.Context, t *Task) {
 
-	if t.tooSoon() {
-		log.WithField("task", t.Name).Info("task fired too soon, skipping")
+	// without a watch on the mapping file, it needs to be read before each run
+	if t.MappingFile != nil && !t.isWatchingMappings() {
+		if err := t.refreshMapping(); err != nil {
+			log.Error(err)
+		}
+	}
+
+	if ctx.Err() != nil {
+		log.WithField("task", t.Name).Info("stopping, skipping task")
 		return
 	}
 
+	if t.Timeout != nil {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *t.Timeout)
+		defer cancel()
+	}
+
 	log.WithFields(log.Fields{
 		"task":   t.Name,
 		"source": t.Source.Registry,
 		"target": t.Target.Registry}).Info("syncing task")
 	t.failed = false
+	start := time.Now()
+	defer func() { metrics.TaskRun(t.Name, time.Since(start), t.failed) }()
 
-	for _, m := range t.Mappings {
+	if err := s.loadState(t); err != nil {
+		log.Error(err)
+		t.fail(true)
+		return
+	}
+
+	// tags of the mappings processed in this run; the state of mappings and
+	// tags that are no longer part of the config gets purged
+	keep := make(map[string][]string)
+
+	for _, m := range t.currentMappings() {
 
 		log.WithFields(log.Fields{"from": m.From, "to": m.To}).Info("mapping")
+		s.health.beat()
+		keep[m.key()] = nil
+
+		if ctx.Err() != nil {
+			log.WithFields(log.Fields{"from": m.From, "to": m.To}).Warnf(
+				"sync aborted (%v), skipping mapping", ctx.Err())
+			t.fail(true)
+			continue
+		}
+
+		if reg, until, paused := t.pausedRegistry(); paused {
+			log.WithFields(log.Fields{"from": m.From, "to": m.To}).Warnf(
+				"registry '%s' rate limited until %s, skipping mapping",
+				reg, until.Format(time.RFC3339))
+			t.fail(true)
+			continue
+		}
 
 		src, trgt := t.mappingRefs(m)
 		if err := t.Source.RefreshAuth(); err != nil {
@@ -195,17 +488,369 @@ func (s *Sync) syncTask(t *Task) {
 			t.fail(true)
 			continue
 		}
-		if err := t.ensureTargetExists(trgt); err != nil {
+		tagList, err := s.mappingTags(ctx, t, m, src)
+		if err != nil {
+			t.checkRateLimit(t.Source.Registry, err)
 			log.Error(err)
 			t.fail(true)
 			continue
 		}
-		if err := s.relay.Sync(src, t.Source.Auth, t.Source.SkipTLSVerify,
-			trgt, t.Target.Auth, t.Target.SkipTLSVerify, m.Tags, t.Verbose); err != nil {
-			log.Error(err)
+		keep[m.key()] = append([]string{}, tagList...)
+		if len(tagList) == 0 {
+			log.WithField("from", m.From).Warn("no matching tags, skipping")
+			continue
+		}
+
+		if !s.syncMapping(ctx, t, m, src, trgt, tagList) {
+			continue
+		}
+
+		if t.copiesReferrers(m) && ctx.Err() == nil {
+			s.syncReferrers(ctx, t, m, src, trgt, tagList)
+		}
+
+		if m.Prune && ctx.Err() == nil {
+			s.pruneTags(ctx, t, m, trgt, tagList)
+		}
+	}
+
+	if q := ratelimit.QuotaOf(t.Source.Registry); q != nil {
+		log.WithFields(log.Fields{
+			"registry":  t.Source.Registry,
+			"limit":     q.Limit,
+			"remaining": q.Remaining,
+			"window":    q.Window}).Info("source registry rate limit quota")
+	}
+
+	t.state.Purge(keep)
+	t.state.LastRun = time.Now()
+	t.state.Failed = t.failed
+	if !t.failed {
+		t.state.LastSuccess = t.state.LastRun
+		s.health.succeeded(t)
+	}
+	if err := s.store.Save(t.Name, t.state); err != nil {
+		log.Error(err)
+	}
+}
+
+// syncMapping syncs those tags out of tagList of mapping m in task t which are
+// outdated in the target. It returns false if the mapping could not be
+// processed at all, e.g. because the target repository could not be created.
+// Failures of individual tags are only recorded.
+func (s *Sync) syncMapping(ctx context.Context, t *Task, m *Mapping,
+	src, trgt string, tagList []string) bool {
+
+	outdated, digests := s.outdatedTags(ctx, t, m, src, trgt, tagList)
+	logger := log.WithFields(log.Fields{
+		"to-sync":    len(outdated),
+		"up-to-date": len(tagList) - len(outdated)})
+	if len(outdated) == 0 {
+		logger.Info("all tags up to date")
+		return true
+	}
+	logger.Info("syncing outdated tags")
+
+	if err := retry.Do(ctx, t.targetRetryPolicy(),
+		log.WithField("ref", trgt), func() error {
+			return t.ensureTargetExists(trgt)
+		}); err != nil {
+		log.Error(err)
+		t.fail(true)
+		return false
+	}
+
+	incomplete, deferred := s.syncTags(
+		ctx, t, m, src, trgt, outdated, digests)
+	if len(incomplete) > 0 {
+		log.WithFields(log.Fields{
+			"from": m.From,
+			"to":   m.To,
+			"tags": strings.Join(incomplete, ", ")}).Warnf(
+			"sync aborted (%v), tags left incomplete", ctx.Err())
+	}
+	if len(deferred) > 0 {
+		log.WithFields(log.Fields{
+			"from": m.From,
+			"to":   m.To,
+			"tags": strings.Join(deferred, ", ")}).Warn(
+			"registry rate limited, tags deferred to next run")
+	}
+
+	return true
+}
+
+// syncTags syncs the given tags of mapping m in task t, running up to
+// max-concurrent-tags syncs in parallel. It returns the tags for which the sync
+// was aborted, or not started at all, because ctx was cancelled, and the tags
+// that were deferred because source or target registry got rate limited.
+func (s *Sync) syncTags(ctx context.Context, t *Task, m *Mapping,
+	src, trgt string, tagList []string, digests map[string]string) (
+	incomplete, deferred []string) {
+
+	failed := make([]bool, len(tagList))
+	aborted := make([]bool, len(tagList))
+
+	var wg gosync.WaitGroup
+	slots := make(chan bool, s.maxTags)
+
+	for ix, tag := range tagList {
+		slots <- true
+		if _, _, paused := t.pausedRegistry(); paused {
+			<-slots
 			t.fail(true)
+			deferred = append(deferred, tag)
+			continue
+		}
+		wg.Add(1)
+		go func(ix int, tag string) {
+			defer wg.Done()
+			failed[ix], aborted[ix] = s.syncTag(
+				ctx, t, m, src, trgt, tag, digests[tag])
+			<-slots
+		}(ix, tag)
+	}
+	wg.Wait()
+
+	for ix, tag := range tagList {
+		t.fail(failed[ix])
+		if aborted[ix] {
+			incomplete = append(incomplete, tag)
 		}
 	}
+	return incomplete, deferred
+}
+
+// syncTag syncs a single tag of mapping m in task t, and records the outcome
+// along with srcDigest, the digest of the source manifest determined before.
+// It returns whether the sync failed, and whether it was aborted, or not
+// started at all, because ctx was cancelled.
+func (s *Sync) syncTag(ctx context.Context, t *Task, m *Mapping,
+	src, trgt, tag, srcDigest string) (failed, aborted bool) {
+
+	rec := &state.TagState{
+		SourceDigest: srcDigest,
+		Outcome:      state.OutcomeSynced,
+	}
+
+	defer func() {
+		rec.Time = time.Now()
+		t.state.SetTag(m.key(), tag, rec)
+		metrics.TagOutcome(t.Name, rec.Outcome)
+	}()
+
+	if ctx.Err() != nil {
+		rec.Outcome = state.OutcomeFailed
+		rec.Error = fmt.Sprintf("sync aborted (%v)", ctx.Err())
+		return true, true
+	}
+
+	// once verified, the tag gets synced from the verified digest, so that it
+	// cannot be moved to a different image in the meantime
+	var verified string
+
+	if v := t.verification(m); v != nil {
+		digest, rejected, err := s.verifyTag(ctx, t, v, src, tag, srcDigest)
+		rec.SourceDigest = digest
+		if err != nil {
+			log.WithField("tag", tag).Error(err)
+			rec.Error = err.Error()
+			if rejected {
+				rec.Outcome = state.OutcomePolicyFailed
+				return true, false
+			}
+			rec.Outcome = state.OutcomeFailed
+			return true, ctx.Err() != nil
+		}
+		log.WithFields(log.Fields{"tag": tag, "digest": digest}).Info(
+			"signature verified")
+		verified = digest
+	}
+
+	exact, _ := s.relay.(ExactRelay)
+	if !t.copiesReferrers(m) {
+		exact = nil
+	}
+
+	err := retry.Do(ctx, t.syncRetryPolicy(), log.WithField("tag", tag),
+		func() error {
+			start := time.Now()
+			var err error
+			if exact != nil {
+				err = exact.SyncExact(ctx, src, t.Source.Auth,
+					t.Source.SkipTLSVerify, trgt, t.Target.Auth,
+					t.Target.SkipTLSVerify, tag, verified, t.policyFile(),
+					t.Verbose)
+			} else if verified != "" {
+				err = s.relay.SyncDigest(ctx, src, t.Source.Auth,
+					t.Source.SkipTLSVerify, trgt, t.Target.Auth,
+					t.Target.SkipTLSVerify, tag, verified, t.policyFile(),
+					t.Verbose)
+			} else {
+				err = s.relay.Sync(ctx, src, t.Source.Auth,
+					t.Source.SkipTLSVerify, trgt, t.Target.Auth,
+					t.Target.SkipTLSVerify, []string{tag}, t.policyFile(),
+					t.Verbose)
+			}
+			metrics.TagSynced(t.Name, time.Since(start))
+			s.health.beat()
+			if t.checkSyncRateLimit(err) {
+				// no use in retrying while the registry is paused
+				return retry.Permanent(err)
+			}
+			return err
+		})
+
+	if err != nil {
+		log.WithField("tag", tag).Error(err)
+		rec.Outcome = state.OutcomeFailed
+		rec.Error = err.Error()
+		return true, ctx.Err() != nil
+
+	} else if d, err := s.relay.ManifestDigest(ctx,
+		fmt.Sprintf("%s:%s", trgt, tag), t.Target.Auth,
+		t.Target.SkipTLSVerify); err != nil {
+		log.WithField("tag", tag).Warnf(
+			"cannot get target digest after sync: %v", err)
+	} else {
+		rec.TargetDigest = d
+	}
+
+	return false, false
+}
+
+// loadState loads the recorded state of task t from the store, if not already
+// loaded
+func (s *Sync) loadState(t *Task) error {
+	if t.state != nil {
+		return nil
+	}
+	ts, err := s.store.Task(t.Name)
+	if err != nil {
+		return err
+	}
+	t.state = ts
+	return nil
+}
+
+// mappingTags resolves the tags to sync for mapping m of task t against the
+// source image ref
+func (s *Sync) mappingTags(ctx context.Context, t *Task, m *Mapping,
+	ref string) ([]string, error) {
+
+	// artifacts copied along with the images are not synced as images
+	referrers := t.copiesReferrers(m)
+
+	list, err := m.tagSet.Expand(func() ([]string, error) {
+		all, err := s.relay.ListTags(
+			ctx, ref, t.Source.Auth, t.Source.SkipTLSVerify)
+		if err != nil || !referrers {
+			return all, err
+		}
+		var ret []string
+		for _, tag := range all {
+			if !isReferrerTag(tag) {
+				ret = append(ret, tag)
+			}
+		}
+		return ret, nil
+	})
+	if err != nil || m.KeepLatest == 0 {
+		return list, err
+	}
+
+	return tags.KeepLatest(list, m.KeepLatest, m.KeepLatestBy,
+		func(tag string) (time.Time, error) {
+			return s.relay.ImageCreated(ctx, fmt.Sprintf("%s:%s", ref, tag),
+				t.Source.Auth, t.Source.SkipTLSVerify)
+		})
+}
+
+// outdatedTags returns those tags out of tagList for which the manifest digests
+// of source & target image differ, and which have not been synced before from
+// the same source manifest to the target manifest that's now present. Whenever
+// a digest cannot be retrieved, e.g. because the tag does not exist yet in the
+// target, the tag is considered outdated. Also returned are the source digests
+// of the outdated tags, as far as they could be retrieved.
+func (s *Sync) outdatedTags(ctx context.Context, t *Task, m *Mapping,
+	src, trgt string, tagList []string) ([]string, map[string]string) {
+
+	var ret []string
+	digests := make(map[string]string)
+
+	for _, c := range s.checkTags(ctx, t, m, src, trgt, tagList) {
+
+		if !c.upToDate {
+			ret = append(ret, c.tag)
+			if c.srcDigest != "" {
+				digests[c.tag] = c.srcDigest
+			}
+			continue
+		}
+
+		log.WithFields(log.Fields{"tag": c.tag, "digest": c.srcDigest}).Info(
+			"tag is up to date")
+		t.state.SetTag(m.key(), c.tag, &state.TagState{
+			SourceDigest: c.srcDigest,
+			TargetDigest: c.trgtDigest,
+			Time:         time.Now(),
+			Outcome:      state.OutcomeUpToDate,
+		})
+		metrics.TagOutcome(t.Name, state.OutcomeUpToDate)
+	}
+
+	return ret, digests
+}
+
+// tagCheck is the result of comparing a tag in source & target
+type tagCheck struct {
+	tag        string
+	srcDigest  string
+	trgtDigest string
+	upToDate   bool
+}
+
+// checkTags compares the tags in tagList of mapping m between source & target,
+// without recording anything; see outdatedTags
+func (s *Sync) checkTags(ctx context.Context, t *Task, m *Mapping,
+	src, trgt string, tagList []string) []*tagCheck {
+
+	var ret []*tagCheck
+
+	for _, tag := range tagList {
+
+		c := &tagCheck{tag: tag}
+		ret = append(ret, c)
+		logger := log.WithField("tag", tag)
+
+		// don't bother the source registry while it's paused; the tag gets
+		// deferred when syncing
+		if _, paused := ratelimit.PausedUntil(t.Source.Registry); paused {
+			continue
+		}
+
+		srcDigest, err := s.relay.ManifestDigest(ctx,
+			fmt.Sprintf("%s:%s", src, tag),
+			t.Source.Auth, t.Source.SkipTLSVerify)
+		if err != nil {
+			t.checkRateLimit(t.Source.Registry, err)
+			logger.Debugf("cannot get source digest: %v", err)
+			continue
+		}
+		c.srcDigest = srcDigest
+
+		trgtDigest, err := s.relay.ManifestDigest(ctx,
+			fmt.Sprintf("%s:%s", trgt, tag),
+			t.Target.Auth, t.Target.SkipTLSVerify)
+		if err != nil {
+			logger.Debugf("cannot get target digest: %v", err)
+			continue
+		}
+		c.trgtDigest = trgtDigest
+
+		c.upToDate = srcDigest == trgtDigest ||
+			t.state.IsUpToDate(m.key(), tag, srcDigest, trgtDigest)
+	}
 
-	t.lastTick = time.Now()
+	return ret
 }
@@ -0,0 +1,595 @@
+/*
+	Copyright 2020 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package sync
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"os"
+	gosync "sync"
+	"testing"
+	"time"
+
+	"github.com/xelalexv/dregsy/internal/pkg/ratelimit"
+	"github.com/xelalexv/dregsy/internal/pkg/relays/native"
+	"github.com/xelalexv/dregsy/internal/pkg/retry"
+	"github.com/xelalexv/dregsy/internal/pkg/state"
+	"github.com/xelalexv/dregsy/internal/pkg/test"
+)
+
+//
+func TestSyncTagFilters(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	src := test.NewRegistry(th)
+	defer src.Close()
+	trgt := test.NewRegistry(th)
+	defer trgt.Close()
+
+	src.PushImage("library/busybox",
+		"1.29.1", "1.29.2", "1.30.0", "latest", "nightly-1", "nightly-2")
+
+	s, task := newTestSync(th, src, trgt,
+		&Mapping{
+			From:    "library/busybox",
+			To:      "semver/busybox",
+			Tags:    []string{"semver: >=1.29.2", "latest"},
+			Exclude: []string{"1.30.0"},
+		},
+		&Mapping{
+			From:    "library/busybox",
+			To:      "regex/busybox",
+			Tags:    []string{"regex: ^nightly-"},
+			Exclude: []string{"regex: -2$"},
+		},
+		&Mapping{
+			From:    "library/busybox",
+			To:      "all/busybox",
+			Exclude: []string{"regex: ^nightly-"},
+		},
+		&Mapping{
+			From: "library/busybox",
+			To:   "none/busybox",
+			Tags: []string{"semver: >=2"},
+		})
+
+	s.syncTask(context.Background(), task)
+	th.AssertFalse(task.failed)
+
+	th.AssertEquivalentSlices(
+		[]string{"1.29.2", "latest"}, trgt.ListTags("semver/busybox"))
+	th.AssertEquivalentSlices(
+		[]string{"nightly-1"}, trgt.ListTags("regex/busybox"))
+	th.AssertEquivalentSlices(
+		[]string{"1.29.1", "1.29.2", "1.30.0", "latest"},
+		trgt.ListTags("all/busybox"))
+	th.AssertEquivalentSlices([]string{}, trgt.ListTags("none/busybox"))
+}
+
+//
+func TestSyncKeepLatest(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	src := test.NewRegistry(th)
+	defer src.Close()
+	trgt := test.NewRegistry(th)
+	defer trgt.Close()
+
+	now := time.Now()
+	src.PushImageCreatedAt("library/node", now.Add(-time.Hour), "14.1.0")
+	src.PushImageCreatedAt("library/node", now, "12.20.0", "erbium")
+	src.PushImageCreatedAt("library/node", now.Add(-2*time.Hour),
+		"15.0.1", "latest")
+	src.PushImageCreatedAt("library/node", now.Add(-3*time.Hour), "14.0.0")
+
+	s, task := newTestSync(th, src, trgt,
+		&Mapping{
+			From:       "library/node",
+			To:         "semver/node",
+			KeepLatest: 2,
+		},
+		&Mapping{
+			From:       "library/node",
+			To:         "filtered/node",
+			Tags:       []string{"semver: ^14"},
+			KeepLatest: 1,
+		},
+		&Mapping{
+			From:         "library/node",
+			To:           "created/node",
+			Tags:         []string{"regex: ^[0-9.]+$"},
+			KeepLatest:   2,
+			KeepLatestBy: "created",
+		})
+
+	s.syncTask(context.Background(), task)
+	th.AssertFalse(task.failed)
+
+	th.AssertEquivalentSlices(
+		[]string{"15.0.1", "14.1.0"}, trgt.ListTags("semver/node"))
+	th.AssertEquivalentSlices([]string{"14.1.0"}, trgt.ListTags("filtered/node"))
+	th.AssertEquivalentSlices(
+		[]string{"12.20.0", "14.1.0"}, trgt.ListTags("created/node"))
+}
+
+//
+func TestSyncIncremental(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	src := test.NewRegistry(th)
+	defer src.Close()
+	trgt := test.NewRegistry(th)
+	defer trgt.Close()
+
+	src.PushImage("library/busybox", "1.0", "1.1")
+
+	s, task := newTestSync(th, src, trgt, &Mapping{From: "library/busybox"})
+
+	s.syncTask(context.Background(), task)
+	th.AssertFalse(task.failed)
+	th.AssertEquivalentSlices([]string{"1.0", "1.1"},
+		trgt.ListTags("library/busybox"))
+	puts := trgt.ManifestPuts
+
+	// nothing changed, so nothing gets pushed
+	s.syncTask(context.Background(), task)
+	th.AssertFalse(task.failed)
+	th.AssertEqual(puts, trgt.ManifestPuts)
+
+	// only the changed and the new tag get pushed
+	d := src.PushImage("library/busybox", "1.1", "1.2")
+	s.syncTask(context.Background(), task)
+	th.AssertFalse(task.failed)
+	th.AssertEqual(puts+2, trgt.ManifestPuts)
+	th.AssertEqual(d, trgt.Digest("library/busybox", "1.1"))
+	th.AssertEqual(d, trgt.Digest("library/busybox", "1.2"))
+}
+
+//
+func TestSyncState(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	src := test.NewRegistry(th)
+	defer src.Close()
+	trgt := test.NewRegistry(th)
+	defer trgt.Close()
+
+	dir, err := ioutil.TempDir("", "dregsy-state-")
+	th.AssertNoError(err)
+	defer os.RemoveAll(dir)
+
+	d := src.PushImage("library/busybox", "1.0")
+
+	s, task := newTestSync(th, src, trgt,
+		&Mapping{From: "library/busybox", Tags: []string{"1.0", "2.0"}})
+	s.store, err = state.NewFileStore(dir)
+	th.AssertNoError(err)
+
+	s.syncTask(context.Background(), task)
+	th.AssertTrue(task.failed)
+
+	// simulate restart
+	s, task = newTestSync(th, src, trgt,
+		&Mapping{From: "library/busybox", Tags: []string{"1.0", "2.0"}})
+	s.store, err = state.NewFileStore(dir)
+	th.AssertNoError(err)
+	th.AssertNoError(s.loadState(task))
+
+	th.AssertTrue(task.state.Failed)
+	th.AssertFalse(task.state.LastRun.IsZero())
+	th.AssertTrue(task.state.LastSuccess.IsZero())
+
+	key := task.Mappings[0].key()
+	rec := task.state.Tag(key, "1.0")
+	th.AssertNotNil(rec)
+	th.AssertEqual(state.OutcomeSynced, rec.Outcome)
+	th.AssertEqual(d, rec.SourceDigest)
+	th.AssertEqual(d, rec.TargetDigest)
+
+	rec = task.state.Tag(key, "2.0")
+	th.AssertNotNil(rec)
+	th.AssertEqual(state.OutcomeFailed, rec.Outcome)
+	th.AssertNotEqual("", rec.Error)
+
+	// a manifest that was altered during sync is considered up to date, as
+	// long as neither source nor target changed since
+	task.state.SetTag(key, "1.0", &state.TagState{
+		SourceDigest: d,
+		TargetDigest: "sha256:altered",
+		Outcome:      state.OutcomeSynced,
+	})
+	outdated, _ := s.outdatedTags(context.Background(), task, task.Mappings[0],
+		src.Host()+"/library/busybox", trgt.Host()+"/library/busybox",
+		[]string{"1.0"})
+	th.AssertEqual(0, len(outdated))
+}
+
+//
+func TestSyncStatePurge(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	src := test.NewRegistry(th)
+	defer src.Close()
+	trgt := test.NewRegistry(th)
+	defer trgt.Close()
+
+	dir, err := ioutil.TempDir("", "dregsy-state-")
+	th.AssertNoError(err)
+	defer os.RemoveAll(dir)
+
+	src.PushImage("library/busybox", "1.0", "2.0")
+	src.PushImage("library/alpine", "1.0")
+
+	busybox := &Mapping{From: "library/busybox", Tags: []string{"1.0", "2.0"}}
+	alpine := &Mapping{From: "library/alpine", Tags: []string{"1.0"}}
+	s, task := newTestSync(th, src, trgt, busybox, alpine)
+	s.store, err = state.NewFileStore(dir)
+	th.AssertNoError(err)
+
+	s.syncTask(context.Background(), task)
+	th.AssertFalse(task.failed)
+	th.AssertNotNil(task.state.Tag(busybox.key(), "1.0"))
+	th.AssertNotNil(task.state.Tag(alpine.key(), "1.0"))
+
+	// restart with a tag and a mapping removed from the config
+	busybox = &Mapping{From: "library/busybox", Tags: []string{"2.0"}}
+	s, task = newTestSync(th, src, trgt, busybox)
+	s.store, err = state.NewFileStore(dir)
+	th.AssertNoError(err)
+
+	s.syncTask(context.Background(), task)
+	th.AssertFalse(task.failed)
+
+	ts, err := s.store.Task(task.Name)
+	th.AssertNoError(err)
+	th.AssertEqual(1, len(ts.Mappings))
+	th.AssertNil(ts.Tag(busybox.key(), "1.0"))
+	th.AssertNotNil(ts.Tag(busybox.key(), "2.0"))
+	th.AssertNil(ts.Tag(alpine.key(), "1.0"))
+}
+
+//
+func TestSyncAborted(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	src := test.NewRegistry(th)
+	defer src.Close()
+	trgt := test.NewRegistry(th)
+	defer trgt.Close()
+
+	src.PushImage("library/busybox", "1.0", "1.1", "1.2")
+	src.PushImage("library/alpine", "3.12")
+
+	s, task := newTestSync(th, src, trgt,
+		&Mapping{From: "library/busybox"}, &Mapping{From: "library/alpine"})
+
+	// cancel after the first tag has been synced
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	relay := &cancellingRelay{Relay: s.relay, cancel: cancel}
+	s.relay = relay
+
+	s.syncTask(ctx, task)
+	th.AssertTrue(task.failed)
+	th.AssertEqual(1, relay.syncs)
+	th.AssertEquivalentSlices([]string{"1.0"}, trgt.ListTags("library/busybox"))
+	th.AssertEquivalentSlices([]string{}, trgt.ListTags("library/alpine"))
+
+	key := task.Mappings[0].key()
+	th.AssertEqual(state.OutcomeSynced, task.state.Tag(key, "1.0").Outcome)
+	for _, tag := range []string{"1.1", "1.2"} {
+		rec := task.state.Tag(key, tag)
+		th.AssertEqual(state.OutcomeFailed, rec.Outcome)
+		th.AssertEqual("sync aborted (context canceled)", rec.Error)
+	}
+	th.AssertNil(task.state.Tag(task.Mappings[1].key(), "3.12"))
+
+	// task timeout
+	timeout := time.Nanosecond
+	s, task = newTestSync(th, src, trgt, &Mapping{From: "library/alpine"})
+	task.Timeout = &timeout
+
+	s.syncTask(context.Background(), task)
+	th.AssertTrue(task.failed)
+	th.AssertEquivalentSlices([]string{}, trgt.ListTags("library/alpine"))
+}
+
+//
+func TestSyncConcurrentTags(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	src := test.NewRegistry(th)
+	defer src.Close()
+	trgt := test.NewRegistry(th)
+	defer trgt.Close()
+
+	src.PushImage("library/busybox", "1.0", "1.1", "1.2", "1.3", "1.4")
+
+	s, task := newTestSync(th, src, trgt, &Mapping{From: "library/busybox"})
+	s.maxTags = 3
+	relay := &trackingRelay{Relay: s.relay, delay: 100 * time.Millisecond}
+	s.relay = relay
+
+	s.syncTask(context.Background(), task)
+	th.AssertFalse(task.failed)
+	th.AssertEquivalentSlices([]string{"1.0", "1.1", "1.2", "1.3", "1.4"},
+		trgt.ListTags("library/busybox"))
+	th.AssertEqual(3, relay.max)
+}
+
+//
+func TestSyncConcurrentTasks(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	src := test.NewRegistry(th)
+	defer src.Close()
+	trgt := test.NewRegistry(th)
+	defer trgt.Close()
+
+	src.PushImage("library/busybox", "1.0")
+	src.PushImage("library/alpine", "3.12")
+
+	var tasks []*Task
+	for _, repo := range []string{"library/busybox", "library/alpine"} {
+		_, task := newTestSync(th, src, trgt, &Mapping{From: repo})
+		task.Name = repo
+		tasks = append(tasks, task)
+	}
+
+	conf := &SyncConfig{
+		Relay:              native.RelayID,
+		MaxConcurrentTasks: 2,
+		Tasks:              tasks,
+	}
+	s, err := New(conf)
+	th.AssertNoError(err)
+	relay := &trackingRelay{Relay: s.relay, delay: 100 * time.Millisecond}
+	s.relay = relay
+
+	th.AssertNoError(s.SyncFromConfig(conf))
+	th.AssertEquivalentSlices([]string{"1.0"}, trgt.ListTags("library/busybox"))
+	th.AssertEquivalentSlices([]string{"3.12"}, trgt.ListTags("library/alpine"))
+	th.AssertEqual(2, relay.max)
+}
+
+//
+func TestSyncRetry(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	src := test.NewRegistry(th)
+	defer src.Close()
+	trgt := test.NewRegistry(th)
+	defer trgt.Close()
+
+	src.PushImage("library/busybox", "1.0", "1.1")
+
+	s, task := newTestSync(th, src, trgt,
+		&Mapping{From: "library/busybox", Tags: []string{"1.0"}})
+	task.Retry = &retry.Policy{Attempts: 3, InitialBackoff: time.Millisecond}
+	th.AssertNoError(task.Retry.Validate())
+	relay := &trackingRelay{Relay: s.relay}
+	s.relay = relay
+
+	// transient errors are retried
+	trgt.FailNext(http.MethodPut, 1, http.StatusServiceUnavailable)
+	s.syncTask(context.Background(), task)
+	th.AssertFalse(task.failed)
+	th.AssertEqual(2, relay.total)
+	th.AssertEquivalentSlices([]string{"1.0"}, trgt.ListTags("library/busybox"))
+
+	// permanent errors are not
+	task.Mappings[0].Tags = []string{"1.1"}
+	th.AssertNoError(task.validateMappings())
+	relay.total = 0
+	trgt.FailNext(http.MethodPut, 1, http.StatusForbidden)
+	s.syncTask(context.Background(), task)
+	th.AssertTrue(task.failed)
+	th.AssertEqual(1, relay.total)
+	th.AssertEquivalentSlices([]string{"1.0"}, trgt.ListTags("library/busybox"))
+}
+
+//
+func TestSyncRateLimit(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	src := test.NewRegistry(th)
+	defer src.Close()
+	trgt := test.NewRegistry(th)
+	defer trgt.Close()
+
+	src.PushImage("library/busybox", "1.0", "1.1", "1.2")
+	src.SetPullQuota(1)
+
+	s, task := newTestSync(th, src, trgt, &Mapping{From: "library/busybox",
+		Tags: []string{"1.0", "1.1", "1.2"}})
+	task.Retry = &retry.Policy{Attempts: 3, InitialBackoff: time.Millisecond}
+	th.AssertNoError(task.Retry.Validate())
+	relay := &trackingRelay{Relay: s.relay}
+	s.relay = relay
+
+	// first tag uses up the quota, second one is rate limited and not retried,
+	// third one deferred
+	s.syncTask(context.Background(), task)
+	th.AssertTrue(task.failed)
+	th.AssertEqual(2, relay.total)
+	th.AssertEquivalentSlices([]string{"1.0"}, trgt.ListTags("library/busybox"))
+
+	_, paused := ratelimit.PausedUntil(src.Host())
+	th.AssertTrue(paused)
+	q := ratelimit.QuotaOf(src.Host())
+	th.AssertNotNil(q)
+	th.AssertEqual(1, q.Limit)
+	th.AssertEqual(0, q.Remaining)
+
+	key := task.Mappings[0].key()
+	th.AssertEqual(state.OutcomeSynced, task.state.Tag(key, "1.0").Outcome)
+	th.AssertEqual(state.OutcomeFailed, task.state.Tag(key, "1.1").Outcome)
+	th.AssertNil(task.state.Tag(key, "1.2"))
+
+	// while the registry is paused, the mapping is skipped
+	src.SetPullQuota(0)
+	s.syncTask(context.Background(), task)
+	th.AssertTrue(task.failed)
+	th.AssertEqual(2, relay.total)
+	th.AssertEquivalentSlices([]string{"1.0"}, trgt.ListTags("library/busybox"))
+}
+
+// TestSyncRateLimitTarget checks that only the target registry gets paused when
+// it's the one that exceeded its rate limit
+func TestSyncRateLimitTarget(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	src := test.NewRegistry(th)
+	defer src.Close()
+	trgt := test.NewRegistry(th)
+	defer trgt.Close()
+
+	src.PushImage("library/busybox", "1.0", "1.1")
+	trgt.FailNext(http.MethodPut, 1, http.StatusTooManyRequests)
+
+	s, task := newTestSync(th, src, trgt, &Mapping{From: "library/busybox",
+		Tags: []string{"1.0", "1.1"}})
+	task.Retry = &retry.Policy{Attempts: 3, InitialBackoff: time.Millisecond}
+	th.AssertNoError(task.Retry.Validate())
+	relay := &trackingRelay{Relay: s.relay}
+	s.relay = relay
+
+	// pushing the first tag runs into the rate limit, second one is deferred
+	s.syncTask(context.Background(), task)
+	th.AssertTrue(task.failed)
+	th.AssertEqual(1, relay.total)
+	th.AssertNil(task.state.Tag(task.Mappings[0].key(), "1.1"))
+
+	_, paused := ratelimit.PausedUntil(trgt.Host())
+	th.AssertTrue(paused)
+	_, paused = ratelimit.PausedUntil(src.Host())
+	th.AssertFalse(paused)
+}
+
+//
+func TestListTags(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	reg := test.NewAuthRegistry(th, "anonymous", "anonymous")
+	defer reg.Close()
+	reg.PushImage("library/busybox", "1.0", "1.1")
+
+	s, err := New(&SyncConfig{Relay: native.RelayID})
+	th.AssertNoError(err)
+
+	ref := reg.Host() + "/library/busybox"
+
+	// no location for the registry, so no credentials
+	_, err = s.ListTags(&SyncConfig{}, ref)
+	th.AssertError(err, "UNAUTHORIZED")
+
+	// {"username": "anonymous", "password": "anonymous"}
+	auth := "eyJ1c2VybmFtZSI6ICJhbm9ueW1vdXMiLCAicGFzc3dvcmQiOiAiYW5vbnltb3VzIn0K"
+	conf := &SyncConfig{Tasks: []*Task{{
+		Source: &Location{Registry: "registry.acme.com"},
+		Target: &Location{Registry: reg.Host(), Auth: auth},
+	}}}
+	tags, err := s.ListTags(conf, ref)
+	th.AssertNoError(err)
+	th.AssertEquivalentSlices([]string{"1.0", "1.1"}, tags)
+}
+
+// trackingRelay tracks the total and maximum number of concurrent syncs; each
+// sync is delayed, to make sure concurrent syncs overlap
+type trackingRelay struct {
+	Relay
+	delay   time.Duration
+	mutex   gosync.Mutex
+	current int
+	max     int
+	total   int
+}
+
+//
+func (r *trackingRelay) Sync(ctx context.Context,
+	srcRef, srcAuth string, srcSkipTLSVerify bool,
+	trgtRef, trgtAuth string, trgtSkipTLSVerify bool,
+	tags []string, policy string, verbose bool) error {
+
+	r.mutex.Lock()
+	r.total++
+	r.current++
+	if r.current > r.max {
+		r.max = r.current
+	}
+	r.mutex.Unlock()
+
+	time.Sleep(r.delay)
+	err := r.Relay.Sync(ctx, srcRef, srcAuth, srcSkipTLSVerify,
+		trgtRef, trgtAuth, trgtSkipTLSVerify, tags, policy, verbose)
+
+	r.mutex.Lock()
+	r.current--
+	r.mutex.Unlock()
+
+	return err
+}
+
+// cancellingRelay cancels a context after the first tag has been synced
+type cancellingRelay struct {
+	Relay
+	cancel func()
+	syncs  int
+}
+
+//
+func (r *cancellingRelay) Sync(ctx context.Context,
+	srcRef, srcAuth string, srcSkipTLSVerify bool,
+	trgtRef, trgtAuth string, trgtSkipTLSVerify bool,
+	tags []string, policy string, verbose bool) error {
+	err := r.Relay.Sync(ctx, srcRef, srcAuth, srcSkipTLSVerify,
+		trgtRef, trgtAuth, trgtSkipTLSVerify, tags, policy, verbose)
+	r.syncs++
+	r.cancel()
+	return err
+}
+
+//
+func newTestSync(th *test.TestHelper, src, trgt *test.Registry,
+	mappings ...*Mapping) (*Sync, *Task) {
+
+	task := &Task{
+		Name:     "test",
+		Source:   &Location{Registry: src.Host()},
+		Target:   &Location{Registry: trgt.Host()},
+		Mappings: mappings,
+	}
+	th.AssertNoError(task.validate())
+
+	s, err := New(&SyncConfig{Relay: native.RelayID})
+	th.AssertNoError(err)
+
+	return s, task
+}
@@ -19,38 +19,59 @@ package sync
 import (
 	"errors"
 	"fmt"
-	"io/ioutil"
 	"strings"
+	gosync "sync"
 	"time"
 
-    "gopkg.in/yaml.v2"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/ecr"
 	log "github.com/sirupsen/logrus"
 
+	"github.com/xelalexv/dregsy/internal/pkg/ratelimit"
 	"github.com/xelalexv/dregsy/internal/pkg/relays/docker"
+	"github.com/xelalexv/dregsy/internal/pkg/relays/skopeo"
+	"github.com/xelalexv/dregsy/internal/pkg/retry"
+	"github.com/xelalexv/dregsy/internal/pkg/state"
+	"github.com/xelalexv/dregsy/internal/pkg/verify"
+	"github.com/xelalexv/dregsy/internal/pkg/watch"
 )
 
+//
 type MappingList struct {
-    Mappings []*Mapping `mappings`
+	Mappings []*Mapping `yaml:"mappings"`
 }
 
 //
 type Task struct {
-	Name     string     `yaml:"name"`
-	Interval int        `yaml:"interval"`
-	Source   *Location  `yaml:"source"`
-	Target   *Location  `yaml:"target"`
-	MappingFile *string  `yaml:"mappings_file"`
-	Mappings []*Mapping `yaml:"mappings"`
-	Verbose  bool       `yaml:"verbose"`
+	Name        string         `yaml:"name"`
+	Interval    int            `yaml:"interval"`
+	Schedule    string         `yaml:"schedule"`
+	TimeZone    string         `yaml:"time-zone"`
+	Jitter      *time.Duration `yaml:"jitter"`
+	Source      *Location      `yaml:"source"`
+	Target      *Location      `yaml:"target"`
+	MappingFile *string        `yaml:"mappings_file"`
+	Mappings    []*Mapping     `yaml:"mappings"`
+	Verbose     bool           `yaml:"verbose"`
+	MaxAge      *time.Duration `yaml:"max-age"`
+	Timeout     *time.Duration `yaml:"timeout"`
+	Retry       *retry.Policy  `yaml:"retry"`
+	Policy      *skopeo.Policy `yaml:"policy"`
+	Verify      *verify.Config `yaml:"verify"`
+	//
+	CopyReferrers bool `yaml:"copy-referrers"`
 
 	//
-	ticker   *time.Ticker
-	lastTick time.Time
-	failed   bool
+	schedule    *schedule
+	failed      bool
+	fingerprint string // of the settings as loaded
+	//
+	mutex   gosync.Mutex // guards mappings & watcher
+	watcher *watch.Watcher
+	//
+	state *state.TaskState
 
 	//
 	exit chan bool
@@ -73,6 +94,38 @@ func (t *Task) validate() error {
 		return errors.New("task interval needs to be 0 or a positive integer")
 	}
 
+	if err := t.validateSchedule(); err != nil {
+		return err
+	}
+
+	if t.MaxAge != nil && *t.MaxAge <= 0 {
+		return fmt.Errorf(
+			"max-age of task '%s' needs to be a positive duration", t.Name)
+	}
+
+	if t.Timeout != nil && *t.Timeout <= 0 {
+		return fmt.Errorf(
+			"timeout of task '%s' needs to be a positive duration", t.Name)
+	}
+
+	if t.Retry != nil {
+		if err := t.Retry.Validate(); err != nil {
+			return fmt.Errorf("task '%s': %v", t.Name, err)
+		}
+	}
+
+	if t.Policy != nil {
+		if err := t.Policy.Validate(); err != nil {
+			return fmt.Errorf("task '%s': %v", t.Name, err)
+		}
+	}
+
+	if t.Verify != nil {
+		if err := t.Verify.Validate(); err != nil {
+			return fmt.Errorf("task '%s': %v", t.Name, err)
+		}
+	}
+
 	if err := t.Source.validate(); err != nil {
 		return fmt.Errorf(
 			"source registry in task '%s' invalid: %v", t.Name, err)
@@ -83,117 +136,241 @@ func (t *Task) validate() error {
 			"target registry in task '%s' invalid: %v", t.Name, err)
 	}
 
-
-    if t.MappingFile != nil {
-        err := t.refreshMapping()
-        if err != nil {
-            return fmt.Errorf("failed to procure mappings", t.Name, err)
-        }
-    } else{
-        t.validateMappings()
-    }
+	if t.MappingFile != nil {
+		mappings, err := t.loadMappings()
+		if err != nil {
+			return fmt.Errorf(
+				"failed to procure mappings for task '%s': %v", t.Name, err)
+		}
+		t.Mappings = mappings
+	} else if err := t.validateMappings(); err != nil {
+		return err
+	}
 
 	return nil
 }
 
-func(t *Task) validateMappings() error {
-    for _, m := range t.Mappings {
-        if err := m.validate(); err != nil {
-
-            return fmt.Errorf("error parsing mappings '%s': %v", m.From, err)
-        }
-        m.From = normalizePath(m.From)
-        m.To = normalizePath(m.To)
-    }
-    return nil
-}
-
-func(t *Task) refreshMapping() error {
-
-    logger := log.WithField("task", t.Name)
-
-    mappingFile := *t.MappingFile
-
-    data, err := ioutil.ReadFile(mappingFile)
+// validateSchedule sets up the schedule of the task, if it's periodic, i.e. has
+// an interval or a schedule
+func (t *Task) validateSchedule() error {
 
-    if err != nil{
-        return fmt.Errorf("issue with mapping file  '%s': %v", mappingFile, err)
-    }
+	spec := t.Schedule
 
-    maplist := &MappingList{}
-
-    if err = yaml.Unmarshal(data, maplist); err != nil {
-        return fmt.Errorf("error parsing mappings config file '%s': %v", mappingFile, err)
-    }
+	if t.Interval > 0 {
+		if spec != "" {
+			return fmt.Errorf(
+				"task '%s' can have either an interval or a schedule, not both",
+				t.Name)
+		}
+		spec = fmt.Sprintf("%ds", t.Interval)
+	}
 
-    t.Mappings = make([]*Mapping, len(maplist.Mappings))
+	if spec == "" {
+		if t.TimeZone != "" || t.Jitter != nil {
+			return fmt.Errorf(
+				"task '%s' has time-zone or jitter, but no schedule", t.Name)
+		}
+		t.schedule = nil
+		return nil
+	}
 
-    //t.Mappings = maplist.Mappings
+	var jitter time.Duration
+	if t.Jitter != nil {
+		jitter = *t.Jitter
+	}
 
-    copy(t.Mappings, maplist.Mappings)
+	sched, err := parseSchedule(spec, t.TimeZone, jitter)
+	if err != nil {
+		return fmt.Errorf("schedule of task '%s' invalid: %v", t.Name, err)
+	}
+	t.schedule = sched
+	return nil
+}
 
-    logger.Info("refreshed task list from file '%s'", mappingFile)
+//
+func (t *Task) validateMappings() error {
+	return validateMappings(t.Mappings)
+}
 
-    t.validateMappings()
+//
+func validateMappings(mappings []*Mapping) error {
+	for _, m := range mappings {
+		if err := m.validate(); err != nil {
+			return fmt.Errorf("error parsing mappings '%s': %v", m.From, err)
+		}
+		m.From = normalizePath(m.From)
+		m.To = normalizePath(m.To)
+	}
+	return nil
+}
 
-    return nil
+// isPeriodic determines whether the task has a schedule by which it's run
+// repeatedly, as opposed to a one-off task
+func (t *Task) isPeriodic() bool {
+	return t.schedule != nil
 }
 
-//
+// startTicking starts firing the task into c according to its schedule. If
+// there is a recorded last run, e.g. from before a restart, the first firing
+// is at the next activation after that.
 func (t *Task) startTicking(c chan *Task) {
 
 	logger := log.WithField("task", t.Name)
 	logger.Debug("task starts ticking")
 
-	i := time.Duration(t.Interval)
-	if i == 0 {
-		i = 3
+	var lastRun time.Time
+	if t.state != nil {
+		lastRun = t.state.LastRun
 	}
 
-	t.ticker = time.NewTicker(time.Second * i)
-	t.lastTick = time.Now().Add(time.Second * i * (-2))
+	now := time.Now()
+	next := t.schedule.first(now, lastRun)
+	if next.Sub(now) > time.Second {
+		logger.WithField("last-run", lastRun).Infof(
+			"first run scheduled for %s", next.Format(time.RFC3339))
+	}
 
 	t.exit = make(chan bool, 1)
 	t.done = make(chan bool, 1)
 
 	go func() {
 
-		logger.Debug("sending initial fire")
-		c <- t
+		defer close(t.done)
 
 		for {
+			timer := time.NewTimer(time.Until(next))
 			select {
-			case <-t.ticker.C:
-				logger.Debug("task firing")
-				c <- t
+			case <-timer.C:
 			case <-t.exit:
+				timer.Stop()
+				logger.Debug("task exiting")
+				return
+			}
+
+			logger.Debug("task firing")
+			if !t.fire(c) {
 				logger.Debug("task exiting")
-				close(t.done)
 				return
 			}
+
+			next = t.schedule.next(time.Now())
+			logger.Debugf("next run scheduled for %s", next.Format(time.RFC3339))
 		}
 	}()
 }
 
-//
-func (t *Task) tooSoon() bool {
-	i := time.Duration(t.Interval)
-	if i == 0 {
+// fire sends t to c, unless the task is told to exit while waiting for the
+// send to complete; returns false in the latter case
+func (t *Task) fire(c chan *Task) bool {
+	select {
+	case c <- t:
+		return true
+	case <-t.exit:
 		return false
 	}
-	return time.Now().Before(t.lastTick.Add(time.Second * i / 2))
 }
 
 //
 func (t *Task) stopTicking() {
-	if t.ticker != nil {
-		t.ticker.Stop()
+	if t.exit != nil {
 		close(t.exit)
 		<-t.done
+		t.exit = nil
 	}
 	log.WithField("task", t.Name).Debug("task exited")
 }
 
+// checkRateLimit pauses registry if err, received from talking to just that
+// registry, says that its rate limit was exceeded, and returns whether that's
+// the case
+func (t *Task) checkRateLimit(registry string, err error) bool {
+	if !retry.IsRateLimited(err) {
+		return false
+	}
+	ratelimit.Exceeded(registry, 0)
+	return true
+}
+
+// checkSyncRateLimit checks whether err, received from syncing an image, says
+// that the rate limit of source or target registry was exceeded. Since a sync
+// talks to both, only the registry the relay attributed the error to gets
+// paused. The native relay already pauses a registry when it receives a 429
+// response. Returned is whether source or target registry is paused now.
+func (t *Task) checkSyncRateLimit(err error) bool {
+	if !retry.IsRateLimited(err) {
+		return false
+	}
+	if reg := ratelimit.RegistryOf(err); reg != "" {
+		ratelimit.Exceeded(reg, 0)
+	}
+	_, _, paused := t.pausedRegistry()
+	return paused
+}
+
+// pausedRegistry returns the source or target registry of the task if it's
+// paused because its rate limit was exceeded, along with the time until which
+// it's paused
+func (t *Task) pausedRegistry() (registry string, until time.Time,
+	paused bool) {
+	for _, r := range []string{t.Source.Registry, t.Target.Registry} {
+		if until, paused := ratelimit.PausedUntil(r); paused {
+			return r, until, true
+		}
+	}
+	return "", time.Time{}, false
+}
+
+// policyFile returns the signature policy file of the task, or an empty string
+// if the task doesn't have its own policy
+func (t *Task) policyFile() string {
+	if t.Policy == nil {
+		return ""
+	}
+	return t.Policy.File
+}
+
+// verification returns the signature verification setting for mapping m of the
+// task, which is the one of the mapping if set, or else the one of the task
+func (t *Task) verification(m *Mapping) *verify.Config {
+	if m.Verify != nil {
+		return m.Verify
+	}
+	return t.Verify
+}
+
+// copiesReferrers determines whether the artifacts referring to the images of
+// mapping m get copied, which is the setting of the mapping if set, or else
+// the one of the task
+func (t *Task) copiesReferrers(m *Mapping) bool {
+	if m.CopyReferrers != nil {
+		return *m.CopyReferrers
+	}
+	return t.CopyReferrers
+}
+
+// syncRetryPolicy returns the retry policy for syncing tags, which is the one
+// of the task if set, or else the one of target or source location
+func (t *Task) syncRetryPolicy() *retry.Policy {
+	for _, p := range []*retry.Policy{t.Retry, t.Target.Retry, t.Source.Retry} {
+		if p != nil {
+			return p
+		}
+	}
+	return retry.DefaultPolicy()
+}
+
+// targetRetryPolicy returns the retry policy for operations on the target
+// registry alone, which is the one of the target location if set, or else the
+// one of the task
+func (t *Task) targetRetryPolicy() *retry.Policy {
+	for _, p := range []*retry.Policy{t.Target.Retry, t.Retry} {
+		if p != nil {
+			return p
+		}
+	}
+	return retry.DefaultPolicy()
+}
+
 //
 func (t *Task) fail(f bool) {
 	t.failed = t.failed || f
@@ -208,59 +385,135 @@ func (t *Task) mappingRefs(m *Mapping) (from, to string) {
 	return from, to
 }
 
-//
+// ensureTargetExists creates target repository ref if it does not exist yet;
+// this is only necessary for ECR, all other registries create repositories on
+// push
 func (t *Task) ensureTargetExists(ref string) error {
 
-	isEcr, region, account := t.Target.GetECR()
+	exists, err := t.targetExists(ref)
+	if err != nil || exists {
+		return err
+	}
 
-	if isEcr {
+	_, region, _ := t.Target.GetECR()
+	_, path, _ := docker.SplitRef(ref)
 
-		_, path, _ := docker.SplitRef(ref)
-		if len(path) == 0 {
-			return nil
-		}
+	sess, err := session.NewSession()
+	if err != nil {
+		return err
+	}
 
-		sess, err := session.NewSession()
-		if err != nil {
-			return err
-		}
+	svc := ecr.New(sess, &aws.Config{
+		Region: aws.String(region),
+	})
 
-		svc := ecr.New(sess, &aws.Config{
-			Region: aws.String(region),
-		})
+	log.WithField("ref", ref).Info("creating target")
+	inpCrea := &ecr.CreateRepositoryInput{
+		RepositoryName: aws.String(path),
+	}
 
-		inpDescr := &ecr.DescribeRepositoriesInput{
-			RegistryId:      aws.String(account),
-			RepositoryNames: []*string{aws.String(path)},
-		}
+	if _, err := svc.CreateRepository(inpCrea); err != nil {
+		return err
+	}
 
-		out, err := svc.DescribeRepositories(inpDescr)
-		if err == nil && len(out.Repositories) > 0 {
-			log.WithField("ref", ref).Info("target already exists")
-			return nil
-		}
+	return nil
+}
 
-		if err != nil {
-			if aerr, ok := err.(awserr.Error); ok {
-				if aerr.Code() != ecr.ErrCodeRepositoryNotFoundException {
-					return err
-				}
-			} else {
-				return err
+// targetExists checks whether target repository ref exists. This is only
+// checked for ECR, for all other registries true is returned.
+func (t *Task) targetExists(ref string) (bool, error) {
+
+	isEcr, region, account := t.Target.GetECR()
+	if !isEcr {
+		return true, nil
+	}
+
+	_, path, _ := docker.SplitRef(ref)
+	if len(path) == 0 {
+		return true, nil
+	}
+
+	sess, err := session.NewSession()
+	if err != nil {
+		return false, err
+	}
+
+	svc := ecr.New(sess, &aws.Config{
+		Region: aws.String(region),
+	})
+
+	inpDescr := &ecr.DescribeRepositoriesInput{
+		RegistryId:      aws.String(account),
+		RepositoryNames: []*string{aws.String(path)},
+	}
+
+	out, err := svc.DescribeRepositories(inpDescr)
+	if err == nil && len(out.Repositories) > 0 {
+		log.WithField("ref", ref).Info("target already exists")
+		return true, nil
+	}
+
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok {
+			if aerr.Code() != ecr.ErrCodeRepositoryNotFoundException {
+				return false, err
 			}
+		} else {
+			return false, err
 		}
+	}
 
-		log.WithField("ref", ref).Info("creating target")
-		inpCrea := &ecr.CreateRepositoryInput{
-			RepositoryName: aws.String(path),
-		}
+	return false, nil
+}
+
+// deleteFromECR removes the given tags from ECR target repository ref. Unlike
+// with a plain registry, this only removes the tags, and ECR deletes an image
+// once it has no tags left. Returned are the tags that were removed.
+func (t *Task) deleteFromECR(ref string, tags []string) ([]string, error) {
+
+	_, region, account := t.Target.GetECR()
+	_, path, _ := docker.SplitRef(ref)
+
+	sess, err := session.NewSession()
+	if err != nil {
+		return nil, err
+	}
 
-		if _, err := svc.CreateRepository(inpCrea); err != nil {
-			return err
+	svc := ecr.New(sess, &aws.Config{
+		Region: aws.String(region),
+	})
+
+	var ids []*ecr.ImageIdentifier
+	for _, tag := range tags {
+		ids = append(ids, &ecr.ImageIdentifier{ImageTag: aws.String(tag)})
+	}
+
+	out, err := svc.BatchDeleteImage(&ecr.BatchDeleteImageInput{
+		RegistryId:     aws.String(account),
+		RepositoryName: aws.String(path),
+		ImageIds:       ids,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var deleted []string
+	for _, id := range out.ImageIds {
+		deleted = append(deleted, aws.StringValue(id.ImageTag))
+	}
+
+	if len(out.Failures) > 0 {
+		var msgs []string
+		for _, f := range out.Failures {
+			msgs = append(msgs, fmt.Sprintf("%s: %s",
+				aws.StringValue(f.ImageId.ImageTag),
+				aws.StringValue(f.FailureReason)))
 		}
+		return deleted, fmt.Errorf("cannot delete tags from '%s': %s",
+			ref, strings.Join(msgs, ", "))
 	}
 
-	return nil
+	return deleted, nil
 }
 
 //
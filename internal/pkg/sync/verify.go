@@ -0,0 +1,65 @@
+/*
+	Copyright 2020 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package sync
+
+import (
+	"context"
+	"fmt"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/xelalexv/dregsy/internal/pkg/retry"
+	"github.com/xelalexv/dregsy/internal/pkg/verify"
+)
+
+// verifyTag checks the cosign signatures of tag in source image src against the
+// keys in v. The signatures are always fetched directly from the source
+// registry, regardless of relay. srcDigest is the digest of the source manifest
+// determined before; if empty, it is retrieved. Returned is the digest that was
+// verified. When the image is not signed, or none of its signatures is valid,
+// rejected is true, otherwise any error means verification could not be done.
+func (s *Sync) verifyTag(ctx context.Context, t *Task, v *verify.Config,
+	src, tag, srcDigest string) (digest string, rejected bool, err error) {
+
+	digest = srcDigest
+	if digest == "" {
+		if digest, err = s.relay.ManifestDigest(ctx,
+			fmt.Sprintf("%s:%s", src, tag), t.Source.Auth,
+			t.Source.SkipTLSVerify); err != nil {
+			return "", false, fmt.Errorf(
+				"cannot get source digest for verifying signature: %v", err)
+		}
+	}
+
+	var sigs []*verify.Signature
+	if err = retry.Do(ctx, t.syncRetryPolicy(), log.WithField("tag", tag),
+		func() error {
+			var err error
+			sigs, err = s.registry.Signatures(ctx,
+				src, digest, t.Source.Auth, t.Source.SkipTLSVerify)
+			return err
+		}); err != nil {
+		return digest, false, err
+	}
+
+	if err = v.Verify(digest, sigs); err != nil {
+		return digest, true, fmt.Errorf(
+			"signature verification failed for digest '%s': %v", digest, err)
+	}
+
+	return digest, false, nil
+}
@@ -0,0 +1,150 @@
+/*
+	Copyright 2020 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package sync
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/xelalexv/dregsy/internal/pkg/state"
+	"github.com/xelalexv/dregsy/internal/pkg/test"
+	"github.com/xelalexv/dregsy/internal/pkg/verify"
+)
+
+//
+func TestSyncVerify(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	src := test.NewRegistry(th)
+	defer src.Close()
+	trgt := test.NewRegistry(th)
+	defer trgt.Close()
+
+	dir, err := ioutil.TempDir("", "dregsy-verify-")
+	th.AssertNoError(err)
+	defer os.RemoveAll(dir)
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	th.AssertNoError(err)
+	other, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	th.AssertNoError(err)
+
+	der, err := x509.MarshalPKIXPublicKey(key.Public())
+	th.AssertNoError(err)
+	keyFile := filepath.Join(dir, "cosign.pub")
+	th.AssertNoError(ioutil.WriteFile(keyFile, pem.EncodeToMemory(
+		&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0644))
+
+	repo := "library/busybox"
+	signed := src.PushImage(repo, "signed")
+	pushSignature(th, src, repo, signed, key)
+	src.PushImage(repo, "unsigned")
+	wrongKey := src.PushImage(repo, "wrong-key")
+	pushSignature(th, src, repo, wrongKey, other)
+
+	// mapping setting overrides task setting
+	m := &Mapping{From: repo,
+		Tags:   []string{"signed", "unsigned", "wrong-key"},
+		Verify: &verify.Config{Keys: []string{keyFile}}}
+	s, task := newTestSync(th, src, trgt, m)
+	task.Verify = &verify.Config{Keys: []string{filepath.Join(dir, "none")}}
+
+	s.syncTask(context.Background(), task)
+	th.AssertTrue(task.failed)
+
+	th.AssertEquivalentSlices([]string{"signed"}, trgt.ListTags(repo))
+	th.AssertEqual(signed, trgt.Digest(repo, "signed"))
+
+	rec := task.state.Tag(m.key(), "signed")
+	th.AssertEqual(state.OutcomeSynced, rec.Outcome)
+
+	rec = task.state.Tag(m.key(), "unsigned")
+	th.AssertEqual(state.OutcomePolicyFailed, rec.Outcome)
+	th.AssertEqual("signature verification failed for digest '"+
+		rec.SourceDigest+"': image is not signed", rec.Error)
+
+	rec = task.state.Tag(m.key(), "wrong-key")
+	th.AssertEqual(state.OutcomePolicyFailed, rec.Outcome)
+	th.AssertEqual(wrongKey, rec.SourceDigest)
+	th.AssertEqual("signature verification failed for digest '"+wrongKey+
+		"': invalid signature: signature does not match any of the keys",
+		rec.Error)
+}
+
+//
+func TestSyncVerifyMovedTag(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	src := test.NewRegistry(th)
+	defer src.Close()
+
+	dir, err := ioutil.TempDir("", "dregsy-verify-")
+	th.AssertNoError(err)
+	defer os.RemoveAll(dir)
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	th.AssertNoError(err)
+	der, err := x509.MarshalPKIXPublicKey(key.Public())
+	th.AssertNoError(err)
+	keyFile := filepath.Join(dir, "cosign.pub")
+	th.AssertNoError(ioutil.WriteFile(keyFile, pem.EncodeToMemory(
+		&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0644))
+
+	// tag gets moved to an unsigned image after the signed one was verified,
+	// simulated by passing the verified digest as the known source digest
+	repo := "library/busybox"
+	signed := src.PushImage(repo, "moving")
+	pushSignature(th, src, repo, signed, key)
+	moved := src.PushImage(repo, "moving")
+	th.AssertNotEqual(signed, moved)
+
+	m := &Mapping{From: repo, Tags: []string{"moving"},
+		Verify: &verify.Config{Keys: []string{keyFile}}}
+
+	trgt := test.NewRegistry(th)
+	defer trgt.Close()
+	s, task := newTestSync(th, src, trgt, m)
+	th.AssertNoError(s.loadState(task))
+	from, to := task.mappingRefs(m)
+
+	failed, _ := s.syncTag(
+		context.Background(), task, m, from, to, "moving", signed)
+	th.AssertFalse(failed)
+	th.AssertEqual(signed, trgt.Digest(repo, "moving"))
+}
+
+//
+func pushSignature(th *test.TestHelper, reg *test.Registry, repo,
+	digest string, key crypto.Signer) {
+	payload := test.CosignPayload(digest)
+	hash := sha256.Sum256(payload)
+	sig, err := key.Sign(rand.Reader, hash[:], crypto.SHA256)
+	th.AssertNoError(err)
+	reg.PushCosignSignature(repo, digest, payload, sig)
+}
@@ -0,0 +1,128 @@
+/*
+	Copyright 2020 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package tags
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/Masterminds/semver/v3"
+	log "github.com/sirupsen/logrus"
+)
+
+//
+const (
+	BySemver  = "semver"
+	ByCreated = "created"
+)
+
+// CreationTimer is used for retrieving the creation time of the image with
+// the given tag, when sorting tags by creation time
+type CreationTimer func(tag string) (time.Time, error)
+
+//
+func ValidateKeepLatest(n int, by string) error {
+	if n < 0 {
+		return fmt.Errorf("keep-latest needs to be 0 or a positive integer")
+	}
+	switch by {
+	case "", BySemver, ByCreated:
+		return nil
+	}
+	return fmt.Errorf("invalid keep-latest-by: '%s', must be either '%s' or '%s'",
+		by, BySemver, ByCreated)
+}
+
+// KeepLatest sorts tags from newest to oldest and returns the n newest ones.
+// Sorting is done either by semantic version, or by creation time of the
+// images, which is retrieved via created. When sorting by semantic version,
+// tags which are no semantic version are considered older than any semantic
+// version, and sorted lexically among themselves. When sorting by creation
+// time, tags for which the creation time cannot be retrieved are considered
+// the oldest.
+func KeepLatest(tags []string, n int, by string, created CreationTimer) (
+	[]string, error) {
+
+	if n <= 0 || len(tags) <= n {
+		return tags, nil
+	}
+
+	if err := ValidateKeepLatest(n, by); err != nil {
+		return nil, err
+	}
+
+	ret := make([]string, len(tags))
+	copy(ret, tags)
+
+	if by == ByCreated {
+		sortByCreation(ret, created)
+	} else {
+		sortBySemver(ret)
+	}
+
+	return ret[:n], nil
+}
+
+//
+func sortBySemver(tags []string) {
+
+	versions := make(map[string]*semver.Version, len(tags))
+	for _, t := range tags {
+		if v, err := semver.NewVersion(t); err == nil {
+			versions[t] = v
+		}
+	}
+
+	sort.SliceStable(tags, func(i, j int) bool {
+		vi, vj := versions[tags[i]], versions[tags[j]]
+		switch {
+		case vi != nil && vj != nil:
+			if vi.Equal(vj) {
+				return tags[i] > tags[j]
+			}
+			return vi.GreaterThan(vj)
+		case vi != nil:
+			return true
+		case vj != nil:
+			return false
+		}
+		return tags[i] > tags[j]
+	})
+}
+
+//
+func sortByCreation(tags []string, created CreationTimer) {
+
+	times := make(map[string]time.Time, len(tags))
+	for _, t := range tags {
+		c, err := created(t)
+		if err != nil {
+			log.WithField("tag", t).Warnf(
+				"cannot get creation time, considering tag oldest: %v", err)
+		}
+		times[t] = c
+	}
+
+	sort.SliceStable(tags, func(i, j int) bool {
+		ti, tj := times[tags[i]], times[tags[j]]
+		if ti.Equal(tj) {
+			return tags[i] > tags[j]
+		}
+		return ti.After(tj)
+	})
+}
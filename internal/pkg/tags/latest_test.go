@@ -0,0 +1,90 @@
+/*
+	Copyright 2020 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package tags
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/xelalexv/dregsy/internal/pkg/test"
+)
+
+//
+func TestKeepLatestBySemver(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	tags := []string{
+		"latest", "1.9.0", "v1.10", "1.10.1", "1.2", "2.0.0-rc1", "alpine"}
+
+	got, err := KeepLatest(tags, 3, BySemver, nil)
+	th.AssertNoError(err)
+	th.AssertEqualSlices([]string{"2.0.0-rc1", "1.10.1", "v1.10"}, got)
+
+	// no semantic versions are oldest
+	got, err = KeepLatest(tags, 6, "", nil)
+	th.AssertNoError(err)
+	th.AssertEqualSlices(
+		[]string{"2.0.0-rc1", "1.10.1", "v1.10", "1.9.0", "1.2", "latest"}, got)
+
+	// nothing to drop
+	got, err = KeepLatest(tags, 10, BySemver, nil)
+	th.AssertNoError(err)
+	th.AssertEqualSlices(tags, got)
+
+	got, err = KeepLatest(tags, 0, BySemver, nil)
+	th.AssertNoError(err)
+	th.AssertEqualSlices(tags, got)
+}
+
+//
+func TestKeepLatestByCreation(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	now := time.Now()
+	created := map[string]time.Time{
+		"a": now.Add(-3 * time.Hour),
+		"b": now.Add(-1 * time.Hour),
+		"c": now.Add(-2 * time.Hour),
+		"d": now,
+	}
+
+	got, err := KeepLatest([]string{"a", "b", "c", "d", "e"}, 3, ByCreated,
+		func(tag string) (time.Time, error) {
+			if c, ok := created[tag]; ok {
+				return c, nil
+			}
+			return time.Time{}, errors.New("no such tag")
+		})
+	th.AssertNoError(err)
+	th.AssertEqualSlices([]string{"d", "b", "c"}, got)
+}
+
+//
+func TestValidateKeepLatest(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	th.AssertNoError(ValidateKeepLatest(0, ""))
+	th.AssertNoError(ValidateKeepLatest(5, BySemver))
+	th.AssertNoError(ValidateKeepLatest(5, ByCreated))
+	th.AssertError(ValidateKeepLatest(-1, ""),
+		"keep-latest needs to be 0 or a positive integer")
+	th.AssertError(ValidateKeepLatest(5, "age"), "invalid keep-latest-by: 'age'")
+}
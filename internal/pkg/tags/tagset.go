@@ -0,0 +1,242 @@
+/*
+	Copyright 2020 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package tags
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/Masterminds/semver/v3"
+)
+
+//
+const (
+	RegexPrefix  = "regex:"
+	SemverPrefix = "semver:"
+)
+
+// Filters is a list of tag filters as given in the config. Each entry is either
+// a plain string, i.e. a verbatim tag or a filter with prefix, or a map with a
+// single 'regex' or 'semver' key, e.g. {semver: ">=1.20 <2.0"}. Map entries are
+// converted into the prefixed form.
+type Filters []string
+
+//
+func (f *Filters) UnmarshalYAML(unmarshal func(interface{}) error) error {
+
+	var entries []Filter
+	if err := unmarshal(&entries); err != nil {
+		return err
+	}
+
+	*f = nil
+	for _, e := range entries {
+		*f = append(*f, string(e))
+	}
+	return nil
+}
+
+// Filter is a single entry of a Filters list
+type Filter string
+
+//
+func (f *Filter) UnmarshalYAML(unmarshal func(interface{}) error) error {
+
+	var tag string
+	if err := unmarshal(&tag); err == nil {
+		*f = Filter(tag)
+		return nil
+	}
+
+	var m map[string]string
+	if err := unmarshal(&m); err != nil || len(m) != 1 {
+		return errors.New("tag filter needs to be a tag, " +
+			"or a single 'regex' or 'semver' item")
+	}
+
+	for k, v := range m {
+		switch k + ":" {
+		case RegexPrefix, SemverPrefix:
+			*f = Filter(k + ": " + v)
+		default:
+			return fmt.Errorf("unknown tag filter type '%s'", k)
+		}
+	}
+	return nil
+}
+
+// TagLister is used for retrieving the complete list of tags of an image,
+// when a tag set needs to be resolved against it
+type TagLister func() ([]string, error)
+
+// TagSet describes the tags to sync for a mapping. It consists of a list of
+// include filters and a list of exclude filters. A filter is either a verbatim
+// tag, a regular expression prefixed with 'regex:', or a semantic version
+// constraint prefixed with 'semver:'. An empty include list means all tags.
+type TagSet struct {
+	include *filter
+	exclude *filter
+}
+
+//
+type filter struct {
+	verbatim []string
+	regex    []*regexp.Regexp
+	semver   []*semver.Constraints
+}
+
+//
+func NewTagSet(include, exclude []string) (*TagSet, error) {
+
+	inc, err := newFilter(include)
+	if err != nil {
+		return nil, err
+	}
+
+	exc, err := newFilter(exclude)
+	if err != nil {
+		return nil, fmt.Errorf("exclude list: %v", err)
+	}
+
+	return &TagSet{include: inc, exclude: exc}, nil
+}
+
+// IsVerbatim determines whether this tag set is just a plain list of tags,
+// which does not require a tag list for resolving it
+func (ts *TagSet) IsVerbatim() bool {
+	return len(ts.include.verbatim) > 0 && ts.include.isVerbatim() &&
+		ts.exclude.isEmpty()
+}
+
+// Expand resolves this tag set into the list of tags to sync. If this is not
+// a verbatim tag set, lister is called to get the complete list of tags to
+// resolve against.
+func (ts *TagSet) Expand(lister TagLister) ([]string, error) {
+
+	if ts.IsVerbatim() {
+		return ts.include.verbatim, nil
+	}
+
+	all, err := lister()
+	if err != nil {
+		return nil, err
+	}
+
+	var ret []string
+	added := make(map[string]bool)
+
+	add := func(tag string) {
+		if !added[tag] && !ts.exclude.matches(tag) {
+			ret = append(ret, tag)
+			added[tag] = true
+		}
+	}
+
+	// verbatim tags are always included, even if not present in tag list, so
+	// that syncing a missing tag still raises an error as before
+	for _, t := range ts.include.verbatim {
+		add(t)
+	}
+
+	for _, t := range all {
+		if ts.include.isEmpty() || ts.include.matches(t) {
+			add(t)
+		}
+	}
+
+	sort.Strings(ret)
+	return ret, nil
+}
+
+//
+func newFilter(tags []string) (*filter, error) {
+
+	f := &filter{}
+
+	for _, t := range tags {
+
+		switch {
+
+		case strings.HasPrefix(t, RegexPrefix):
+			expr := strings.TrimSpace(strings.TrimPrefix(t, RegexPrefix))
+			re, err := regexp.Compile(expr)
+			if err != nil {
+				return nil, fmt.Errorf("invalid regex '%s': %v", expr, err)
+			}
+			f.regex = append(f.regex, re)
+
+		case strings.HasPrefix(t, SemverPrefix):
+			expr := strings.TrimSpace(strings.TrimPrefix(t, SemverPrefix))
+			c, err := semver.NewConstraint(expr)
+			if err != nil {
+				return nil, fmt.Errorf(
+					"invalid semver constraint '%s': %v", expr, err)
+			}
+			f.semver = append(f.semver, c)
+
+		default:
+			t = strings.TrimSpace(t)
+			if t == "" {
+				return nil, fmt.Errorf("empty tag")
+			}
+			f.verbatim = append(f.verbatim, t)
+		}
+	}
+
+	return f, nil
+}
+
+//
+func (f *filter) isEmpty() bool {
+	return len(f.verbatim) == 0 && f.isVerbatim()
+}
+
+//
+func (f *filter) isVerbatim() bool {
+	return len(f.regex) == 0 && len(f.semver) == 0
+}
+
+//
+func (f *filter) matches(tag string) bool {
+
+	for _, t := range f.verbatim {
+		if t == tag {
+			return true
+		}
+	}
+
+	for _, re := range f.regex {
+		if re.MatchString(tag) {
+			return true
+		}
+	}
+
+	if len(f.semver) > 0 {
+		if v, err := semver.NewVersion(tag); err == nil {
+			for _, c := range f.semver {
+				if c.Check(v) {
+					return true
+				}
+			}
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,147 @@
+/*
+	Copyright 2020 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package tags
+
+import (
+	"errors"
+	"testing"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/xelalexv/dregsy/internal/pkg/test"
+)
+
+//
+var sourceTags = []string{
+	"1.19.3", "1.20.0", "1.20.1", "v1.21", "1.22.0-rc1", "2.0.0",
+	"latest", "nightly-20210101", "nightly-20210102",
+}
+
+//
+func listSourceTags() ([]string, error) {
+	return sourceTags, nil
+}
+
+//
+func TestTagSetExpand(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	tryExpand(th, nil, nil, sourceTags)
+	tryExpand(th, []string{"latest", "1.0"}, nil, []string{"latest", "1.0"})
+	tryExpand(th, []string{"semver: >=1.20 <2.0"}, nil,
+		[]string{"1.20.0", "1.20.1", "v1.21"})
+	tryExpand(th, []string{"regex: ^v?[0-9]+\\.[0-9]+$"}, nil,
+		[]string{"v1.21"})
+	tryExpand(th, []string{"regex: ^nightly-", "latest"}, nil,
+		[]string{"latest", "nightly-20210101", "nightly-20210102"})
+	tryExpand(th, []string{"semver: ~1.20", "semver: ^2"}, nil,
+		[]string{"1.20.0", "1.20.1", "2.0.0"})
+	tryExpand(th, []string{"semver: >=1.22.0-0"}, nil,
+		[]string{"1.22.0-rc1", "2.0.0"})
+
+	// exclusions
+	tryExpand(th, nil, []string{"regex: ^nightly-", "latest"},
+		[]string{"1.19.3", "1.20.0", "1.20.1", "v1.21", "1.22.0-rc1", "2.0.0"})
+	tryExpand(th, []string{"semver: >=1.20"}, []string{"semver: >=2"},
+		[]string{"1.20.0", "1.20.1", "v1.21"})
+	tryExpand(th, []string{"latest", "1.0"}, []string{"1.0"},
+		[]string{"latest"})
+}
+
+//
+func TestTagSetVerbatim(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	ts, err := NewTagSet([]string{"a", "b"}, nil)
+	th.AssertNoError(err)
+	th.AssertTrue(ts.IsVerbatim())
+
+	// verbatim tag set must not require a tag list
+	tags, err := ts.Expand(func() ([]string, error) {
+		return nil, errors.New("should not be called")
+	})
+	th.AssertNoError(err)
+	th.AssertEqualSlices([]string{"a", "b"}, tags)
+
+	ts, err = NewTagSet(nil, nil)
+	th.AssertNoError(err)
+	th.AssertFalse(ts.IsVerbatim())
+
+	ts, err = NewTagSet([]string{"a"}, []string{"regex: b"})
+	th.AssertNoError(err)
+	th.AssertFalse(ts.IsVerbatim())
+
+	_, err = ts.Expand(func() ([]string, error) {
+		return nil, errors.New("listing failed")
+	})
+	th.AssertError(err, "listing failed")
+}
+
+//
+func TestTagSetInvalid(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	_, err := NewTagSet([]string{"regex: ^(abc"}, nil)
+	th.AssertError(err, "invalid regex '^(abc'")
+
+	_, err = NewTagSet([]string{"semver: >=x.y"}, nil)
+	th.AssertError(err, "invalid semver constraint '>=x.y'")
+
+	_, err = NewTagSet(nil, []string{"regex: ["})
+	th.AssertError(err, "exclude list: invalid regex")
+
+	_, err = NewTagSet([]string{" "}, nil)
+	th.AssertError(err, "empty tag")
+}
+
+//
+func tryExpand(th *test.TestHelper, include, exclude, want []string) {
+
+	test.StackTraceDepth = 2
+	defer func() { test.StackTraceDepth = 1 }()
+
+	ts, err := NewTagSet(include, exclude)
+	th.AssertNoError(err)
+
+	got, err := ts.Expand(listSourceTags)
+	th.AssertNoError(err)
+	th.AssertEquivalentSlices(want, got)
+}
+
+//
+func TestFiltersYAML(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	var f Filters
+	th.AssertNoError(yaml.Unmarshal([]byte(`
+- 1.0
+- 'regex: ^1\.1$'
+- regex: ^v1\.
+- semver: '>=1.20 <2.0'
+`), &f))
+	th.AssertEquivalentSlices(Filters{"1.0", `regex: ^1\.1$`, `regex: ^v1\.`,
+		"semver: >=1.20 <2.0"}, f)
+
+	th.AssertError(yaml.Unmarshal([]byte("- glob: 1.*"), &f),
+		"unknown tag filter type 'glob'")
+	th.AssertError(yaml.Unmarshal([]byte("- {regex: a, semver: b}"), &f),
+		"tag filter needs to be a tag, or a single 'regex' or 'semver' item")
+}
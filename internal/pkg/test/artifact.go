@@ -0,0 +1,236 @@
+/*
+	Copyright 2020 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package test
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+// ArtifactLayer is a layer of an artifact such as a cosign signature, which is
+// stored as is, i.e. without compression
+type ArtifactLayer struct {
+	MediaType   string
+	Data        []byte
+	Annotations map[string]string
+}
+
+// PushArtifact pushes an artifact made up of the given layers to repo in this
+// registry, tagged with tag, and returns the artifact's digest
+func (r *Registry) PushArtifact(repo, tag string,
+	layers ...*ArtifactLayer) string {
+
+	img := empty.Image
+	for _, l := range layers {
+		var err error
+		if img, err = mutate.Append(img, mutate.Addendum{
+			Layer:       &rawLayer{data: l.Data, mediaType: l.MediaType},
+			Annotations: l.Annotations,
+		}); err != nil {
+			r.th.Fatal(err)
+		}
+	}
+
+	ref, err := name.NewTag(r.Host() + "/" + repo + ":" + tag)
+	if err != nil {
+		r.th.Fatal(err)
+	}
+	if err := remote.Write(ref, img, r.remoteOptions()...); err != nil {
+		r.th.Fatal(err)
+	}
+
+	d, err := img.Digest()
+	if err != nil {
+		r.th.Fatal(err)
+	}
+	return d.String()
+}
+
+// CosignPayload returns a cosign simple signing payload for the image with
+// digest
+func CosignPayload(digest string) []byte {
+	return []byte(fmt.Sprintf(`{"critical":{"identity":{"docker-reference":""},`+
+		`"image":{"docker-manifest-digest":"%s"},`+
+		`"type":"cosign container image signature"},"optional":null}`, digest))
+}
+
+// PushCosignSignature pushes a cosign signature artifact for the image with
+// digest to repo in this registry, holding payload and its signature sig
+func (r *Registry) PushCosignSignature(repo, digest string,
+	payload, sig []byte) string {
+	return r.PushArtifact(repo, strings.Replace(digest, ":", "-", 1)+".sig",
+		&ArtifactLayer{
+			MediaType: "application/vnd.dev.cosign.simplesigning.v1+json",
+			Data:      payload,
+			Annotations: map[string]string{
+				"dev.cosignproject.cosign/signature": base64.StdEncoding.
+					EncodeToString(sig)},
+		})
+}
+
+// EnableReferrers makes this registry support the OCI referrers API
+func (r *Registry) EnableReferrers() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.referrers = true
+}
+
+// PushReferrer stores an OCI artifact of artifactType with a single layer
+// holding data in repo of this registry, referring to the manifest with digest
+// subject. The artifact is not tagged. Returned is the artifact's digest.
+func (r *Registry) PushReferrer(repo, subject, artifactType string,
+	data []byte) string {
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	s, ok := r.manifests[repo][subject]
+	if !ok {
+		r.th.Fatalf("no manifest '%s' in repo '%s'", subject, repo)
+	}
+
+	config := []byte("{}")
+	r.addBlob(repo, blobDigest(config), config)
+	r.addBlob(repo, blobDigest(data), data)
+
+	content, err := json.Marshal(map[string]interface{}{
+		"schemaVersion": 2,
+		"mediaType":     types.OCIManifestSchema1,
+		"artifactType":  artifactType,
+		"config": descriptor(
+			"application/vnd.oci.empty.v1+json", config),
+		"layers": []interface{}{descriptor(artifactType, data)},
+		"subject": map[string]interface{}{
+			"mediaType": s.mediaType,
+			"digest":    subject,
+			"size":      len(s.content),
+		},
+	})
+	if err != nil {
+		r.th.Fatal(err)
+	}
+
+	m := &manifest{mediaType: string(types.OCIManifestSchema1), content: content}
+	r.manifests[repo][m.digest()] = m
+	return m.digest()
+}
+
+//
+func (r *Registry) handleReferrers(w http.ResponseWriter,
+	repo, digest string) {
+
+	if !r.referrers {
+		writeError(w, http.StatusNotFound, "NOT_FOUND", "not found")
+		return
+	}
+
+	manifests := []interface{}{}
+	for ref, m := range r.manifests[repo] {
+		if ref != m.digest() {
+			continue // only look at each manifest once, via its digest
+		}
+		var parsed struct {
+			ArtifactType string `json:"artifactType"`
+			Subject      struct {
+				Digest string `json:"digest"`
+			} `json:"subject"`
+		}
+		if json.Unmarshal(m.content, &parsed) != nil ||
+			parsed.Subject.Digest != digest {
+			continue
+		}
+		manifests = append(manifests, map[string]interface{}{
+			"mediaType":    m.mediaType,
+			"digest":       m.digest(),
+			"size":         len(m.content),
+			"artifactType": parsed.ArtifactType,
+		})
+	}
+
+	w.Header().Set("Content-Type", string(types.OCIImageIndex))
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"schemaVersion": 2,
+		"mediaType":     types.OCIImageIndex,
+		"manifests":     manifests,
+	})
+}
+
+//
+func descriptor(mediaType string, data []byte) map[string]interface{} {
+	return map[string]interface{}{
+		"mediaType": mediaType,
+		"digest":    blobDigest(data),
+		"size":      len(data),
+	}
+}
+
+//
+func blobDigest(data []byte) string {
+	return fmt.Sprintf("sha256:%x", sha256.Sum256(data))
+}
+
+// rawLayer is an uncompressed layer
+type rawLayer struct {
+	data      []byte
+	mediaType string
+}
+
+//
+func (l *rawLayer) Digest() (v1.Hash, error) {
+	sum := sha256.Sum256(l.data)
+	return v1.Hash{Algorithm: "sha256", Hex: hex.EncodeToString(sum[:])}, nil
+}
+
+//
+func (l *rawLayer) DiffID() (v1.Hash, error) {
+	return l.Digest()
+}
+
+//
+func (l *rawLayer) Compressed() (io.ReadCloser, error) {
+	return ioutil.NopCloser(bytes.NewReader(l.data)), nil
+}
+
+//
+func (l *rawLayer) Uncompressed() (io.ReadCloser, error) {
+	return l.Compressed()
+}
+
+//
+func (l *rawLayer) Size() (int64, error) {
+	return int64(len(l.data)), nil
+}
+
+//
+func (l *rawLayer) MediaType() (types.MediaType, error) {
+	return types.MediaType(l.mediaType), nil
+}
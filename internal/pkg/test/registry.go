@@ -0,0 +1,523 @@
+/*
+	Copyright 2020 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package test
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+//
+const testToken = "dregsy-test-token"
+
+// Registry is an in-process stand-in for a Docker registry, for use in unit
+// tests that need to talk to a registry via the Registry v2 API. It keeps all
+// content in memory and only implements what dregsy needs.
+type Registry struct {
+	*httptest.Server
+	th *TestHelper
+
+	user     string
+	password string
+
+	mutex     sync.Mutex
+	blobs     map[string][]byte
+	repoBlobs map[string]map[string]bool
+	manifests map[string]map[string]*manifest
+	uploads   map[string][]byte
+	uploadSeq int
+	failures  map[string][]int
+	pullQuota int
+	pulls     int
+	referrers bool
+
+	// counters for asserting on blob & manifest handling
+	Uploads         int
+	Mounts          int
+	ManifestPuts    int
+	ManifestDeletes int
+}
+
+//
+type manifest struct {
+	mediaType string
+	content   []byte
+}
+
+//
+func (m *manifest) digest() string {
+	return fmt.Sprintf("sha256:%x", sha256.Sum256(m.content))
+}
+
+//
+func NewRegistry(th *TestHelper) *Registry {
+	r := &Registry{
+		th:        th,
+		blobs:     map[string][]byte{},
+		repoBlobs: map[string]map[string]bool{},
+		manifests: map[string]map[string]*manifest{},
+		uploads:   map[string][]byte{},
+		failures:  map[string][]int{},
+	}
+	r.Server = httptest.NewServer(http.HandlerFunc(r.handle))
+	return r
+}
+
+// NewAuthRegistry creates a registry that requires a bearer token, which is
+// only handed out to clients authenticating with user & password
+func NewAuthRegistry(th *TestHelper, user, password string) *Registry {
+	r := NewRegistry(th)
+	r.user = user
+	r.password = password
+	return r
+}
+
+// Host returns the host:port address of the registry
+func (r *Registry) Host() string {
+	u, err := url.Parse(r.URL)
+	if err != nil {
+		r.th.Fatal(err)
+	}
+	return u.Host
+}
+
+//
+func (r *Registry) remoteOptions() []remote.Option {
+	if r.user == "" {
+		return nil
+	}
+	return []remote.Option{remote.WithAuth(
+		&authn.Basic{Username: r.user, Password: r.password})}
+}
+
+// PushImage pushes a random single-layer image to repo in this registry,
+// tagged with all of the given tags, and returns the image's digest
+func (r *Registry) PushImage(repo string, tags ...string) string {
+	return r.PushImageCreatedAt(repo, time.Time{}, tags...)
+}
+
+// PushImageCreatedAt is like PushImage, but sets the creation time of the image
+func (r *Registry) PushImageCreatedAt(repo string, created time.Time,
+	tags ...string) string {
+
+	img, err := random.Image(256, 1)
+	if err != nil {
+		r.th.Fatal(err)
+	}
+
+	if img, err = mutate.CreatedAt(img, v1.Time{Time: created}); err != nil {
+		r.th.Fatal(err)
+	}
+
+	for _, tag := range tags {
+		ref, err := name.NewTag(r.Host() + "/" + repo + ":" + tag)
+		if err != nil {
+			r.th.Fatal(err)
+		}
+		if err := remote.Write(ref, img, r.remoteOptions()...); err != nil {
+			r.th.Fatal(err)
+		}
+	}
+
+	d, err := img.Digest()
+	if err != nil {
+		r.th.Fatal(err)
+	}
+	return d.String()
+}
+
+// PushIndex pushes a random image index with the given number of child images
+// to repo in this registry, tagged with tag, and returns the index's digest
+func (r *Registry) PushIndex(repo, tag string, count int64) string {
+
+	idx, err := random.Index(256, 1, count)
+	if err != nil {
+		r.th.Fatal(err)
+	}
+
+	ref, err := name.NewTag(r.Host() + "/" + repo + ":" + tag)
+	if err != nil {
+		r.th.Fatal(err)
+	}
+	if err := remote.WriteIndex(ref, idx, r.remoteOptions()...); err != nil {
+		r.th.Fatal(err)
+	}
+
+	d, err := idx.Digest()
+	if err != nil {
+		r.th.Fatal(err)
+	}
+	return d.String()
+}
+
+// ListTags lists all tags of repo in this registry
+func (r *Registry) ListTags(repo string) []string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.tags(repo)
+}
+
+// Digest returns the digest of the manifest referenced by repo:tag in this
+// registry, or the empty string if there is no such manifest
+func (r *Registry) Digest(repo, tag string) string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if m, ok := r.manifests[repo][tag]; ok {
+		return m.digest()
+	}
+	return ""
+}
+
+//
+func (r *Registry) tags(repo string) []string {
+	ret := []string{}
+	for ref := range r.manifests[repo] {
+		if !strings.HasPrefix(ref, "sha256:") {
+			ret = append(ret, ref)
+		}
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+//
+func (r *Registry) handle(w http.ResponseWriter, req *http.Request) {
+
+	if req.URL.Path == "/token" {
+		r.handleToken(w, req)
+		return
+	}
+
+	if !strings.HasPrefix(req.URL.Path, "/v2/") {
+		writeError(w, http.StatusNotFound, "NOT_FOUND", "not found")
+		return
+	}
+
+	if r.user != "" &&
+		req.Header.Get("Authorization") != "Bearer "+testToken {
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf(
+			`Bearer realm="%s/token",service="test-registry"`, r.URL))
+		writeError(w, http.StatusUnauthorized, "UNAUTHORIZED",
+			"authentication required")
+		return
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	path := strings.TrimPrefix(req.URL.Path, "/v2/")
+
+	if path != "" && r.injectFailure(w, req.Method) {
+		return
+	}
+
+	switch {
+
+	case path == "":
+		w.WriteHeader(http.StatusOK)
+
+	case strings.HasSuffix(path, "/tags/list"):
+		r.handleTags(w, strings.TrimSuffix(path, "/tags/list"))
+
+	case strings.Contains(path, "/referrers/"):
+		ix := strings.LastIndex(path, "/referrers/")
+		r.handleReferrers(w, path[:ix], path[ix+len("/referrers/"):])
+
+	case strings.Contains(path, "/manifests/"):
+		ix := strings.LastIndex(path, "/manifests/")
+		r.handleManifest(w, req, path[:ix], path[ix+len("/manifests/"):])
+
+	case strings.Contains(path, "/blobs/uploads"):
+		ix := strings.LastIndex(path, "/blobs/uploads")
+		r.handleUpload(w, req, path[:ix],
+			strings.TrimPrefix(path[ix+len("/blobs/uploads"):], "/"))
+
+	case strings.Contains(path, "/blobs/"):
+		ix := strings.LastIndex(path, "/blobs/")
+		r.handleBlob(w, req, path[:ix], path[ix+len("/blobs/"):])
+
+	default:
+		writeError(w, http.StatusNotFound, "NOT_FOUND", "not found")
+	}
+}
+
+// FailNext makes the next n requests with method fail with HTTP status
+func (r *Registry) FailNext(method string, n, status int) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for ; n > 0; n-- {
+		r.failures[method] = append(r.failures[method], status)
+	}
+}
+
+// SetPullQuota limits the number of manifest GET requests to n, and makes the
+// registry report its quota in rate limit headers the way Docker Hub does.
+// Once the quota is used up, manifest GETs fail with HTTP status 429. HEAD
+// requests don't count against the quota. 0 means no limit.
+func (r *Registry) SetPullQuota(n int) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.pullQuota = n
+	r.pulls = 0
+}
+
+// injectFailure writes an error response if a failure is pending for method
+func (r *Registry) injectFailure(w http.ResponseWriter, method string) bool {
+
+	pending := r.failures[method]
+	if len(pending) == 0 {
+		return false
+	}
+	status := pending[0]
+	r.failures[method] = pending[1:]
+
+	switch {
+	case status == http.StatusTooManyRequests:
+		writeError(w, status, "TOOMANYREQUESTS", "too many requests")
+	case status >= 500:
+		writeError(w, status, "UNAVAILABLE", http.StatusText(status))
+	case status == http.StatusUnauthorized:
+		writeError(w, status, "UNAUTHORIZED", "authentication required")
+	default:
+		writeError(w, status, "UNKNOWN", http.StatusText(status))
+	}
+	return true
+}
+
+//
+func (r *Registry) handleToken(w http.ResponseWriter, req *http.Request) {
+	if user, pass, ok := req.BasicAuth(); !ok ||
+		user != r.user || pass != r.password {
+		writeError(w, http.StatusUnauthorized, "UNAUTHORIZED",
+			"invalid credentials")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"token": testToken})
+}
+
+//
+func (r *Registry) handleTags(w http.ResponseWriter, repo string) {
+	if _, ok := r.manifests[repo]; !ok {
+		writeError(w, http.StatusNotFound, "NAME_UNKNOWN", "unknown repository")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"name": repo,
+		"tags": r.tags(repo),
+	})
+}
+
+//
+func (r *Registry) handleManifest(w http.ResponseWriter, req *http.Request,
+	repo, ref string) {
+
+	switch req.Method {
+
+	case http.MethodGet, http.MethodHead:
+		if r.pullQuota > 0 {
+			exceeded := req.Method == http.MethodGet && r.pulls >= r.pullQuota
+			if req.Method == http.MethodGet && !exceeded {
+				r.pulls++
+			}
+			w.Header().Set("RateLimit-Limit",
+				fmt.Sprintf("%d;w=21600", r.pullQuota))
+			w.Header().Set("RateLimit-Remaining",
+				fmt.Sprintf("%d;w=21600", r.pullQuota-r.pulls))
+			if exceeded {
+				writeError(w, http.StatusTooManyRequests, "TOOMANYREQUESTS",
+					"pull rate limit reached")
+				return
+			}
+		}
+		m, ok := r.manifests[repo][ref]
+		if !ok {
+			writeError(w, http.StatusNotFound, "MANIFEST_UNKNOWN",
+				"unknown manifest")
+			return
+		}
+		w.Header().Set("Content-Type", m.mediaType)
+		w.Header().Set("Docker-Content-Digest", m.digest())
+		w.Header().Set("Content-Length", strconv.Itoa(len(m.content)))
+		w.WriteHeader(http.StatusOK)
+		if req.Method == http.MethodGet {
+			w.Write(m.content)
+		}
+
+	case http.MethodPut:
+		content, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "MANIFEST_INVALID", err.Error())
+			return
+		}
+		m := &manifest{
+			mediaType: req.Header.Get("Content-Type"),
+			content:   content,
+		}
+		if r.manifests[repo] == nil {
+			r.manifests[repo] = map[string]*manifest{}
+		}
+		r.manifests[repo][ref] = m
+		r.manifests[repo][m.digest()] = m
+		r.ManifestPuts++
+		w.Header().Set("Docker-Content-Digest", m.digest())
+		w.WriteHeader(http.StatusCreated)
+
+	case http.MethodDelete:
+		// like most registries, only support deleting by digest, which takes
+		// along all tags pointing to the manifest
+		if !strings.HasPrefix(ref, "sha256:") {
+			writeError(w, http.StatusBadRequest, "UNSUPPORTED",
+				"deleting by tag not supported")
+			return
+		}
+		found := false
+		for key, m := range r.manifests[repo] {
+			if m.digest() == ref {
+				delete(r.manifests[repo], key)
+				found = true
+			}
+		}
+		if !found {
+			writeError(w, http.StatusNotFound, "MANIFEST_UNKNOWN",
+				"unknown manifest")
+			return
+		}
+		r.ManifestDeletes++
+		w.WriteHeader(http.StatusAccepted)
+
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "UNSUPPORTED",
+			"method not allowed")
+	}
+}
+
+//
+func (r *Registry) handleBlob(w http.ResponseWriter, req *http.Request,
+	repo, digest string) {
+
+	b, ok := r.blobs[digest]
+	if !ok || !r.repoBlobs[repo][digest] {
+		writeError(w, http.StatusNotFound, "BLOB_UNKNOWN", "unknown blob")
+		return
+	}
+
+	w.Header().Set("Docker-Content-Digest", digest)
+	w.Header().Set("Content-Length", strconv.Itoa(len(b)))
+	w.WriteHeader(http.StatusOK)
+	if req.Method == http.MethodGet {
+		w.Write(b)
+	}
+}
+
+//
+func (r *Registry) handleUpload(w http.ResponseWriter, req *http.Request,
+	repo, id string) {
+
+	switch req.Method {
+
+	case http.MethodPost:
+		q := req.URL.Query()
+		if d, from := q.Get("mount"), q.Get("from"); d != "" && from != "" &&
+			r.repoBlobs[from][d] {
+			r.addBlob(repo, d, r.blobs[d])
+			r.Mounts++
+			w.Header().Set("Docker-Content-Digest", d)
+			w.WriteHeader(http.StatusCreated)
+			return
+		}
+		r.uploadSeq++
+		id = strconv.Itoa(r.uploadSeq)
+		r.uploads[id] = nil
+		w.Header().Set("Location", fmt.Sprintf("/v2/%s/blobs/uploads/%s", repo, id))
+		w.WriteHeader(http.StatusAccepted)
+
+	case http.MethodPatch, http.MethodPut:
+		data, ok := r.uploads[id]
+		if !ok {
+			writeError(w, http.StatusNotFound, "BLOB_UPLOAD_UNKNOWN",
+				"unknown upload")
+			return
+		}
+		chunk, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "BLOB_UPLOAD_INVALID",
+				err.Error())
+			return
+		}
+		data = append(data, chunk...)
+
+		if req.Method == http.MethodPatch {
+			r.uploads[id] = data
+			w.Header().Set("Location", req.URL.Path)
+			w.WriteHeader(http.StatusAccepted)
+			return
+		}
+
+		d := req.URL.Query().Get("digest")
+		if d != fmt.Sprintf("sha256:%x", sha256.Sum256(data)) {
+			writeError(w, http.StatusBadRequest, "DIGEST_INVALID",
+				"digest mismatch")
+			return
+		}
+		delete(r.uploads, id)
+		r.addBlob(repo, d, data)
+		r.Uploads++
+		w.Header().Set("Docker-Content-Digest", d)
+		w.WriteHeader(http.StatusCreated)
+
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "UNSUPPORTED",
+			"method not allowed")
+	}
+}
+
+//
+func (r *Registry) addBlob(repo, digest string, data []byte) {
+	r.blobs[digest] = data
+	if r.repoBlobs[repo] == nil {
+		r.repoBlobs[repo] = map[string]bool{}
+	}
+	r.repoBlobs[repo][digest] = true
+}
+
+//
+func writeError(w http.ResponseWriter, status int, code, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"errors": []map[string]string{{"code": code, "message": msg}},
+	})
+}
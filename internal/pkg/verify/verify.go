@@ -0,0 +1,206 @@
+/*
+	Copyright 2020 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package verify
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"strings"
+)
+
+// the type of payload cosign signs for container images
+const payloadType = "cosign container image signature"
+
+// ErrUnsigned is returned by Verify when there's no signature at all
+var ErrUnsigned = errors.New("image is not signed")
+
+// Config is the signature verification setting of a task or mapping
+type Config struct {
+	Keys []string `yaml:"keys"`
+	//
+	keys []crypto.PublicKey
+}
+
+// Validate loads the public keys of this config
+func (c *Config) Validate() error {
+
+	if len(c.Keys) == 0 {
+		return errors.New("verify requires at least one key")
+	}
+
+	c.keys = nil
+	for _, f := range c.Keys {
+		k, err := loadKey(f)
+		if err != nil {
+			return err
+		}
+		c.keys = append(c.keys, k)
+	}
+
+	return nil
+}
+
+// Signature is a cosign signature of an image, i.e. the signed payload, and
+// the base64 encoded signature
+type Signature struct {
+	Payload   []byte
+	Signature string
+}
+
+// SignatureTag returns the tag under which cosign stores the signatures of the
+// image with digest
+func SignatureTag(digest string) (string, error) {
+	parts := strings.SplitN(digest, ":", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", fmt.Errorf("invalid digest '%s'", digest)
+	}
+	return fmt.Sprintf("%s-%s.sig", parts[0], parts[1]), nil
+}
+
+// Verify checks that at least one of sigs is a valid signature for the image
+// with digest, made with one of the keys of this config. If sigs is empty,
+// ErrUnsigned is returned.
+func (c *Config) Verify(digest string, sigs []*Signature) error {
+
+	if len(sigs) == 0 {
+		return ErrUnsigned
+	}
+
+	var err error
+	for _, s := range sigs {
+		if err = c.verify(digest, s); err == nil {
+			return nil
+		}
+	}
+
+	if len(sigs) == 1 {
+		return fmt.Errorf("invalid signature: %v", err)
+	}
+	return fmt.Errorf("none of %d signatures is valid, last error: %v",
+		len(sigs), err)
+}
+
+//
+func (c *Config) verify(digest string, s *Signature) error {
+
+	sig, err := base64.StdEncoding.DecodeString(s.Signature)
+	if err != nil {
+		return fmt.Errorf("signature not base64 encoded: %v", err)
+	}
+
+	valid := false
+	for _, k := range c.keys {
+		if valid = verifySignature(k, s.Payload, sig); valid {
+			break
+		}
+	}
+	if !valid {
+		return errors.New("signature does not match any of the keys")
+	}
+
+	// only now that we know the payload is genuine, it's worth looking at
+	var payload struct {
+		Critical struct {
+			Image struct {
+				Digest string `json:"docker-manifest-digest"`
+			} `json:"image"`
+			Type string `json:"type"`
+		} `json:"critical"`
+	}
+	if err := json.Unmarshal(s.Payload, &payload); err != nil {
+		return fmt.Errorf("malformed payload: %v", err)
+	}
+	if payload.Critical.Type != payloadType {
+		return fmt.Errorf("unexpected payload type '%s'", payload.Critical.Type)
+	}
+	if payload.Critical.Image.Digest != digest {
+		return fmt.Errorf("signature is for digest '%s', not '%s'",
+			payload.Critical.Image.Digest, digest)
+	}
+
+	return nil
+}
+
+// verifySignature checks sig over payload with key, the way cosign creates
+// signatures, i.e. ECDSA and RSA PKCS #1 v1.5 over a SHA-256 hash, and Ed25519
+// over the payload itself
+func verifySignature(key crypto.PublicKey, payload, sig []byte) bool {
+
+	hash := sha256.Sum256(payload)
+
+	switch k := key.(type) {
+
+	case *ecdsa.PublicKey:
+		var es struct {
+			R, S *big.Int
+		}
+		rest, err := asn1.Unmarshal(sig, &es)
+		if err != nil || len(rest) > 0 {
+			return false
+		}
+		return ecdsa.Verify(k, hash[:], es.R, es.S)
+
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(k, crypto.SHA256, hash[:], sig) == nil
+
+	case ed25519.PublicKey:
+		return ed25519.Verify(k, payload, sig)
+	}
+
+	return false
+}
+
+// loadKey loads a PEM encoded public key from file
+func loadKey(file string) (crypto.PublicKey, error) {
+
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read key: %v", err)
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("key file '%s' contains no PEM data", file)
+	}
+	if block.Type != "PUBLIC KEY" {
+		return nil, fmt.Errorf(
+			"key file '%s' contains a '%s', not a public key", file, block.Type)
+	}
+
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("key file '%s': %v", file, err)
+	}
+
+	switch key.(type) {
+	case *ecdsa.PublicKey, *rsa.PublicKey, ed25519.PublicKey:
+		return key, nil
+	}
+	return nil, fmt.Errorf("key file '%s': unsupported key type %T", file, key)
+}
@@ -0,0 +1,175 @@
+/*
+	Copyright 2020 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package verify
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/xelalexv/dregsy/internal/pkg/test"
+)
+
+//
+const testDigest = "sha256:" +
+	"0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+
+//
+func TestSignatureTag(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	tag, err := SignatureTag(testDigest)
+	th.AssertNoError(err)
+	th.AssertEqual("sha256-0123456789abcdef0123456789abcdef"+
+		"0123456789abcdef0123456789abcdef.sig", tag)
+
+	_, err = SignatureTag("latest")
+	th.AssertError(err, "invalid digest 'latest'")
+}
+
+//
+func TestVerify(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	dir, err := ioutil.TempDir("", "dregsy-verify-test")
+	th.AssertNoError(err)
+	defer os.RemoveAll(dir)
+
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	th.AssertNoError(err)
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	th.AssertNoError(err)
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	th.AssertNoError(err)
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	th.AssertNoError(err)
+
+	payload := test.CosignPayload(testDigest)
+
+	for _, key := range []crypto.Signer{ecKey, rsaKey, edKey} {
+
+		conf := &Config{Keys: []string{
+			writeKey(th, dir, otherKey.Public()),
+			writeKey(th, dir, key.Public())}}
+		th.AssertNoError(conf.Validate())
+
+		sig := sign(th, key, payload)
+		th.AssertNoError(conf.Verify(testDigest, []*Signature{sig}))
+
+		// any valid signature will do
+		th.AssertNoError(conf.Verify(testDigest, []*Signature{
+			sign(th, otherKey, payload), sig}))
+
+		th.AssertError(conf.Verify(testDigest, nil), "image is not signed")
+
+		th.AssertError(conf.Verify("sha256:other", []*Signature{sig}),
+			"invalid signature: signature is for digest '"+testDigest+
+				"', not 'sha256:other'")
+
+		tampered := &Signature{
+			Payload:   test.CosignPayload("sha256:other"),
+			Signature: sig.Signature,
+		}
+		th.AssertError(conf.Verify("sha256:other", []*Signature{tampered}),
+			"invalid signature: signature does not match any of the keys")
+
+		th.AssertError(conf.Verify(testDigest, []*Signature{
+			tampered, {Payload: payload, Signature: "%%%"}}),
+			"none of 2 signatures is valid, last error: "+
+				"signature not base64 encoded")
+	}
+
+	// signature made with a key that's not configured
+	conf := &Config{Keys: []string{writeKey(th, dir, ecKey.Public())}}
+	th.AssertNoError(conf.Validate())
+	th.AssertError(conf.Verify(testDigest, []*Signature{
+		sign(th, otherKey, payload)}),
+		"invalid signature: signature does not match any of the keys")
+
+	// wrong payload type
+	sig := sign(th, ecKey, []byte(`{"critical":{"image":`+
+		`{"docker-manifest-digest":"`+testDigest+`"},"type":"other"}}`))
+	th.AssertError(conf.Verify(testDigest, []*Signature{sig}),
+		"invalid signature: unexpected payload type 'other'")
+}
+
+//
+func TestLoadKey(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	dir, err := ioutil.TempDir("", "dregsy-verify-test")
+	th.AssertNoError(err)
+	defer os.RemoveAll(dir)
+
+	th.AssertError((&Config{}).Validate(), "verify requires at least one key")
+
+	file := filepath.Join(dir, "key.pub")
+	th.AssertError((&Config{Keys: []string{file}}).Validate(),
+		"cannot read key")
+
+	th.AssertNoError(ioutil.WriteFile(file, []byte("not a key"), 0644))
+	th.AssertError((&Config{Keys: []string{file}}).Validate(),
+		"contains no PEM data")
+
+	th.AssertNoError(ioutil.WriteFile(file, pem.EncodeToMemory(
+		&pem.Block{Type: "ENCRYPTED COSIGN PRIVATE KEY", Bytes: []byte("x")}),
+		0644))
+	th.AssertError((&Config{Keys: []string{file}}).Validate(),
+		"contains a 'ENCRYPTED COSIGN PRIVATE KEY', not a public key")
+}
+
+//
+func writeKey(th *test.TestHelper, dir string, key crypto.PublicKey) string {
+	der, err := x509.MarshalPKIXPublicKey(key)
+	th.AssertNoError(err)
+	f, err := ioutil.TempFile(dir, "key-*.pub")
+	th.AssertNoError(err)
+	defer f.Close()
+	th.AssertNoError(pem.Encode(f, &pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+	return f.Name()
+}
+
+// sign signs payload with key the way cosign does
+func sign(th *test.TestHelper, key crypto.Signer, payload []byte) *Signature {
+	var sig []byte
+	var err error
+	if _, ok := key.(ed25519.PrivateKey); ok {
+		sig, err = key.Sign(rand.Reader, payload, crypto.Hash(0))
+	} else {
+		hash := sha256.Sum256(payload)
+		sig, err = key.Sign(rand.Reader, hash[:], crypto.SHA256)
+	}
+	th.AssertNoError(err)
+	return &Signature{
+		Payload:   payload,
+		Signature: base64.StdEncoding.EncodeToString(sig),
+	}
+}
@@ -0,0 +1,214 @@
+/*
+	Copyright 2020 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package watch
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Settle is how long a watched path needs to be quiet after a change, before
+// the change is reported. Editors and tools often write a file in several
+// steps, which should only be reported once.
+var Settle = 500 * time.Millisecond
+
+// Watcher reports changes to a set of files and directories. For a directory,
+// any change to the files directly inside of it is reported.
+type Watcher struct {
+	changes chan string
+	targets []*target
+	done    chan bool
+	closed  sync.Once
+	//
+	mutex sync.Mutex
+	dirty map[*target]bool
+	timer *time.Timer
+	//
+	backend backend
+}
+
+// a watched path
+type target struct {
+	path  string // as given by the caller
+	dir   string // directory in which changes are observed
+	name  string // file within dir, empty if all of dir is watched
+	isDir bool
+}
+
+// backend is the OS-specific part of a watcher
+type backend interface {
+	// add starts watching directory dir
+	add(dir string) error
+	// run reports the names of changed files in watched directories to
+	// changed, until close is called
+	run(changed func(dir, name string))
+	//
+	close() error
+}
+
+// New creates a watcher for the given paths, which need to exist
+func New(paths ...string) (*Watcher, error) {
+
+	w := &Watcher{
+		changes: make(chan string, len(paths)),
+		done:    make(chan bool),
+		dirty:   make(map[*target]bool),
+	}
+
+	for _, p := range paths {
+		t, err := newTarget(p)
+		if err != nil {
+			return nil, err
+		}
+		w.targets = append(w.targets, t)
+	}
+
+	b, err := newBackend()
+	if err != nil {
+		return nil, err
+	}
+
+	added := make(map[string]bool)
+	for _, t := range w.targets {
+		if added[t.dir] {
+			continue
+		}
+		if err := b.add(t.dir); err != nil {
+			b.close()
+			return nil, err
+		}
+		added[t.dir] = true
+	}
+
+	w.backend = b
+	go b.run(w.changed)
+
+	return w, nil
+}
+
+//
+func newTarget(path string) (*target, error) {
+
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+
+	fi, err := os.Stat(abs)
+	if err != nil {
+		return nil, err
+	}
+
+	if fi.IsDir() {
+		return &target{path: path, dir: abs, isDir: true}, nil
+	}
+
+	// a file is watched via its directory, so that replacing it, as many
+	// editors do, is noticed as well
+	return &target{path: path, dir: filepath.Dir(abs),
+		name: filepath.Base(abs)}, nil
+}
+
+// Changes returns the channel on which changed paths are reported, as they
+// were given when creating the watcher. The channel is closed when the watcher
+// gets closed.
+func (w *Watcher) Changes() <-chan string {
+	return w.changes
+}
+
+// Close stops watching
+func (w *Watcher) Close() error {
+	var err error
+	w.closed.Do(func() {
+		close(w.done)
+		err = w.backend.close()
+		w.mutex.Lock()
+		if w.timer != nil {
+			w.timer.Stop()
+		}
+		close(w.changes)
+		w.mutex.Unlock()
+	})
+	return err
+}
+
+// changed is called by the backend for every change to file name within
+// directory dir
+func (w *Watcher) changed(dir, name string) {
+
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	hit := false
+	for _, t := range w.targets {
+		if t.matches(dir, name) {
+			w.dirty[t] = true
+			hit = true
+		}
+	}
+
+	if !hit {
+		return
+	}
+
+	if w.timer == nil {
+		w.timer = time.AfterFunc(Settle, w.report)
+	} else {
+		w.timer.Reset(Settle)
+	}
+}
+
+// report sends all targets that changed since the last report
+func (w *Watcher) report() {
+
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	select {
+	case <-w.done: // closed while waiting for the lock
+		return
+	default:
+	}
+
+	for t := range w.dirty {
+		log.WithField("path", t.path).Debug("change detected")
+		select {
+		case w.changes <- t.path:
+		case <-w.done:
+			return
+		default:
+			// a change for this path is still waiting to be picked up
+		}
+		delete(w.dirty, t)
+	}
+}
+
+// matches determines whether a change to file name in directory dir affects
+// this target
+func (t *target) matches(dir, name string) bool {
+	if dir != t.dir {
+		return false
+	}
+	// Kubernetes updates mounted config maps & secrets by swapping a symlink
+	// to a hidden directory, named e.g. '..data'
+	return t.isDir || name == t.name || strings.HasPrefix(name, "..")
+}
@@ -0,0 +1,120 @@
+/*
+	Copyright 2020 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package watch
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"sync"
+	"syscall"
+	"unsafe"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// events that indicate a change to a file in a watched directory
+const inotifyMask = syscall.IN_CLOSE_WRITE | syscall.IN_CREATE |
+	syscall.IN_DELETE | syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO
+
+// inotifyBackend watches directories using inotify
+type inotifyBackend struct {
+	fd    int
+	file  *os.File
+	mutex sync.Mutex
+	dirs  map[int]string // by watch descriptor
+}
+
+//
+func newBackend() (backend, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, fmt.Errorf("cannot initialize inotify: %v", err)
+	}
+	// a non-blocking file goes through the runtime poller, so that closing it
+	// ends a pending read; calling Fd() on it would switch it back to blocking
+	// mode, so the raw descriptor is kept for adding watches
+	return &inotifyBackend{
+		fd:   fd,
+		file: os.NewFile(uintptr(fd), "inotify"),
+		dirs: make(map[int]string),
+	}, nil
+}
+
+//
+func (b *inotifyBackend) add(dir string) error {
+	wd, err := syscall.InotifyAddWatch(b.fd, dir, inotifyMask)
+	if err != nil {
+		return fmt.Errorf("cannot watch '%s': %v", dir, err)
+	}
+	b.mutex.Lock()
+	b.dirs[wd] = dir
+	b.mutex.Unlock()
+	return nil
+}
+
+//
+func (b *inotifyBackend) run(changed func(dir, name string)) {
+
+	buf := make([]byte, 64*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1))
+
+	for {
+		n, err := b.file.Read(buf)
+		if err != nil {
+			if !isClosed(err) {
+				log.Errorf("error reading inotify events: %v", err)
+			}
+			return
+		}
+
+		for off := 0; off+syscall.SizeofInotifyEvent <= n; {
+			ev := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[off]))
+			start := off + syscall.SizeofInotifyEvent
+			end := start + int(ev.Len)
+			if end > n {
+				break
+			}
+			name := string(bytes.TrimRight(buf[start:end], "\x00"))
+			off = end
+
+			if ev.Mask&syscall.IN_Q_OVERFLOW != 0 {
+				log.Warn("inotify event queue overflow")
+				continue
+			}
+
+			b.mutex.Lock()
+			dir, ok := b.dirs[int(ev.Wd)]
+			b.mutex.Unlock()
+			if ok {
+				changed(dir, name)
+			}
+		}
+	}
+}
+
+//
+func (b *inotifyBackend) close() error {
+	return b.file.Close()
+}
+
+//
+func isClosed(err error) bool {
+	if pe, ok := err.(*os.PathError); ok {
+		err = pe.Err
+	}
+	return err == os.ErrClosed
+}
@@ -0,0 +1,119 @@
+//go:build !linux
+// +build !linux
+
+/*
+	Copyright 2020 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package watch
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// PollInterval is the interval at which watched directories are checked for
+// changes on platforms without inotify
+var PollInterval = 2 * time.Second
+
+// pollingBackend watches directories by periodically comparing modification
+// times and sizes of the files in them
+type pollingBackend struct {
+	mutex sync.Mutex
+	dirs  map[string]map[string]os.FileInfo
+	done  chan bool
+}
+
+//
+func newBackend() (backend, error) {
+	return &pollingBackend{
+		dirs: make(map[string]map[string]os.FileInfo),
+		done: make(chan bool),
+	}, nil
+}
+
+//
+func (b *pollingBackend) add(dir string) error {
+	files, err := scan(dir)
+	if err != nil {
+		return err
+	}
+	b.mutex.Lock()
+	b.dirs[dir] = files
+	b.mutex.Unlock()
+	return nil
+}
+
+//
+func (b *pollingBackend) run(changed func(dir, name string)) {
+
+	ticker := time.NewTicker(PollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-b.done:
+			return
+		}
+
+		b.mutex.Lock()
+		for dir, before := range b.dirs {
+			after, err := scan(dir)
+			if err != nil {
+				continue
+			}
+			for name, fi := range after {
+				if old, ok := before[name]; !ok ||
+					!old.ModTime().Equal(fi.ModTime()) || old.Size() != fi.Size() {
+					changed(dir, name)
+				}
+			}
+			for name := range before {
+				if _, ok := after[name]; !ok {
+					changed(dir, name)
+				}
+			}
+			b.dirs[dir] = after
+		}
+		b.mutex.Unlock()
+	}
+}
+
+//
+func (b *pollingBackend) close() error {
+	close(b.done)
+	return nil
+}
+
+// scan returns the infos of all files in dir, following symlinks
+func scan(dir string) (map[string]os.FileInfo, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	ret := make(map[string]os.FileInfo, len(entries))
+	for _, e := range entries {
+		if fi, err := os.Stat(filepath.Join(dir, e.Name())); err == nil {
+			ret[e.Name()] = fi
+		} else {
+			ret[e.Name()] = e
+		}
+	}
+	return ret, nil
+}
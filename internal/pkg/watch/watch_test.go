@@ -0,0 +1,142 @@
+/*
+	Copyright 2020 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package watch
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/xelalexv/dregsy/internal/pkg/test"
+)
+
+//
+func init() {
+	Settle = 100 * time.Millisecond
+}
+
+//
+func TestWatchFile(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	dir, err := ioutil.TempDir("", "dregsy-watch-")
+	th.AssertNoError(err)
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "config.yaml")
+	other := filepath.Join(dir, "other.yaml")
+	th.AssertNoError(ioutil.WriteFile(file, []byte("a"), 0644))
+
+	w, err := New(file)
+	th.AssertNoError(err)
+	defer w.Close()
+
+	// unrelated files in the same dir don't matter
+	th.AssertNoError(ioutil.WriteFile(other, []byte("a"), 0644))
+	expectNoChange(th, w)
+
+	// several writes are reported once
+	th.AssertNoError(ioutil.WriteFile(file, []byte("b"), 0644))
+	th.AssertNoError(ioutil.WriteFile(file, []byte("c"), 0644))
+	expectChange(th, w, file)
+	expectNoChange(th, w)
+
+	// replacing the file, as editors do
+	th.AssertNoError(ioutil.WriteFile(other, []byte("d"), 0644))
+	th.AssertNoError(os.Rename(other, file))
+	expectChange(th, w, file)
+}
+
+//
+func TestWatchDir(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	dir, err := ioutil.TempDir("", "dregsy-watch-")
+	th.AssertNoError(err)
+	defer os.RemoveAll(dir)
+
+	w, err := New(dir)
+	th.AssertNoError(err)
+
+	file := filepath.Join(dir, "mappings.yaml")
+	th.AssertNoError(ioutil.WriteFile(file, []byte("a"), 0644))
+	expectChange(th, w, dir)
+
+	th.AssertNoError(os.Remove(file))
+	expectChange(th, w, dir)
+
+	th.AssertNoError(w.Close())
+	th.AssertNoError(w.Close())
+	_, open := <-w.Changes()
+	th.AssertFalse(open)
+
+	_, err = New(filepath.Join(dir, "missing"))
+	th.AssertError(err, "no such file or directory")
+}
+
+//
+func TestCloseStopsBackend(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	dir, err := ioutil.TempDir("", "dregsy-watch-")
+	th.AssertNoError(err)
+	defer os.RemoveAll(dir)
+
+	b, err := newBackend()
+	th.AssertNoError(err)
+	th.AssertNoError(b.add(dir))
+
+	stopped := make(chan bool)
+	go func() {
+		b.run(func(dir, name string) {})
+		close(stopped)
+	}()
+
+	// give run a chance to block in waiting for events
+	time.Sleep(100 * time.Millisecond)
+	th.AssertNoError(b.close())
+
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		th.Fatal("backend still running after close")
+	}
+}
+
+//
+func expectChange(th *test.TestHelper, w *Watcher, path string) {
+	select {
+	case p := <-w.Changes():
+		th.AssertEqual(path, p)
+	case <-time.After(5 * time.Second):
+		th.Fatal("no change reported")
+	}
+}
+
+//
+func expectNoChange(th *test.TestHelper, w *Watcher) {
+	select {
+	case p := <-w.Changes():
+		th.Fatalf("unexpected change reported: %s", p)
+	case <-time.After(2 * Settle):
+	}
+}